@@ -0,0 +1,128 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mattermost/calls-offloader/service"
+	"github.com/mattermost/calls-offloader/service/store"
+)
+
+func runCommand(cfg service.Config, cmd string, args []string) error {
+	switch cmd {
+	case "migrate-store":
+		return migrateStore(cfg, args)
+	case "backup":
+		return backupStore(cfg, args)
+	case "restore":
+		return restoreStore(cfg, args)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+// migrateStore copies a bitcask data directory into the configured SQLite store.
+func migrateStore(cfg service.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate-store", flag.ContinueOnError)
+	from := fs.String("from", "", "Path to the bitcask data directory to migrate from.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == "" {
+		return errors.New("the -from flag is required")
+	}
+
+	if cfg.Store.GetDriver() != store.DriverSQLite {
+		return fmt.Errorf("the configured store driver should be %q", store.DriverSQLite)
+	}
+
+	n, err := store.MigrateBitcaskToSQLite(*from, cfg.Store.DataSource)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("calls-offloader: migrated %d entries from %s to %s", n, *from, cfg.Store.DataSource)
+
+	return nil
+}
+
+// backupStore writes a snapshot of the configured store to a file. The store
+// can't be opened while the service is running with the bitcask driver, in
+// which case the /store/snapshot admin endpoint should be used instead.
+func backupStore(cfg service.Config, args []string) (err error) {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("o", "", "Path to the snapshot file to create.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return errors.New("the -o flag is required")
+	}
+
+	st, err := store.NewWithDriver(cfg.Store.GetDriver(), cfg.Store.DataSource)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer st.Close()
+
+	// The snapshot contains credentials so it shouldn't be readable by others.
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to close snapshot file: %w", closeErr)
+		}
+		if err != nil {
+			_ = os.Remove(*out)
+		}
+	}()
+
+	manifest, err := store.WriteSnapshot(st, cfg.Store.GetDriver(), f)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("calls-offloader: backed up %d entries to %s", manifest.Entries, *out)
+
+	return nil
+}
+
+// restoreStore loads a snapshot file into the configured, empty, store.
+func restoreStore(cfg service.Config, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := fs.String("from", "", "Path to the snapshot file to restore.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == "" {
+		return errors.New("the -from flag is required")
+	}
+
+	f, err := os.Open(*from)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer f.Close()
+
+	manifest, err := store.RestoreSnapshot(f, cfg.Store.GetDriver(), cfg.Store.DataSource)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("calls-offloader: restored %d entries, taken at %s, to %s", manifest.Entries,
+		time.UnixMilli(manifest.CreatedAt).UTC().Format(time.RFC3339), cfg.Store.DataSource)
+
+	return nil
+}
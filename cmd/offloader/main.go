@@ -50,6 +50,13 @@ func main() {
 		log.Fatalf("calls-offloader: failed to validate config: %s", err.Error())
 	}
 
+	if cmd := flag.Arg(0); cmd != "" {
+		if err := runCommand(cfg, cmd, flag.Args()[1:]); err != nil {
+			log.Fatalf("calls-offloader: %s failed: %s", cmd, err.Error())
+		}
+		return
+	}
+
 	service, err := service.New(cfg)
 	if err != nil {
 		log.Fatalf("calls-offloader: failed to create service: %s", err.Error())
@@ -60,8 +67,14 @@ func main() {
 	}
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	signal.Notify(sig, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
+		}
+		// Errors are logged by the service, which keeps serving the previous certificates.
+		_ = service.ReloadCertificates()
+	}
 
 	if err := service.Stop(); err != nil {
 		log.Fatalf("calls-offloader: failed to stop service: %s", err.Error())
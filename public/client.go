@@ -13,6 +13,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/mattermost/calls-offloader/public/job"
@@ -22,6 +23,16 @@ var (
 	ErrUnauthorized = errors.New("unauthorized")
 )
 
+// ClientInfo holds the details of a registered client. Timestamps are in
+// Unix milliseconds, with a zero CreatedAt for clients registered by older
+// versions of the service.
+type ClientInfo struct {
+	ID         string   `json:"clientID"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"createdAt"`
+	LastSeenAt int64    `json:"lastSeenAt"`
+}
+
 type Client struct {
 	cfg        *ClientConfig
 	httpClient *http.Client
@@ -30,7 +41,8 @@ type Client struct {
 }
 
 type ClientConfig struct {
-	httpURL string
+	httpURL    string
+	socketPath string
 
 	ClientID string
 	AuthKey  string
@@ -47,6 +59,18 @@ func (c *ClientConfig) Parse() error {
 		return fmt.Errorf("failed to parse url: %w", err)
 	}
 
+	// Unix socket URLs are in the form unix:///path/to.sock
+	if u.Scheme == "unix" {
+		if u.Path == "" {
+			return fmt.Errorf("invalid url path: should not be empty")
+		}
+		c.socketPath = u.Path
+		// Requests still need a valid HTTP URL even though the host is
+		// ignored when dialing the socket.
+		c.httpURL = "http://unix"
+		return nil
+	}
+
 	if u.Host == "" {
 		return fmt.Errorf("invalid url host: should not be empty")
 	}
@@ -81,6 +105,12 @@ func NewClient(cfg ClientConfig, opts ...ClientOption) (*Client, error) {
 	}
 	c.cfg = &cfg
 
+	if cfg.socketPath != "" {
+		// Applied first so that a dialing function explicitly passed by the
+		// caller takes precedence.
+		opts = append([]ClientOption{WithDialFunc(unixSocketDialFn(cfg.socketPath))}, opts...)
+	}
+
 	for _, opt := range opts {
 		if err := opt(&c); err != nil {
 			return nil, fmt.Errorf("failed to apply option: %w", err)
@@ -109,12 +139,32 @@ func NewClient(cfg ClientConfig, opts ...ClientOption) (*Client, error) {
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
+	if cfg.socketPath != "" {
+		transport.Proxy = nil
+	}
+
 	c.httpClient = &http.Client{Transport: transport}
 
 	return &c, nil
 }
 
+func unixSocketDialFn(socketPath string) DialContextFn {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+	}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+}
+
 func (c *Client) Register(clientID string, authKey string) error {
+	return c.RegisterWithScopes(clientID, authKey, nil)
+}
+
+// RegisterWithScopes registers a client granting it the given scopes
+// (e.g. "jobs:read"). The default scopes are granted if none are given.
+// Specifying scopes requires the calling client to have the clients:admin scope.
+func (c *Client) RegisterWithScopes(clientID string, authKey string, scopes []string) error {
 	if c.httpClient == nil {
 		return fmt.Errorf("http client is not initialized")
 	}
@@ -123,6 +173,9 @@ func (c *Client) Register(clientID string, authKey string) error {
 		"clientID": clientID,
 		"authKey":  authKey,
 	}
+	if len(scopes) > 0 {
+		reqData["scopes"] = strings.Join(scopes, " ")
+	}
 
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(reqData); err != nil {
@@ -246,6 +299,162 @@ func (c *Client) Login(clientID string, authKey string) error {
 	return fmt.Errorf("request failed with status %s", resp.Status)
 }
 
+// Logout revokes the bearer token obtained through Login.
+func (c *Client) Logout() error {
+	if c.httpClient == nil {
+		return fmt.Errorf("http client is not initialized")
+	}
+
+	req, err := http.NewRequest("POST", c.cfg.httpURL+"/logout", nil)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.authToken)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		c.authToken = ""
+		return nil
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+
+	respData := map[string]any{}
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return fmt.Errorf("decoding http response failed: %w", err)
+	}
+	if errMsg, _ := respData["error"].(string); errMsg != "" {
+		return fmt.Errorf("request failed: %s", errMsg)
+	}
+	return fmt.Errorf("request failed with status %s", resp.Status)
+}
+
+// RotateKey replaces the auth key of the given client. The previous key
+// remains valid for the overlap window configured on the service.
+func (c *Client) RotateKey(clientID string, authKey string) error {
+	if c.httpClient == nil {
+		return fmt.Errorf("http client is not initialized")
+	}
+
+	reqData := map[string]string{
+		"authKey": authKey,
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(reqData); err != nil {
+		return fmt.Errorf("failed to encode body: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", c.cfg.httpURL+"/clients/"+url.PathEscape(clientID)+"/rotate", &buf)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.SetBasicAuth(c.cfg.ClientID, c.cfg.AuthKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		if clientID == c.cfg.ClientID {
+			c.cfg.AuthKey = authKey
+		}
+		return nil
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+
+	respData := map[string]any{}
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return fmt.Errorf("decoding http response failed: %w", err)
+	}
+	if errMsg, _ := respData["error"].(string); errMsg != "" {
+		return fmt.Errorf("request failed: %s", errMsg)
+	}
+	return fmt.Errorf("request failed with status %s", resp.Status)
+}
+
+// ListClients returns all the registered clients. It requires the
+// clients:admin scope.
+func (c *Client) ListClients() ([]ClientInfo, error) {
+	if c.httpClient == nil {
+		return nil, fmt.Errorf("http client is not initialized")
+	}
+
+	req, err := http.NewRequest("GET", c.cfg.httpURL+"/clients", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.SetBasicAuth(c.cfg.ClientID, c.cfg.AuthKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		var clients []ClientInfo
+		if err := json.NewDecoder(resp.Body).Decode(&clients); err != nil {
+			return nil, fmt.Errorf("decoding http response failed: %w", err)
+		}
+		return clients, nil
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
+
+	respData := map[string]any{}
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return nil, fmt.Errorf("decoding http response failed: %w", err)
+	}
+	if errMsg, _ := respData["error"].(string); errMsg != "" {
+		return nil, fmt.Errorf("request failed: %s", errMsg)
+	}
+	return nil, fmt.Errorf("request failed with status %s", resp.Status)
+}
+
+// DeleteSessions invalidates all the sessions of the given client,
+// forcing it to log in again.
+func (c *Client) DeleteSessions(clientID string) error {
+	if c.httpClient == nil {
+		return fmt.Errorf("http client is not initialized")
+	}
+
+	req, err := http.NewRequest("DELETE", c.cfg.httpURL+"/clients/"+url.PathEscape(clientID)+"/sessions", nil)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	req.SetBasicAuth(c.cfg.ClientID, c.cfg.AuthKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+
+	respData := map[string]any{}
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return fmt.Errorf("decoding http response failed: %w", err)
+	}
+	if errMsg, _ := respData["error"].(string); errMsg != "" {
+		return fmt.Errorf("request failed: %s", errMsg)
+	}
+	return fmt.Errorf("request failed with status %s", resp.Status)
+}
+
 func (c *Client) CreateJob(cfg job.Config) (job.Job, error) {
 	if c.httpClient == nil {
 		return job.Job{}, fmt.Errorf("http client is not initialized")
@@ -397,6 +606,82 @@ func (c *Client) Init(cfg job.ServiceConfig) error {
 	return fmt.Errorf("request failed with status %s", resp.Status)
 }
 
+func (c *Client) GetInitStatus() (job.ServiceStatus, error) {
+	if c.httpClient == nil {
+		return job.ServiceStatus{}, fmt.Errorf("http client is not initialized")
+	}
+
+	req, err := http.NewRequest("GET", c.cfg.httpURL+"/jobs/init", nil)
+	if err != nil {
+		return job.ServiceStatus{}, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.SetBasicAuth(c.cfg.ClientID, c.cfg.AuthKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return job.ServiceStatus{}, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		var status job.ServiceStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return job.ServiceStatus{}, fmt.Errorf("decoding http response failed: %w", err)
+		}
+		return status, nil
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return job.ServiceStatus{}, ErrUnauthorized
+	}
+
+	respData := map[string]any{}
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return job.ServiceStatus{}, fmt.Errorf("decoding http response failed: %w", err)
+	}
+	if errMsg, _ := respData["error"].(string); errMsg != "" {
+		return job.ServiceStatus{}, fmt.Errorf("request failed: %s", errMsg)
+	}
+	return job.ServiceStatus{}, fmt.Errorf("request failed with status %s", resp.Status)
+}
+
+// GetJobSchemas returns the JSON Schemas the input data of jobs is validated
+// against, per job type and runner version.
+func (c *Client) GetJobSchemas() (job.InputDataSchemas, error) {
+	if c.httpClient == nil {
+		return nil, fmt.Errorf("http client is not initialized")
+	}
+
+	req, err := http.NewRequest("GET", c.cfg.httpURL+"/jobs/schemas", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.SetBasicAuth(c.cfg.ClientID, c.cfg.AuthKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		var schemas job.InputDataSchemas
+		if err := json.NewDecoder(resp.Body).Decode(&schemas); err != nil {
+			return nil, fmt.Errorf("decoding http response failed: %w", err)
+		}
+		return schemas, nil
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
+
+	respData := map[string]any{}
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return nil, fmt.Errorf("decoding http response failed: %w", err)
+	}
+	if errMsg, _ := respData["error"].(string); errMsg != "" {
+		return nil, fmt.Errorf("request failed: %s", errMsg)
+	}
+	return nil, fmt.Errorf("request failed with status %s", resp.Status)
+}
+
 func (c *Client) Close() error {
 	if c.httpClient != nil {
 		c.httpClient.CloseIdleConnections()
@@ -437,5 +722,5 @@ func (c *Client) AuthToken() string {
 }
 
 func (c *Client) URL() string {
-	return c.cfg.httpURL
+	return c.cfg.URL
 }
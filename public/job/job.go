@@ -4,9 +4,12 @@
 package job
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -25,15 +28,93 @@ const (
 	ImageRegistryDefault           = "mattermost"
 
 	InputDataSiteURLKey = "site_url"
+
+	// InputDataRedactedValue replaces secret input data values in API
+	// responses and logs.
+	InputDataRedactedValue = "[redacted]"
+
+	// InputDataFileEnvSuffix is appended to the environment variable of a
+	// secret delivered to the job as a file. The variable then holds the
+	// path to the file rather than the secret itself.
+	InputDataFileEnvSuffix = "_FILE"
 )
 
+// SecretInputDataKeys declares, per job type, the input data keys holding
+// secrets in addition to those following the naming convention (see
+// IsSecretInputDataKey).
+var SecretInputDataKeys = map[Type][]string{
+	TypeRecording:    {"auth_token"},
+	TypeTranscribing: {"auth_token", "transcribe_api_options"},
+}
+
+// secretInputDataKeySuffixes lets clients mark any input data key as secret
+// through its name (e.g. "bot_token" or "api_key").
+var secretInputDataKeySuffixes = []string{"_token", "_secret", "_password", "_key"}
+
+// inputDataEnvKeyRE restricts input data keys to those mapping to portable
+// environment variable names.
+var inputDataEnvKeyRE = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+var inputDataEnvPrefixRE = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// reservedEnvNames can't be set through input data as they either control the
+// job process itself or are set by the job services.
+var reservedEnvNames = []string{
+	"DEV_MODE",
+	"TEST_MODE",
+	"PATH",
+	"HOME",
+	"HOSTNAME",
+	"USER",
+	"SHELL",
+	"PWD",
+	"TMPDIR",
+	"GODEBUG",
+	"GOGC",
+	"GOMAXPROCS",
+	"GOMEMLIMIT",
+	"GOTRACEBACK",
+}
+
+var reservedEnvNamePrefixes = []string{
+	"LD_",
+	"KUBERNETES_",
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// ErrNotFound is returned by job services when a job, or its underlying
+// resources, no longer exists (e.g. after being removed by retention).
+var ErrNotFound = errors.New("job not found")
+
+// ErrContainerNotFound is returned by job services when fetching the logs of
+// a container that's not part of the job.
+var ErrContainerNotFound = errors.New("container not found")
+
 type ServiceConfig struct {
 	Runners []string
 }
 
+// ServiceStatus reports the progress of the job service initialization
+// (e.g. pre-pulling of job runners).
+type ServiceStatus struct {
+	Runners []string `json:"runners"`
+	// Ready is true when all the runners are available to start jobs
+	// without further delay.
+	Ready bool `json:"ready"`
+	// NodesDesired is the number of nodes the runners should be made
+	// available on.
+	NodesDesired int `json:"nodes_desired"`
+	// NodesReady is the number of nodes the runners are available on.
+	NodesReady int `json:"nodes_ready"`
+}
+
 type Job struct {
 	Config
-	ID         string         `json:"id"`
+	ID string `json:"id"`
+	// ClientID is the ID of the client that created the job, which is the
+	// only one allowed to access it besides admins.
+	ClientID   string         `json:"client_id,omitempty"`
 	StartAt    int64          `json:"start_at"`
 	StopAt     int64          `json:"stop_at,omitempty"`
 	OutputData map[string]any `json:"output_data,omitempty"`
@@ -56,12 +137,234 @@ func (d InputData) SetSiteURL(siteURL string) {
 	d[InputDataSiteURLKey] = siteURL
 }
 
-func (d InputData) ToEnv() []string {
-	env := make([]string, 0, len(d))
+// IsSecretInputDataKey returns whether the value of the given input data key
+// is a secret for jobs of type t. Keys are compared case insensitively since
+// these are passed to jobs as uppercase environment variables.
+func IsSecretInputDataKey(t Type, key string) bool {
+	key = strings.ToLower(key)
+	for _, suffix := range secretInputDataKeySuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	for _, secretKey := range SecretInputDataKeys[t] {
+		if key == secretKey {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSecrets returns whether the input data holds any secret for jobs of type
+// t.
+func (d InputData) HasSecrets(t Type) bool {
+	for k := range d {
+		if IsSecretInputDataKey(t, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns a copy of the input data where secret values for jobs of
+// type t are replaced with InputDataRedactedValue.
+func (d InputData) Redacted(t Type) InputData {
+	if d == nil {
+		return nil
+	}
+	redacted := make(InputData, len(d))
+	for k, v := range d {
+		if IsSecretInputDataKey(t, k) {
+			v = InputDataRedactedValue
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// Secrets returns a copy of the input data holding only the secret values for
+// jobs of type t.
+func (d InputData) Secrets(t Type) InputData {
+	if d == nil {
+		return nil
+	}
+	secrets := make(InputData, len(d))
 	for k, v := range d {
-		env = append(env, fmt.Sprintf("%s=%v", strings.ToUpper(k), v))
+		if IsSecretInputDataKey(t, k) {
+			secrets[k] = v
+		}
 	}
-	return env
+	return secrets
+}
+
+// WithoutSecrets returns a copy of the input data without the secret values
+// for jobs of type t.
+func (d InputData) WithoutSecrets(t Type) InputData {
+	if d == nil {
+		return nil
+	}
+	data := make(InputData, len(d))
+	for k, v := range d {
+		if !IsSecretInputDataKey(t, k) {
+			data[k] = v
+		}
+	}
+	return data
+}
+
+// InputDataEnvError is returned when input data can't be safely passed to jobs
+// as environment variables.
+type InputDataEnvError struct {
+	Errors []InputDataFieldError
+}
+
+func (e *InputDataEnvError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fieldErr := range e.Errors {
+		msgs = append(msgs, fieldErr.Field+": "+fieldErr.Message)
+	}
+	return "invalid input data: " + strings.Join(msgs, "; ")
+}
+
+// ToEnvMap maps the input data to environment variables, keyed by name. Names
+// are the uppercased keys with the given prefix prepended. Scalar values are
+// formatted as is while any other value (e.g. objects or arrays) is JSON
+// encoded. An *InputDataEnvError is returned if any key can't be mapped.
+func (d InputData) ToEnvMap(prefix string) (map[string]string, error) {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	env := make(map[string]string, len(d))
+	var fieldErrs []InputDataFieldError
+	addErr := func(key, msg string) {
+		fieldErrs = append(fieldErrs, InputDataFieldError{
+			Field:   "/" + jsonPointerEscaper.Replace(key),
+			Message: msg,
+		})
+	}
+
+	for _, k := range keys {
+		if !inputDataEnvKeyRE.MatchString(k) {
+			addErr(k, "key should start with a letter and only contain letters, digits and underscores")
+			continue
+		}
+
+		name := InputDataEnvName(prefix, k)
+		if isReservedEnvName(name) {
+			addErr(k, fmt.Sprintf("%s is a reserved environment variable", name))
+			continue
+		}
+		if _, ok := env[name]; ok {
+			addErr(k, fmt.Sprintf("%s is set by another key", name))
+			continue
+		}
+
+		val, err := inputDataEnvValue(d[k])
+		if err != nil {
+			addErr(k, err.Error())
+			continue
+		}
+		env[name] = val
+	}
+
+	// Secrets delivered as files are referenced through <NAME>_FILE
+	// variables which shouldn't be overridable.
+	for _, k := range keys {
+		name := InputDataEnvName(prefix, k)
+		baseName, ok := strings.CutSuffix(name, InputDataFileEnvSuffix)
+		if !ok {
+			continue
+		}
+		if _, ok := env[baseName]; ok {
+			addErr(k, fmt.Sprintf("%s is reserved for the file holding %s", name, baseName))
+		}
+	}
+
+	if len(fieldErrs) > 0 {
+		return nil, &InputDataEnvError{Errors: fieldErrs}
+	}
+
+	return env, nil
+}
+
+// SplitEnvMap maps the input data to environment variables like ToEnvMap,
+// returning the variables holding secrets for jobs of type t separately.
+func (d InputData) SplitEnvMap(t Type, prefix string) (map[string]string, map[string]string, error) {
+	env, err := d.ToEnvMap(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	secrets := make(map[string]string)
+	for k := range d.Secrets(t) {
+		name := InputDataEnvName(prefix, k)
+		secrets[name] = env[name]
+		delete(env, name)
+	}
+	return env, secrets, nil
+}
+
+// ToEnv returns the input data as a list of NAME=value environment variables.
+// See ToEnvMap for the mapping rules.
+func (d InputData) ToEnv(prefix string) ([]string, error) {
+	envMap, err := d.ToEnvMap(prefix)
+	if err != nil {
+		return nil, err
+	}
+	env := make([]string, 0, len(envMap))
+	for name, val := range envMap {
+		env = append(env, name+"="+val)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// InputDataEnvName returns the name of the environment variable the given
+// input data key is passed to jobs through.
+func InputDataEnvName(prefix, key string) string {
+	return prefix + strings.ToUpper(key)
+}
+
+// InputDataEnvPrefixIsValid checks that prefix can be prepended to input data
+// environment variables.
+func InputDataEnvPrefixIsValid(prefix string) error {
+	if prefix != "" && !inputDataEnvPrefixRE.MatchString(prefix) {
+		return fmt.Errorf("prefix should start with an uppercase letter and only contain uppercase letters, digits and underscores")
+	}
+	return nil
+}
+
+func inputDataEnvValue(v any) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return val, nil
+	case bool, json.Number, float32, float64, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%v", val), nil
+	default:
+		js, err := json.Marshal(val)
+		if err != nil {
+			return "", fmt.Errorf("value can't be JSON encoded: %w", err)
+		}
+		return string(js), nil
+	}
+}
+
+func isReservedEnvName(name string) bool {
+	for _, reserved := range reservedEnvNames {
+		if name == reserved {
+			return true
+		}
+	}
+	for _, prefix := range reservedEnvNamePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
 type Config struct {
@@ -71,8 +374,51 @@ type Config struct {
 	InputData      InputData `json:"input_data,omitempty"`
 }
 
+// Redacted returns a copy of the config with secret input data redacted.
+func (c Config) Redacted() Config {
+	c.InputData = c.InputData.Redacted(c.Type)
+	return c
+}
+
+// LogClone implements logr.LogCloner so that logged configs are redacted.
+func (c Config) LogClone() any {
+	return c.Redacted()
+}
+
+// Redacted returns a copy of the job with secret input data redacted. It
+// should be used whenever a job is returned through the API.
+func (j Job) Redacted() Job {
+	j.Config = j.Config.Redacted()
+	return j
+}
+
+// LogClone implements logr.LogCloner so that logged jobs are redacted.
+func (j Job) LogClone() any {
+	return j.Redacted()
+}
+
+// InputDataSchemas maps job types to the JSON Schemas of their input data,
+// keyed by the runner version from which they apply (e.g. "v0.6.0").
+type InputDataSchemas map[Type]map[string]json.RawMessage
+
+// InputDataFieldError describes why the input data failed validation.
+type InputDataFieldError struct {
+	// The location of the invalid value, as a JSON pointer relative to the
+	// input data (e.g. "/call_id"). Empty for errors about the input data as
+	// a whole (e.g. missing properties).
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
 type StopCb func(job Job, success bool) error
 
+// LogsOptions holds optional parameters used when fetching job logs.
+type LogsOptions struct {
+	// Container restricts the logs to the container with the given name.
+	// An empty value means logs from all the containers of the job.
+	Container string
+}
+
 func (c ServiceConfig) IsValid(registry string) error {
 	if len(c.Runners) == 0 {
 		return fmt.Errorf("invalid empty Runners")
@@ -4,6 +4,7 @@
 package job
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 
@@ -285,7 +286,8 @@ func TestInputData(t *testing.T) {
 	t.Run("ToEnv", func(t *testing.T) {
 		t.Run("nil", func(t *testing.T) {
 			var inputData InputData
-			env := inputData.ToEnv()
+			env, err := inputData.ToEnv("")
+			require.NoError(t, err)
 			require.Empty(t, env)
 		})
 
@@ -297,13 +299,182 @@ func TestInputData(t *testing.T) {
 				"output_format": "format",
 			}
 
-			env := inputData.ToEnv()
-			require.ElementsMatch(t, []string{
-				"SITE_URL=http://localhost:8065",
+			env, err := inputData.ToEnv("")
+			require.NoError(t, err)
+			require.Equal(t, []string{
 				"CALL_ID=callID",
-				"VIDEO_RATE=1000",
 				"OUTPUT_FORMAT=format",
+				"SITE_URL=http://localhost:8065",
+				"VIDEO_RATE=1000",
+			}, env)
+		})
+
+		t.Run("prefix", func(t *testing.T) {
+			inputData := InputData{
+				"call_id": "callID",
+				"path":    "/bin",
+			}
+
+			env, err := inputData.ToEnv("JOB_")
+			require.NoError(t, err)
+			require.Equal(t, []string{
+				"JOB_CALL_ID=callID",
+				"JOB_PATH=/bin",
+			}, env)
+		})
+
+		t.Run("values", func(t *testing.T) {
+			inputData := InputData{
+				"empty":   nil,
+				"enabled": true,
+				"rate":    1.5,
+				"number":  json.Number("42"),
+				"options": map[string]any{"model": "base", "threads": 2},
+				"list":    []any{"a", 1},
+			}
+
+			env, err := inputData.ToEnvMap("")
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{
+				"EMPTY":   "",
+				"ENABLED": "true",
+				"RATE":    "1.5",
+				"NUMBER":  "42",
+				"OPTIONS": `{"model":"base","threads":2}`,
+				"LIST":    `["a",1]`,
 			}, env)
 		})
+
+		t.Run("invalid", func(t *testing.T) {
+			inputData := InputData{
+				"call-id":    "callID",
+				"call id":    "callID",
+				"a=b":        "c",
+				"a/b":        "c",
+				"_call_id":   "callID",
+				"dev_mode":   "true",
+				"Path":       "/tmp",
+				"ld_preload": "lib.so",
+				"call_ID":    "callID",
+				"CALL_ID":    "callID",
+				"func":       func() {},
+			}
+
+			env, err := inputData.ToEnv("")
+			require.Nil(t, env)
+			var envErr *InputDataEnvError
+			require.ErrorAs(t, err, &envErr)
+			require.Equal(t, []InputDataFieldError{
+				{Field: "/Path", Message: "PATH is a reserved environment variable"},
+				{Field: "/_call_id", Message: "key should start with a letter and only contain letters, digits and underscores"},
+				{Field: "/a~1b", Message: "key should start with a letter and only contain letters, digits and underscores"},
+				{Field: "/a=b", Message: "key should start with a letter and only contain letters, digits and underscores"},
+				{Field: "/call id", Message: "key should start with a letter and only contain letters, digits and underscores"},
+				{Field: "/call-id", Message: "key should start with a letter and only contain letters, digits and underscores"},
+				{Field: "/call_ID", Message: "CALL_ID is set by another key"},
+				{Field: "/dev_mode", Message: "DEV_MODE is a reserved environment variable"},
+				{Field: "/func", Message: "value can't be JSON encoded: json: unsupported type: func()"},
+				{Field: "/ld_preload", Message: "LD_PRELOAD is a reserved environment variable"},
+			}, envErr.Errors)
+			require.Contains(t, err.Error(), "invalid input data: /Path: PATH is a reserved environment variable; ")
+		})
+
+		t.Run("file suffix", func(t *testing.T) {
+			inputData := InputData{
+				"auth_token":      "secretToken",
+				"auth_token_file": "/tmp/token",
+				"config_file":     "/tmp/config",
+			}
+
+			_, err := inputData.ToEnv("")
+			require.EqualError(t, err, "invalid input data: /auth_token_file: AUTH_TOKEN_FILE is reserved for the file holding AUTH_TOKEN")
+		})
+	})
+
+	t.Run("SplitEnvMap", func(t *testing.T) {
+		inputData := InputData{
+			"call_id":    "callID",
+			"auth_token": "secretToken",
+		}
+
+		env, secrets, err := inputData.SplitEnvMap(TypeRecording, "JOB_")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"JOB_CALL_ID": "callID"}, env)
+		require.Equal(t, map[string]string{"JOB_AUTH_TOKEN": "secretToken"}, secrets)
+
+		_, _, err = InputData{"dev_mode": true}.SplitEnvMap(TypeRecording, "")
+		require.Error(t, err)
+	})
+
+	t.Run("InputDataEnvPrefixIsValid", func(t *testing.T) {
+		require.NoError(t, InputDataEnvPrefixIsValid(""))
+		require.NoError(t, InputDataEnvPrefixIsValid("CALLS_JOB_"))
+		require.Error(t, InputDataEnvPrefixIsValid("job_"))
+		require.Error(t, InputDataEnvPrefixIsValid("1JOB_"))
+		require.Error(t, InputDataEnvPrefixIsValid("JOB-"))
+	})
+}
+
+func TestInputDataSecrets(t *testing.T) {
+	inputData := InputData{
+		"site_url":               "http://localhost:8065",
+		"auth_token":             "secretToken",
+		"AZURE_SPEECH_KEY":       "speechKey",
+		"transcribe_api_options": map[string]any{"api_key": "key"},
+		"call_id":                "callID",
+	}
+
+	t.Run("IsSecretInputDataKey", func(t *testing.T) {
+		require.True(t, IsSecretInputDataKey(TypeRecording, "auth_token"))
+		require.True(t, IsSecretInputDataKey(TypeRecording, "AUTH_TOKEN"))
+		require.True(t, IsSecretInputDataKey(TypeRecording, "db_password"))
+		require.True(t, IsSecretInputDataKey(TypeTranscribing, "transcribe_api_options"))
+		require.False(t, IsSecretInputDataKey(TypeRecording, "transcribe_api_options"))
+		require.False(t, IsSecretInputDataKey(TypeRecording, "call_id"))
+		require.False(t, IsSecretInputDataKey(TypeRecording, "token"))
+	})
+
+	t.Run("HasSecrets", func(t *testing.T) {
+		require.True(t, inputData.HasSecrets(TypeRecording))
+		require.False(t, InputData{"call_id": "callID"}.HasSecrets(TypeRecording))
+		require.False(t, InputData(nil).HasSecrets(TypeRecording))
+	})
+
+	t.Run("Redacted", func(t *testing.T) {
+		require.Nil(t, InputData(nil).Redacted(TypeRecording))
+		require.Equal(t, InputData{
+			"site_url":               "http://localhost:8065",
+			"auth_token":             InputDataRedactedValue,
+			"AZURE_SPEECH_KEY":       InputDataRedactedValue,
+			"transcribe_api_options": InputDataRedactedValue,
+			"call_id":                "callID",
+		}, inputData.Redacted(TypeTranscribing))
+		// The original is left untouched.
+		require.Equal(t, "secretToken", inputData["auth_token"])
+	})
+
+	t.Run("Secrets", func(t *testing.T) {
+		require.Nil(t, InputData(nil).Secrets(TypeRecording))
+		require.Equal(t, InputData{
+			"auth_token":       "secretToken",
+			"AZURE_SPEECH_KEY": "speechKey",
+		}, inputData.Secrets(TypeRecording))
+	})
+
+	t.Run("WithoutSecrets", func(t *testing.T) {
+		require.Nil(t, InputData(nil).WithoutSecrets(TypeRecording))
+		require.Equal(t, InputData{
+			"site_url": "http://localhost:8065",
+			"call_id":  "callID",
+		}, inputData.WithoutSecrets(TypeTranscribing))
+	})
+
+	t.Run("Job", func(t *testing.T) {
+		j := Job{ID: "jobID", Config: Config{Type: TypeRecording, InputData: inputData}}
+		redacted := j.Redacted()
+		require.Equal(t, "jobID", redacted.ID)
+		require.Equal(t, InputDataRedactedValue, redacted.InputData["auth_token"])
+		require.Equal(t, redacted, j.LogClone())
+		require.Equal(t, "secretToken", j.InputData["auth_token"])
 	})
 }
@@ -0,0 +1,123 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+var certWatchInterval = 10 * time.Second
+
+// certReloader serves the TLS certificate found at the given paths, reloading
+// it whenever the files change so that renewed certificates are picked up
+// without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	log      mlog.LoggerIFace
+
+	mut      sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string, log mlog.LoggerIFace) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		log:      log,
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) statFiles() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *certReloader) load() error {
+	// Files are stat'ed before loading so that any change happening in
+	// between gets picked up by the next watch tick.
+	modTimes, statErr := r.statFiles()
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if statErr != nil {
+		return statErr
+	}
+
+	r.mut.Lock()
+	r.cert = &cert
+	r.modTimes = modTimes
+	r.mut.Unlock()
+
+	return nil
+}
+
+// Reload loads the certificate again. On failure the previous certificate
+// keeps being served.
+func (r *certReloader) Reload() error {
+	if err := r.load(); err != nil {
+		r.log.Error("api: failed to reload certificate, keeping the previous one", mlog.Err(err))
+		return fmt.Errorf("failed to reload certificate: %w", err)
+	}
+	r.log.Info("api: certificate reloaded", mlog.String("certFile", r.certFile))
+	return nil
+}
+
+func (r *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.cert, nil
+}
+
+// watch polls the certificate files and reloads them upon modification
+// until stopCh is closed.
+func (r *certReloader) watch(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			modTimes, err := r.statFiles()
+			if err != nil {
+				r.log.Warn("api: failed to stat certificate files", mlog.Err(err))
+				continue
+			}
+
+			r.mut.RLock()
+			changed := modTimes != r.modTimes
+			r.mut.RUnlock()
+
+			if changed {
+				// Errors are logged. Files still being written are picked up on
+				// the next tick since the stored modification times aren't updated.
+				_ = r.Reload()
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	require.NoError(t, err)
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	require.NoError(t, err)
+}
+
+func getCertCommonName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	log, err := mlog.NewLogger()
+	require.NoError(t, err)
+	defer func() {
+		err := log.Shutdown()
+		require.NoError(t, err)
+	}()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	t.Run("missing files", func(t *testing.T) {
+		r, err := newCertReloader(certFile, keyFile, log)
+		require.Error(t, err)
+		require.Nil(t, r)
+	})
+
+	writeTestCert(t, certFile, keyFile, "first")
+
+	t.Run("reload", func(t *testing.T) {
+		r, err := newCertReloader(certFile, keyFile, log)
+		require.NoError(t, err)
+		require.Equal(t, "first", getCertCommonName(t, r))
+
+		writeTestCert(t, certFile, keyFile, "second")
+		err = r.Reload()
+		require.NoError(t, err)
+		require.Equal(t, "second", getCertCommonName(t, r))
+
+		// A broken certificate leaves the previous one in place.
+		err = os.WriteFile(certFile, []byte("invalid"), 0600)
+		require.NoError(t, err)
+		err = r.Reload()
+		require.Error(t, err)
+		require.Equal(t, "second", getCertCommonName(t, r))
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		defaultInterval := certWatchInterval
+		certWatchInterval = 10 * time.Millisecond
+		defer func() {
+			certWatchInterval = defaultInterval
+		}()
+
+		writeTestCert(t, certFile, keyFile, "first")
+		r, err := newCertReloader(certFile, keyFile, log)
+		require.NoError(t, err)
+
+		stopCh := make(chan struct{})
+		doneCh := make(chan struct{})
+		go func() {
+			defer close(doneCh)
+			r.watch(stopCh)
+		}()
+		defer func() {
+			close(stopCh)
+			<-doneCh
+		}()
+
+		// Making sure the modification time changes on filesystems with a
+		// coarse resolution.
+		writeTestCert(t, certFile, keyFile, "second")
+		future := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(certFile, future, future))
+
+		require.Eventually(t, func() bool {
+			return getCertCommonName(t, r) == "second"
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestServerReloadCertificate(t *testing.T) {
+	log, err := mlog.NewLogger()
+	require.NoError(t, err)
+	defer func() {
+		err := log.Shutdown()
+		require.NoError(t, err)
+	}()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first")
+
+	s, err := NewServer(Config{
+		ListenAddress: "localhost:0",
+		TLS: TLSConfig{
+			Enable:   true,
+			CertFile: certFile,
+			CertKey:  keyFile,
+		},
+	}, log)
+	require.NoError(t, err)
+
+	err = s.Start()
+	require.NoError(t, err)
+	defer func() {
+		err := s.Stop()
+		require.NoError(t, err)
+	}()
+
+	getServerCommonName := func() string {
+		conn, err := tls.Dial("tcp", s.Addr(), &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	require.Equal(t, "first", getServerCommonName())
+
+	writeTestCert(t, certFile, keyFile, "second")
+	err = s.ReloadCertificate()
+	require.NoError(t, err)
+	require.Equal(t, "second", getServerCommonName())
+}
@@ -5,12 +5,31 @@ package api
 
 import (
 	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type ClientAuthMode string
+
+const (
+	// ClientAuthNone doesn't request client certificates.
+	ClientAuthNone ClientAuthMode = "none"
+	// ClientAuthVerify verifies client certificates, if provided.
+	ClientAuthVerify ClientAuthMode = "verify"
+	// ClientAuthRequire requires clients to provide a valid certificate.
+	ClientAuthRequire ClientAuthMode = "require"
 )
 
 type TLSConfig struct {
 	Enable   bool
 	CertFile string `toml:"cert_file"`
 	CertKey  string `toml:"cert_key"`
+	// A path to a PEM encoded bundle of the CAs used to verify client certificates.
+	ClientCAFile string `toml:"client_ca_file"`
+	// Whether client certificates are verified or required. Defaults to none
+	// when empty.
+	ClientAuth ClientAuthMode `toml:"client_auth"`
 }
 
 func (c TLSConfig) IsValid() error {
@@ -22,18 +41,64 @@ func (c TLSConfig) IsValid() error {
 			return fmt.Errorf("invalid CertKey value: should not be empty")
 		}
 	}
+
+	switch c.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthVerify, ClientAuthRequire:
+		if !c.Enable {
+			return fmt.Errorf("invalid ClientAuth value: TLS should be enabled")
+		}
+		if c.ClientCAFile == "" {
+			return fmt.Errorf("invalid ClientCAFile value: should not be empty")
+		}
+	default:
+		return fmt.Errorf("invalid ClientAuth value: %q", c.ClientAuth)
+	}
+
 	return nil
 }
 
+const unixSocketPrefix = "unix://"
+
 type Config struct {
+	// The address to listen on. Either a TCP address (e.g. ":4545") or the
+	// path of a Unix socket in the form unix:///path/to.sock
 	ListenAddress string `toml:"listen_address"`
 	TLS           TLSConfig
+	// The file mode of the Unix socket, in octal notation (e.g. "0660").
+	SocketFileMode string `toml:"socket_file_mode"`
+	// The user and group, either names or IDs, owning the Unix socket.
+	SocketOwner string `toml:"socket_owner"`
+	SocketGroup string `toml:"socket_group"`
+}
+
+// socketPath returns the path of the Unix socket to listen on, if any.
+func (c Config) socketPath() string {
+	return strings.TrimPrefix(c.ListenAddress, unixSocketPrefix)
+}
+
+func (c Config) isUnixSocket() bool {
+	return strings.HasPrefix(c.ListenAddress, unixSocketPrefix)
 }
 
 func (c Config) IsValid() error {
 	if c.ListenAddress == "" {
 		return fmt.Errorf("invalid ListenAddress value: should not be empty")
 	}
+
+	if c.isUnixSocket() {
+		if !filepath.IsAbs(c.socketPath()) {
+			return fmt.Errorf("invalid ListenAddress value: socket path should be absolute")
+		}
+		if c.SocketFileMode != "" {
+			if _, err := strconv.ParseUint(c.SocketFileMode, 8, 32); err != nil {
+				return fmt.Errorf("invalid SocketFileMode value: should be in octal notation")
+			}
+		}
+	} else if c.SocketFileMode != "" || c.SocketOwner != "" || c.SocketGroup != "" {
+		return fmt.Errorf("invalid ListenAddress value: socket settings require a Unix socket")
+	}
+
 	if err := c.TLS.IsValid(); err != nil {
 		return fmt.Errorf("invalid TLS config: %w", err)
 	}
@@ -52,4 +52,80 @@ func TestIsValid(t *testing.T) {
 		err := cfg.IsValid()
 		require.NoError(t, err)
 	})
+	t.Run("invalid client auth", func(t *testing.T) {
+		var cfg Config
+		cfg.ListenAddress = ":8080"
+		cfg.TLS.ClientAuth = "optional"
+		err := cfg.IsValid()
+		require.Error(t, err)
+		require.Equal(t, `invalid TLS config: invalid ClientAuth value: "optional"`, err.Error())
+	})
+
+	t.Run("client auth without tls", func(t *testing.T) {
+		var cfg Config
+		cfg.ListenAddress = ":8080"
+		cfg.TLS.ClientAuth = ClientAuthRequire
+		err := cfg.IsValid()
+		require.Error(t, err)
+		require.Equal(t, "invalid TLS config: invalid ClientAuth value: TLS should be enabled", err.Error())
+	})
+
+	t.Run("missing client ca", func(t *testing.T) {
+		var cfg Config
+		cfg.ListenAddress = ":8080"
+		cfg.TLS.Enable = true
+		cfg.TLS.CertFile = "cert.pem"
+		cfg.TLS.CertKey = "key.pem"
+		cfg.TLS.ClientAuth = ClientAuthVerify
+		err := cfg.IsValid()
+		require.Error(t, err)
+		require.Equal(t, "invalid TLS config: invalid ClientCAFile value: should not be empty", err.Error())
+	})
+
+	t.Run("valid with client auth", func(t *testing.T) {
+		var cfg Config
+		cfg.ListenAddress = ":8080"
+		cfg.TLS.Enable = true
+		cfg.TLS.CertFile = "cert.pem"
+		cfg.TLS.CertKey = "key.pem"
+		cfg.TLS.ClientAuth = ClientAuthRequire
+		cfg.TLS.ClientCAFile = "ca.pem"
+		err := cfg.IsValid()
+		require.NoError(t, err)
+	})
+	t.Run("relative socket path", func(t *testing.T) {
+		var cfg Config
+		cfg.ListenAddress = "unix://offloader.sock"
+		err := cfg.IsValid()
+		require.Error(t, err)
+		require.Equal(t, "invalid ListenAddress value: socket path should be absolute", err.Error())
+	})
+
+	t.Run("invalid socket file mode", func(t *testing.T) {
+		var cfg Config
+		cfg.ListenAddress = "unix:///run/offloader.sock"
+		cfg.SocketFileMode = "rw-rw----"
+		err := cfg.IsValid()
+		require.Error(t, err)
+		require.Equal(t, "invalid SocketFileMode value: should be in octal notation", err.Error())
+	})
+
+	t.Run("socket settings without socket", func(t *testing.T) {
+		var cfg Config
+		cfg.ListenAddress = ":8080"
+		cfg.SocketOwner = "mattermost"
+		err := cfg.IsValid()
+		require.Error(t, err)
+		require.Equal(t, "invalid ListenAddress value: socket settings require a Unix socket", err.Error())
+	})
+
+	t.Run("valid with socket", func(t *testing.T) {
+		var cfg Config
+		cfg.ListenAddress = "unix:///run/offloader.sock"
+		cfg.SocketFileMode = "0660"
+		cfg.SocketOwner = "mattermost"
+		cfg.SocketGroup = "mattermost"
+		err := cfg.IsValid()
+		require.NoError(t, err)
+	})
 }
@@ -0,0 +1,101 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+func (s *Server) listen() (net.Listener, error) {
+	if !s.cfg.isUnixSocket() {
+		return net.Listen("tcp", s.cfg.ListenAddress)
+	}
+	return listenUnixSocket(s.cfg)
+}
+
+func listenUnixSocket(cfg Config) (net.Listener, error) {
+	path := cfg.socketPath()
+
+	// A socket left behind by an unclean shutdown would make listening fail.
+	// Anything other than a socket is left alone.
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s already exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setSocketPermissions(cfg); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func setSocketPermissions(cfg Config) error {
+	path := cfg.socketPath()
+
+	if cfg.SocketFileMode != "" {
+		mode, err := strconv.ParseUint(cfg.SocketFileMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("failed to parse socket file mode: %w", err)
+		}
+		if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+			return fmt.Errorf("failed to set socket file mode: %w", err)
+		}
+	}
+
+	if cfg.SocketOwner == "" && cfg.SocketGroup == "" {
+		return nil
+	}
+
+	// -1 leaves the respective ID unchanged.
+	uid, gid := -1, -1
+	if cfg.SocketOwner != "" {
+		u, err := user.Lookup(cfg.SocketOwner)
+		if err != nil {
+			u, err = user.LookupId(cfg.SocketOwner)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find socket owner: %w", err)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("failed to parse socket owner id: %w", err)
+		}
+	}
+	if cfg.SocketGroup != "" {
+		g, err := user.LookupGroup(cfg.SocketGroup)
+		if err != nil {
+			g, err = user.LookupGroupId(cfg.SocketGroup)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find socket group: %w", err)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("failed to parse socket group id: %w", err)
+		}
+	}
+
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to set socket ownership: %w", err)
+	}
+
+	return nil
+}
@@ -6,26 +6,52 @@ package api
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/mattermost/mattermost/server/public/shared/mlog"
 )
 
 type Server struct {
-	cfg      Config
-	listener net.Listener
-	srv      *http.Server
-	mux      *http.ServeMux
-	log      mlog.LoggerIFace
+	cfg          Config
+	listener     net.Listener
+	srv          *http.Server
+	mux          *http.ServeMux
+	log          mlog.LoggerIFace
+	certReloader *certReloader
+	stopCh       chan struct{}
+	watchDoneCh  chan struct{}
 }
 
 func NewServer(cfg Config, log mlog.LoggerIFace) (*Server, error) {
 	if err := cfg.IsValid(); err != nil {
 		return nil, err
 	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		CurvePreferences: []tls.CurveID{
+			tls.CurveP256,
+		},
+	}
+
+	if cfg.TLS.ClientAuth == ClientAuthVerify || cfg.TLS.ClientAuth == ClientAuthRequire {
+		pool, err := loadCertPool(cfg.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CAs: %w", err)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.TLS.ClientAuth == ClientAuthRequire {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
 	mux := http.NewServeMux()
 	s := &Server{
 		srv: &http.Server{
@@ -33,14 +59,8 @@ func NewServer(cfg Config, log mlog.LoggerIFace) (*Server, error) {
 			ReadTimeout:  30 * time.Second,
 			WriteTimeout: 60 * time.Second,
 			IdleTimeout:  30 * time.Second,
-			TLSConfig: &tls.Config{
-				MinVersion:               tls.VersionTLS12,
-				PreferServerCipherSuites: true,
-				CurvePreferences: []tls.CurveID{
-					tls.CurveP256,
-				},
-			},
-			Handler: mux,
+			TLSConfig:    tlsConfig,
+			Handler:      mux,
 		},
 		log: log,
 		cfg: cfg,
@@ -49,9 +69,31 @@ func NewServer(cfg Config, log mlog.LoggerIFace) (*Server, error) {
 	return s, nil
 }
 
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
 func (s *Server) Start() error {
 	var err error
-	s.listener, err = net.Listen("tcp", s.cfg.ListenAddress)
+	if s.cfg.TLS.Enable {
+		s.certReloader, err = newCertReloader(s.cfg.TLS.CertFile, s.cfg.TLS.CertKey, s.log)
+		if err != nil {
+			return err
+		}
+		s.srv.TLSConfig.GetCertificate = s.certReloader.GetCertificate
+	}
+
+	s.listener, err = s.listen()
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
@@ -61,9 +103,10 @@ func (s *Server) Start() error {
 	startErrCh := make(chan error, 1)
 	go func() {
 		var err error
-		if s.cfg.TLS.Enable && s.cfg.TLS.CertFile != "" && s.cfg.TLS.CertKey != "" {
+		if s.certReloader != nil {
 			s.log.Debug("api: serving with tls")
-			err = s.srv.ServeTLS(s.listener, s.cfg.TLS.CertFile, s.cfg.TLS.CertKey)
+			// Certificates are served through GetCertificate.
+			err = s.srv.ServeTLS(s.listener, "", "")
 		} else {
 			s.log.Debug("api: serving plaintext")
 			err = s.srv.Serve(s.listener)
@@ -82,10 +125,34 @@ func (s *Server) Start() error {
 	case <-time.After(time.Second):
 	}
 
+	if err == nil && s.certReloader != nil {
+		s.stopCh = make(chan struct{})
+		s.watchDoneCh = make(chan struct{})
+		go func() {
+			defer close(s.watchDoneCh)
+			s.certReloader.watch(s.stopCh)
+		}()
+	}
+
 	return err
 }
 
+// ReloadCertificate reloads the TLS certificate from disk. On failure the
+// previous certificate keeps being served.
+func (s *Server) ReloadCertificate() error {
+	if s.certReloader == nil {
+		return nil
+	}
+	return s.certReloader.Reload()
+}
+
 func (s *Server) Stop() error {
+	if s.stopCh != nil {
+		close(s.stopCh)
+		<-s.watchDoneCh
+		s.stopCh = nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := s.srv.Shutdown(ctx); err != nil {
@@ -4,10 +4,21 @@
 package api
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/mattermost/mattermost/server/public/shared/mlog"
 	"github.com/stretchr/testify/require"
@@ -116,4 +127,180 @@ func TestStartServer(t *testing.T) {
 		_, err = client.Get("https://localhost:" + port)
 		require.Error(t, err)
 	})
+	t.Run("mtls", func(t *testing.T) {
+		caCert, caKey := newTestCA(t)
+		clientCert := newTestClientCert(t, caCert, caKey)
+
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0600)
+		require.NoError(t, err)
+
+		for _, mode := range []ClientAuthMode{ClientAuthVerify, ClientAuthRequire} {
+			t.Run(string(mode), func(t *testing.T) {
+				cfg := Config{
+					ListenAddress: ":0",
+					TLS: TLSConfig{
+						Enable:       true,
+						CertFile:     "../../testfiles/tls_test_cert.pem",
+						CertKey:      "../../testfiles/tls_test_key.pem",
+						ClientCAFile: caFile,
+						ClientAuth:   mode,
+					},
+				}
+				s, err := NewServer(cfg, log)
+				require.NoError(t, err)
+
+				var verifiedChains int
+				s.RegisterHandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+					verifiedChains = len(r.TLS.VerifiedChains)
+				})
+
+				err = s.Start()
+				require.NoError(t, err)
+				defer func() {
+					err := s.Stop()
+					require.NoError(t, err)
+				}()
+
+				_, port, err := net.SplitHostPort(s.listener.Addr().String())
+				require.NoError(t, err)
+
+				client := &http.Client{Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				}}
+				resp, err := client.Get("https://localhost:" + port)
+				if mode == ClientAuthRequire {
+					require.Error(t, err)
+				} else {
+					require.NoError(t, err)
+					resp.Body.Close()
+					require.Zero(t, verifiedChains)
+				}
+
+				client = &http.Client{Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						InsecureSkipVerify: true,
+						Certificates:       []tls.Certificate{clientCert},
+					},
+				}}
+				resp, err = client.Get("https://localhost:" + port)
+				require.NoError(t, err)
+				resp.Body.Close()
+				require.Equal(t, 1, verifiedChains)
+			})
+		}
+	})
+
+	t.Run("unix socket", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "offloader.sock")
+
+		// A stale socket gets replaced.
+		stale, err := net.Listen("unix", socketPath)
+		require.NoError(t, err)
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		require.NoError(t, stale.Close())
+
+		cfg := Config{
+			ListenAddress:  "unix://" + socketPath,
+			SocketFileMode: "0600",
+		}
+		s, err := NewServer(cfg, log)
+		require.NoError(t, err)
+
+		err = s.Start()
+		require.NoError(t, err)
+
+		info, err := os.Stat(socketPath)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		}}
+		resp, err := client.Get("http://unix")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		err = s.Stop()
+		require.NoError(t, err)
+
+		_, err = os.Stat(socketPath)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("unix socket path not a socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "offloader.sock")
+		err := os.WriteFile(path, nil, 0600)
+		require.NoError(t, err)
+
+		s, err := NewServer(Config{ListenAddress: "unix://" + path}, log)
+		require.NoError(t, err)
+
+		err = s.Start()
+		require.EqualError(t, err, "failed to listen: "+path+" already exists and is not a socket")
+	})
+
+	t.Run("invalid client ca", func(t *testing.T) {
+		cfg := Config{
+			ListenAddress: ":0",
+			TLS: TLSConfig{
+				Enable:       true,
+				CertFile:     "../../testfiles/tls_test_cert.pem",
+				CertKey:      "../../testfiles/tls_test_key.pem",
+				ClientCAFile: "../../testfiles/tls_test_key.pem",
+				ClientAuth:   ClientAuthRequire,
+			},
+		}
+		s, err := NewServer(cfg, log)
+		require.EqualError(t, err, "failed to load client CAs: no valid certificates found in ../../testfiles/tls_test_key.pem")
+		require.Nil(t, s)
+	})
+}
+
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+func newTestClientCert(t *testing.T, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mattermost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
 }
@@ -11,13 +11,14 @@ import (
 	"strings"
 
 	"github.com/mattermost/calls-offloader/service/auth"
+	"github.com/mattermost/calls-offloader/service/store"
 
 	"github.com/mattermost/mattermost/server/public/shared/mlog"
 )
 
 const bearerPrefix = "Bearer "
 
-func (s *Service) authHandler(r *http.Request) (clientID string, code int, err error) {
+func (s *Service) authHandler(w http.ResponseWriter, r *http.Request) (clientID string, scopes []auth.Scope, code int, err error) {
 	defer func() {
 		data := newHTTPData()
 
@@ -31,23 +32,90 @@ func (s *Service) authHandler(r *http.Request) (clientID string, code int, err e
 	}()
 
 	if strings.HasPrefix(r.Header.Get("Authorization"), bearerPrefix) {
-		return s.bearerAuthHandler(r)
+		return s.bearerAuthHandler(w, r)
 	}
-	return s.basicAuthHandler(r)
+	if r.Header.Get("Authorization") == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return s.certAuthHandler(r)
+	}
+	return s.basicAuthHandler(w, r)
+}
+
+// authorize authenticates the request and verifies it was granted the given scope.
+func (s *Service) authorize(w http.ResponseWriter, r *http.Request, scope auth.Scope) (string, int, error) {
+	clientID, _, code, err := s.authorizeScopes(w, r, scope)
+	return clientID, code, err
+}
+
+// authorizeScopes is like authorize but also returns all the scopes granted
+// to the request.
+func (s *Service) authorizeScopes(w http.ResponseWriter, r *http.Request, scope auth.Scope) (string, []auth.Scope, int, error) {
+	clientID, scopes, code, err := s.authHandler(w, r)
+	if err != nil {
+		return clientID, nil, code, err
+	}
+
+	if !auth.HasScope(scopes, scope) {
+		return clientID, nil, http.StatusForbidden, fmt.Errorf("forbidden: missing %s scope", scope)
+	}
+
+	return clientID, scopes, http.StatusOK, nil
 }
 
-func (s *Service) basicAuthHandler(r *http.Request) (string, int, error) {
+// requireCurrentKey verifies that a client authenticated through Basic auth
+// used its current key. The previous key of a rotated client is only meant to
+// keep the client working during the rotation overlap, not to manage it.
+func (s *Service) requireCurrentKey(r *http.Request, clientID string) (int, error) {
+	_, authKey, ok := r.BasicAuth()
+	if !ok || clientID == "" {
+		return http.StatusOK, nil
+	}
+
+	if err := s.auth.AuthenticateCurrentKey(clientID, authKey); err != nil {
+		return http.StatusForbidden, errors.New("forbidden: current key required")
+	}
+
+	return http.StatusOK, nil
+}
+
+// adminOnly restricts access to the given handler to requests authenticated
+// through the admin key.
+func (s *Service) adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, _, code, err := s.authHandler(w, r)
+		if err == nil && clientID != "" {
+			code, err = http.StatusForbidden, errors.New("forbidden: admin only")
+		}
+		if err != nil {
+			data := newHTTPData()
+			data.clientID = clientID
+			data.err = err.Error()
+			data.code = code
+			s.httpAudit("adminOnly", data, w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Service) basicAuthHandler(w http.ResponseWriter, r *http.Request) (string, []auth.Scope, int, error) {
 	clientID, authKey, ok := r.BasicAuth()
 	if !ok {
-		return "", http.StatusUnauthorized, errors.New("authentication failed: invalid auth header")
+		return "", nil, http.StatusUnauthorized, errors.New("authentication failed: invalid auth header")
+	}
+
+	if code, err := s.checkLockout(w, lockoutKeys(r, clientID)...); err != nil {
+		return "", nil, code, err
 	}
 
 	if s.cfg.API.Security.EnableAdmin && authKey == s.cfg.API.Security.AdminSecretKey {
-		return "", http.StatusOK, nil
+		s.authSucceeded(r, "")
+		return "", auth.AllScopes, http.StatusOK, nil
 	}
 
 	if clientID == "" {
-		return "", http.StatusUnauthorized, errors.New("authentication failed: unauthorized")
+		s.authFailed(r, clientID)
+		return "", nil, http.StatusUnauthorized, errors.New("authentication failed: unauthorized")
 	}
 
 	// If self registrations are enabled we attempt to automatically register the
@@ -57,7 +125,7 @@ func (s *Service) basicAuthHandler(r *http.Request) (string, int, error) {
 		err := s.auth.Register(clientID, authKey)
 		if err != nil && err != auth.ErrAlreadyRegistered {
 			s.log.Error("failed to register client in auth handler", mlog.String("clientID", clientID), mlog.Err(err))
-			return "", http.StatusUnauthorized, errors.New("unauthorized")
+			return "", nil, http.StatusUnauthorized, errors.New("unauthorized")
 		}
 
 		if err == auth.ErrAlreadyRegistered {
@@ -69,28 +137,62 @@ func (s *Service) basicAuthHandler(r *http.Request) (string, int, error) {
 
 	if err := s.auth.Authenticate(clientID, authKey); err != nil {
 		s.log.Error("authentication failed", mlog.Err(err))
-		return "", http.StatusUnauthorized, errors.New("authentication failed")
+		s.authFailed(r, clientID)
+		return "", nil, http.StatusUnauthorized, errors.New("authentication failed")
 	}
+	s.authSucceeded(r, clientID)
 
-	return clientID, http.StatusOK, nil
+	scopes, err := s.auth.GetScopes(clientID)
+	if err != nil {
+		s.log.Error("failed to get scopes", mlog.String("clientID", clientID), mlog.Err(err))
+		return "", nil, http.StatusUnauthorized, errors.New("authentication failed")
+	}
+
+	return clientID, scopes, http.StatusOK, nil
 }
 
-func (s *Service) bearerAuthHandler(r *http.Request) (string, int, error) {
+func (s *Service) bearerAuthHandler(w http.ResponseWriter, r *http.Request) (string, []auth.Scope, int, error) {
 	bearerToken, ok := parseBearerAuth(r.Header.Get("Authorization"))
 	if !ok {
-		return "", http.StatusUnauthorized, errors.New("authentication failed: invalid auth header")
+		return "", nil, http.StatusUnauthorized, errors.New("authentication failed: invalid auth header")
 	}
 
-	session, err := s.sessionCache.Get(bearerToken)
+	// Failures aren't counted towards lockouts as tokens can't be guessed,
+	// while expired ones would otherwise lock out every client sharing the
+	// same address.
+	session, err := s.auth.GetSession(bearerToken)
 	if err != nil {
-		return "", http.StatusUnauthorized, fmt.Errorf("authentication failed: %w", err)
+		return "", nil, http.StatusUnauthorized, fmt.Errorf("authentication failed: %w", err)
 	}
 
 	if session.ClientID == "" {
-		return "", http.StatusUnauthorized, errors.New("authentication failed: unauthorized")
+		return "", nil, http.StatusUnauthorized, errors.New("authentication failed: unauthorized")
+	}
+
+	return session.ClientID, session.Scopes, http.StatusOK, nil
+}
+
+// certAuthHandler authenticates clients through a TLS certificate verified
+// against the configured client CAs.
+func (s *Service) certAuthHandler(r *http.Request) (string, []auth.Scope, int, error) {
+	cert := r.TLS.VerifiedChains[0][0]
+	clientID, ok := s.cfg.API.Security.CertClientIDs.ClientID(cert)
+	if !ok {
+		s.log.Warn("no client ID found for certificate", mlog.String("subject", cert.Subject.String()))
+		return "", nil, http.StatusUnauthorized, errors.New("authentication failed: unknown client certificate")
+	}
+
+	// Clients identified by certificate don't need to be registered, in
+	// which case they get the default scopes.
+	scopes, err := s.auth.GetScopes(clientID)
+	if errors.Is(err, store.ErrNotFound) {
+		scopes = auth.DefaultScopes
+	} else if err != nil {
+		s.log.Error("failed to get scopes", mlog.String("clientID", clientID), mlog.Err(err))
+		return "", nil, http.StatusUnauthorized, errors.New("authentication failed")
 	}
 
-	return session.ClientID, http.StatusOK, nil
+	return clientID, scopes, http.StatusOK, nil
 }
 
 func parseBearerAuth(auth string) (token string, ok bool) {
@@ -109,13 +211,28 @@ func (s *Service) registerClient(w http.ResponseWriter, r *http.Request) {
 	data := newHTTPData()
 	defer s.httpAudit("registerClient", data, w, r)
 
+	// Whether the caller can only register clients with the default scopes.
+	var defaultScopesOnly bool
 	if !s.cfg.API.Security.AllowSelfRegistration {
-		_, code, err := s.authHandler(r)
+		authedClientID, scopes, code, err := s.authHandler(w, r)
 		if err != nil {
 			data.err = err.Error()
 			data.code = code
 			return
 		}
+
+		// Clients registered without explicit scopes could register other
+		// clients before scopes were introduced. They still can, for
+		// compatibility, as long as no specific scope is requested.
+		if !auth.HasScope(scopes, auth.ScopeClientsAdmin) {
+			explicit, err := s.auth.HasExplicitScopes(authedClientID)
+			if err != nil || explicit {
+				data.err = fmt.Sprintf("forbidden: missing %s scope", auth.ScopeClientsAdmin)
+				data.code = http.StatusForbidden
+				return
+			}
+			defaultScopesOnly = true
+		}
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&data.reqData); err != nil {
@@ -124,9 +241,31 @@ func (s *Service) registerClient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	scopes, err := auth.ParseScopes(data.reqData["scopes"])
+	if err != nil {
+		data.err = err.Error()
+		data.code = http.StatusBadRequest
+		return
+	}
+
+	// Self registered clients get the default scopes. Granting any specific
+	// scope is reserved to client admins.
+	if len(scopes) > 0 && defaultScopesOnly {
+		data.err = fmt.Sprintf("forbidden: missing %s scope", auth.ScopeClientsAdmin)
+		data.code = http.StatusForbidden
+		return
+	} else if len(scopes) > 0 && s.cfg.API.Security.AllowSelfRegistration {
+		_, code, err := s.authorize(w, r, auth.ScopeClientsAdmin)
+		if err != nil {
+			data.err = err.Error()
+			data.code = code
+			return
+		}
+	}
+
 	clientID := data.reqData["clientID"]
 	authKey := data.reqData["authKey"]
-	err := s.auth.Register(clientID, authKey)
+	err = s.auth.RegisterWithScopes(clientID, authKey, scopes)
 	if err != nil {
 		data.err = err.Error()
 		data.code = http.StatusBadRequest
@@ -157,13 +296,19 @@ func (s *Service) unregisterClient(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if admin authKey or clientID + authKey have been provided
-	authedClientID, code, err := s.authHandler(r)
+	authedClientID, scopes, code, err := s.authHandler(w, r)
 	if err != nil {
 		data.err = err.Error()
 		data.code = code
 		return
 	}
 
+	if code, err := s.requireCurrentKey(r, authedClientID); err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+
 	if err := json.NewDecoder(r.Body).Decode(&data.reqData); err != nil {
 		data.err = err.Error()
 		data.code = http.StatusBadRequest
@@ -177,9 +322,9 @@ func (s *Service) unregisterClient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// an authedClientID == "" means admin. So if there is an authedClientID,
-	// then the requested clientID needs to be the same.
-	if authedClientID != "" && authedClientID != clientID {
+	// Clients can always unregister themselves. Unregistering any other
+	// client requires the clients:admin scope, which the admin is granted.
+	if authedClientID != clientID && !auth.HasScope(scopes, auth.ScopeClientsAdmin) {
 		data.err = "client id not valid"
 		data.code = http.StatusForbidden
 		return
@@ -213,14 +358,59 @@ func (s *Service) loginClient(w http.ResponseWriter, r *http.Request) {
 
 	clientID := data.reqData["clientID"]
 	authKey := data.reqData["authKey"]
+
+	if code, err := s.checkLockout(w, lockoutKeys(r, clientID)...); err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+
 	bearerToken, err := s.auth.Login(clientID, authKey)
 	if err != nil {
+		s.authFailed(r, clientID)
 		data.err = err.Error()
 		data.code = http.StatusBadRequest
 		return
 	}
+	s.authSucceeded(r, clientID)
 
 	s.log.Debug("logged in client", mlog.String("clientID", clientID))
 	data.code = http.StatusOK
 	data.resData["bearerToken"] = bearerToken
 }
+
+func (s *Service) logoutClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := newHTTPData()
+	defer s.httpAudit("logoutClient", data, w, r)
+
+	// Only the presented token gets revoked, leaving any other session
+	// for the same client untouched.
+	bearerToken, ok := parseBearerAuth(r.Header.Get("Authorization"))
+	if !ok {
+		data.err = "logout failed: invalid auth header"
+		data.code = http.StatusUnauthorized
+		return
+	}
+
+	clientID, _, code, err := s.authHandler(w, r)
+	if err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+	data.clientID = clientID
+
+	if err := s.auth.Logout(bearerToken); err != nil {
+		data.err = err.Error()
+		data.code = http.StatusUnauthorized
+		return
+	}
+
+	s.log.Debug("logged out client", mlog.String("clientID", clientID))
+	data.code = http.StatusOK
+}
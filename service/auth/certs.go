@@ -0,0 +1,87 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	CertIdentityCN    = "cn"
+	CertIdentityDNS   = "dns"
+	CertIdentityURI   = "uri"
+	CertIdentityEmail = "email"
+)
+
+// CertIdentities maps client certificate identities to client IDs.
+// Identities are in the form "<type>:<value>" where type is one of cn (subject
+// common name), dns, uri or email (subject alternative names).
+type CertIdentities map[string]string
+
+func (m *CertIdentities) Decode(data string) error {
+	return json.Unmarshal([]byte(data), m)
+}
+
+func (m *CertIdentities) UnmarshalTOML(data interface{}) error {
+	js, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("invalid data found")
+	}
+	if js == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(js), m)
+}
+
+func (m CertIdentities) IsValid() error {
+	for identity, clientID := range m {
+		idType, value, _ := strings.Cut(identity, ":")
+		switch idType {
+		case CertIdentityCN, CertIdentityDNS, CertIdentityURI, CertIdentityEmail:
+		default:
+			return fmt.Errorf("invalid identity %q: unsupported type", identity)
+		}
+		if value == "" {
+			return fmt.Errorf("invalid identity %q: value should not be empty", identity)
+		}
+		if clientID == "" {
+			return fmt.Errorf("invalid identity %q: client ID should not be empty", identity)
+		}
+	}
+	return nil
+}
+
+// ClientID returns the client ID mapped to the given certificate. Subject
+// alternative names are matched first, in URI, DNS and email order, followed
+// by the subject common name.
+func (m CertIdentities) ClientID(cert *x509.Certificate) (string, bool) {
+	if cert == nil {
+		return "", false
+	}
+
+	var identities []string
+	for _, uri := range cert.URIs {
+		identities = append(identities, CertIdentityURI+":"+uri.String())
+	}
+	for _, name := range cert.DNSNames {
+		identities = append(identities, CertIdentityDNS+":"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		identities = append(identities, CertIdentityEmail+":"+email)
+	}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, CertIdentityCN+":"+cert.Subject.CommonName)
+	}
+
+	for _, identity := range identities {
+		if clientID, ok := m[identity]; ok {
+			return clientID, true
+		}
+	}
+
+	return "", false
+}
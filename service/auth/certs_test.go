@@ -0,0 +1,92 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertIdentitiesIsValid(t *testing.T) {
+	require.NoError(t, CertIdentities(nil).IsValid())
+	require.NoError(t, CertIdentities{"cn:mattermost": "clientA", "uri:spiffe://mm/app": "clientB"}.IsValid())
+	require.EqualError(t, CertIdentities{"mattermost": "clientA"}.IsValid(), `invalid identity "mattermost": unsupported type`)
+	require.EqualError(t, CertIdentities{"ip:10.0.0.1": "clientA"}.IsValid(), `invalid identity "ip:10.0.0.1": unsupported type`)
+	require.EqualError(t, CertIdentities{"dns:": "clientA"}.IsValid(), `invalid identity "dns:": value should not be empty`)
+	require.EqualError(t, CertIdentities{"dns:mm.local": ""}.IsValid(), `invalid identity "dns:mm.local": client ID should not be empty`)
+}
+
+func TestCertIdentitiesDecode(t *testing.T) {
+	var ids CertIdentities
+	err := ids.Decode(`{"cn:mattermost": "clientA"}`)
+	require.NoError(t, err)
+	require.Equal(t, CertIdentities{"cn:mattermost": "clientA"}, ids)
+
+	ids = nil
+	err = ids.UnmarshalTOML("")
+	require.NoError(t, err)
+	require.Nil(t, ids)
+
+	err = ids.UnmarshalTOML(45)
+	require.EqualError(t, err, "invalid data found")
+}
+
+func TestCertIdentitiesClientID(t *testing.T) {
+	spiffeURL, err := url.Parse("spiffe://mm/app")
+	require.NoError(t, err)
+
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "mattermost"},
+		DNSNames:       []string{"mm.local"},
+		EmailAddresses: []string{"admin@mm.local"},
+		URIs:           []*url.URL{spiffeURL},
+	}
+
+	tcs := []struct {
+		name     string
+		ids      CertIdentities
+		clientID string
+	}{
+		{
+			name: "no match",
+			ids:  CertIdentities{"cn:other": "clientA"},
+		},
+		{
+			name:     "common name",
+			ids:      CertIdentities{"cn:mattermost": "clientA"},
+			clientID: "clientA",
+		},
+		{
+			name:     "email",
+			ids:      CertIdentities{"cn:mattermost": "clientA", "email:admin@mm.local": "clientB"},
+			clientID: "clientB",
+		},
+		{
+			name:     "dns",
+			ids:      CertIdentities{"email:admin@mm.local": "clientB", "dns:mm.local": "clientC"},
+			clientID: "clientC",
+		},
+		{
+			name:     "uri",
+			ids:      CertIdentities{"dns:mm.local": "clientC", "uri:spiffe://mm/app": "clientD"},
+			clientID: "clientD",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			clientID, ok := tc.ids.ClientID(cert)
+			require.Equal(t, tc.clientID != "", ok)
+			require.Equal(t, tc.clientID, clientID)
+		})
+	}
+
+	clientID, ok := CertIdentities{"cn:mattermost": "clientA"}.ClientID(nil)
+	require.False(t, ok)
+	require.Empty(t, clientID)
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/calls-offloader/service/store"
+)
+
+const (
+	clientsIndexKey = "clients_index"
+
+	// The minimum interval between two updates of a client's last seen
+	// timestamp, to avoid writing to the store on every request.
+	lastSeenUpdateInterval = time.Minute
+)
+
+// reservedKeyPrefixes lists the prefixes of the store keys holding anything
+// other than client records, which are saved under their bare ID. Client IDs
+// can't start with any of them so that the two never collide.
+var reservedKeyPrefixes = []string{
+	clientsIndexKey,
+	sessionKeyPrefix,
+	revokedTokenKeyPrefix,
+	tokenGenerationKeyPrefix,
+	// Job records, saved by the service.
+	"job_",
+	store.JournalKeyPrefix,
+}
+
+// isReservedClientID returns whether the given ID can't be used by a client
+// as it could collide with internal store keys.
+func isReservedClientID(id string) bool {
+	for _, prefix := range reservedKeyPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientRecord holds what gets saved in the store for each registered client.
+type clientRecord struct {
+	KeyHash string `json:"key_hash"`
+	// The hash of the key that was replaced by the last rotation. It remains
+	// valid until PrevKeyExpiresAt (Unix milliseconds) so that clients can
+	// switch keys without downtime.
+	PrevKeyHash      string  `json:"prev_key_hash,omitempty"`
+	PrevKeyExpiresAt int64   `json:"prev_key_expires_at,omitempty"`
+	Scopes           []Scope `json:"scopes,omitempty"`
+	// Unix milliseconds. Zero for clients registered by older versions.
+	CreatedAt  int64 `json:"created_at,omitempty"`
+	LastSeenAt int64 `json:"last_seen_at,omitempty"`
+}
+
+// ClientInfo is the public information about a registered client.
+type ClientInfo struct {
+	ID         string
+	Scopes     []Scope
+	CreatedAt  int64
+	LastSeenAt int64
+}
+
+func (s *Service) getClient(id string) (clientRecord, error) {
+	if isReservedClientID(id) {
+		return clientRecord{}, store.ErrNotFound
+	}
+
+	data, err := s.store.Get(id)
+	if err != nil {
+		return clientRecord{}, err
+	}
+
+	// Clients registered by older versions are saved as a bare key hash.
+	if !strings.HasPrefix(data, "{") {
+		return clientRecord{KeyHash: data}, nil
+	}
+
+	var rec clientRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return clientRecord{}, fmt.Errorf("failed to unmarshal client: %w", err)
+	}
+
+	return rec, nil
+}
+
+// saveClient must be called with clientsMut held.
+func (s *Service) saveClient(id string, rec clientRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal client: %w", err)
+	}
+	return s.store.Set(id, string(data))
+}
+
+// getClientsIndex returns the IDs of all the known clients. Client records are
+// saved under their bare ID, so finding them through Store.Scan would mean
+// going through every other entry (e.g. jobs and sessions) and telling them
+// apart. The index avoids that, at the cost of clients registered by older
+// versions only being added to it upon their first authentication.
+func (s *Service) getClientsIndex() ([]string, error) {
+	data, err := s.store.Get(clientsIndexKey)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if err := json.Unmarshal([]byte(data), &ids); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal clients index: %w", err)
+	}
+
+	return ids, nil
+}
+
+// updateClientsIndex must be called with clientsMut held.
+func (s *Service) updateClientsIndex(id string, add bool) error {
+	ids, err := s.getClientsIndex()
+	if err != nil {
+		return err
+	}
+
+	i := sort.SearchStrings(ids, id)
+	found := i < len(ids) && ids[i] == id
+	if add == found {
+		return nil
+	}
+
+	if add {
+		ids = append(ids[:i], append([]string{id}, ids[i:]...)...)
+	} else {
+		ids = append(ids[:i], ids[i+1:]...)
+	}
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return fmt.Errorf("failed to marshal clients index: %w", err)
+	}
+
+	return s.store.Set(clientsIndexKey, string(data))
+}
+
+// touchClient updates the last seen timestamp of the given client, also
+// migrating records saved by older versions.
+func (s *Service) touchClient(id string) error {
+	s.clientsMut.Lock()
+	defer s.clientsMut.Unlock()
+
+	rec, err := s.getClient(id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Sub(time.UnixMilli(rec.LastSeenAt)) < lastSeenUpdateInterval {
+		return nil
+	}
+
+	if rec.LastSeenAt == 0 {
+		if err := s.updateClientsIndex(id, true); err != nil {
+			return err
+		}
+	}
+
+	rec.LastSeenAt = now.UnixMilli()
+
+	return s.saveClient(id, rec)
+}
+
+// ListClients returns all the known clients, sorted by ID.
+func (s *Service) ListClients() ([]ClientInfo, error) {
+	ids, err := s.getClientsIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get clients: %w", err)
+	}
+
+	clients := make([]ClientInfo, 0, len(ids))
+	for _, id := range ids {
+		rec, err := s.getClient(id)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get client: %w", err)
+		}
+
+		scopes := rec.Scopes
+		if len(scopes) == 0 {
+			scopes = DefaultScopes
+		}
+
+		clients = append(clients, ClientInfo{
+			ID:         id,
+			Scopes:     scopes,
+			CreatedAt:  rec.CreatedAt,
+			LastSeenAt: rec.LastSeenAt,
+		})
+	}
+
+	return clients, nil
+}
+
+// RotateKey replaces the key of the given client. The current key remains
+// valid for the given overlap duration, after which only the new key is
+// accepted. Existing sessions are not affected.
+func (s *Service) RotateKey(id, newKey string, overlap time.Duration) error {
+	if len(newKey) < MinKeyLen {
+		return errors.New("rotation failed: key not long enough")
+	}
+
+	hash, err := hashKey(newKey)
+	if err != nil {
+		return fmt.Errorf("rotation failed: %w", err)
+	}
+
+	s.clientsMut.Lock()
+	defer s.clientsMut.Unlock()
+
+	rec, err := s.getClient(id)
+	if err != nil {
+		return fmt.Errorf("rotation failed: %w", err)
+	}
+
+	if compareKeyHash(rec.KeyHash, newKey) == nil {
+		return errors.New("rotation failed: key is unchanged")
+	}
+
+	if overlap > 0 {
+		rec.PrevKeyHash = rec.KeyHash
+		rec.PrevKeyExpiresAt = time.Now().Add(overlap).UnixMilli()
+	} else {
+		rec.PrevKeyHash = ""
+		rec.PrevKeyExpiresAt = 0
+	}
+	rec.KeyHash = hash
+
+	if rec.LastSeenAt == 0 {
+		if err := s.updateClientsIndex(id, true); err != nil {
+			return fmt.Errorf("rotation failed: %w", err)
+		}
+	}
+
+	if err := s.saveClient(id, rec); err != nil {
+		return fmt.Errorf("rotation failed: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteSessions invalidates all the sessions of the given client.
+func (s *Service) DeleteSessions(id string) error {
+	if _, err := s.getClient(id); err != nil {
+		return fmt.Errorf("failed to delete sessions: %w", err)
+	}
+
+	if err := s.sessions.Delete(id); err != nil {
+		return fmt.Errorf("failed to delete sessions: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateKey(t *testing.T) {
+	dbStore, teardown := newTestDBStore(t)
+	defer teardown()
+	sessionCache := newTestSessionCache(t)
+
+	s, err := NewService(dbStore, sessionCache)
+	require.NoError(t, err)
+
+	oldKey, err := newRandomString(MinKeyLen)
+	require.NoError(t, err)
+	newKey, err := newRandomString(MinKeyLen)
+	require.NoError(t, err)
+
+	err = s.Register("instanceA", oldKey)
+	require.NoError(t, err)
+
+	t.Run("missing client", func(t *testing.T) {
+		err := s.RotateKey("instanceB", newKey, time.Minute)
+		require.EqualError(t, err, "rotation failed: error: not found")
+	})
+
+	t.Run("short key", func(t *testing.T) {
+		err := s.RotateKey("instanceA", "short key", time.Minute)
+		require.EqualError(t, err, "rotation failed: key not long enough")
+	})
+
+	t.Run("unchanged key", func(t *testing.T) {
+		err := s.RotateKey("instanceA", oldKey, time.Minute)
+		require.EqualError(t, err, "rotation failed: key is unchanged")
+	})
+
+	t.Run("overlap", func(t *testing.T) {
+		token, err := s.Login("instanceA", oldKey)
+		require.NoError(t, err)
+
+		err = s.RotateKey("instanceA", newKey, time.Minute)
+		require.NoError(t, err)
+
+		require.NoError(t, s.Authenticate("instanceA", oldKey))
+		require.NoError(t, s.Authenticate("instanceA", newKey))
+		_, err = s.Login("instanceA", oldKey)
+		require.NoError(t, err)
+
+		// Managing the client requires the new key.
+		require.EqualError(t, s.AuthenticateCurrentKey("instanceA", oldKey), "authentication failed")
+		require.NoError(t, s.AuthenticateCurrentKey("instanceA", newKey))
+
+		// Existing sessions are not affected.
+		_, err = s.GetSession(token)
+		require.NoError(t, err)
+	})
+
+	t.Run("overlap expired", func(t *testing.T) {
+		s.clientsMut.Lock()
+		rec, err := s.getClient("instanceA")
+		require.NoError(t, err)
+		rec.PrevKeyExpiresAt = time.Now().Add(-time.Second).UnixMilli()
+		require.NoError(t, s.saveClient("instanceA", rec))
+		s.clientsMut.Unlock()
+
+		require.EqualError(t, s.Authenticate("instanceA", oldKey), "authentication failed")
+		require.NoError(t, s.Authenticate("instanceA", newKey))
+	})
+
+	t.Run("no overlap", func(t *testing.T) {
+		err = s.RotateKey("instanceA", oldKey, 0)
+		require.NoError(t, err)
+
+		require.EqualError(t, s.Authenticate("instanceA", newKey), "authentication failed")
+		require.NoError(t, s.Authenticate("instanceA", oldKey))
+	})
+}
+
+func TestListClients(t *testing.T) {
+	dbStore, teardown := newTestDBStore(t)
+	defer teardown()
+	sessionCache := newTestSessionCache(t)
+
+	s, err := NewService(dbStore, sessionCache)
+	require.NoError(t, err)
+
+	authKey, err := newRandomString(MinKeyLen)
+	require.NoError(t, err)
+
+	clients, err := s.ListClients()
+	require.NoError(t, err)
+	require.Empty(t, clients)
+
+	err = s.RegisterWithScopes("instanceB", authKey, []Scope{ScopeJobsRead})
+	require.NoError(t, err)
+	err = s.Register("instanceA", authKey)
+	require.NoError(t, err)
+
+	// Clients registered by older versions are listed once they authenticate.
+	hash, err := hashKey(authKey)
+	require.NoError(t, err)
+	err = dbStore.Set("instanceC", hash)
+	require.NoError(t, err)
+
+	clients, err = s.ListClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "instanceA", clients[0].ID)
+	require.Equal(t, DefaultScopes, clients[0].Scopes)
+	require.NotZero(t, clients[0].CreatedAt)
+	require.Zero(t, clients[0].LastSeenAt)
+	require.Equal(t, "instanceB", clients[1].ID)
+	require.Equal(t, []Scope{ScopeJobsRead}, clients[1].Scopes)
+
+	err = s.Authenticate("instanceA", authKey)
+	require.NoError(t, err)
+	err = s.Authenticate("instanceC", authKey)
+	require.NoError(t, err)
+
+	clients, err = s.ListClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 3)
+	require.NotZero(t, clients[0].LastSeenAt)
+	require.Equal(t, "instanceC", clients[2].ID)
+	require.Zero(t, clients[2].CreatedAt)
+	require.NotZero(t, clients[2].LastSeenAt)
+
+	err = s.Unregister("instanceB")
+	require.NoError(t, err)
+
+	clients, err = s.ListClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "instanceA", clients[0].ID)
+	require.Equal(t, "instanceC", clients[1].ID)
+}
+
+func TestDeleteSessions(t *testing.T) {
+	dbStore, teardown := newTestDBStore(t)
+	defer teardown()
+	sessionCache := newTestSessionCache(t)
+
+	s, err := NewService(dbStore, sessionCache)
+	require.NoError(t, err)
+
+	authKey, err := newRandomString(MinKeyLen)
+	require.NoError(t, err)
+	err = s.Register("instanceA", authKey)
+	require.NoError(t, err)
+
+	err = s.DeleteSessions("instanceB")
+	require.EqualError(t, err, "failed to delete sessions: error: not found")
+
+	tokenA, err := s.Login("instanceA", authKey)
+	require.NoError(t, err)
+	tokenB, err := s.Login("instanceA", authKey)
+	require.NoError(t, err)
+
+	err = s.DeleteSessions("instanceA")
+	require.NoError(t, err)
+
+	_, err = s.GetSession(tokenA)
+	require.Error(t, err)
+	_, err = s.GetSession(tokenB)
+	require.Error(t, err)
+
+	// The client can log in again.
+	_, err = s.Login("instanceA", authKey)
+	require.NoError(t, err)
+}
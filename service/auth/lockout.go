@@ -0,0 +1,169 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var lockoutPruneInterval = time.Minute
+
+type LockoutConfig struct {
+	// Whether or not to lock out client IDs and remote addresses after
+	// repeated authentication failures.
+	Enable bool `toml:"enable"`
+	// The number of consecutive failures after which a lockout is applied.
+	MaxFailures int `toml:"max_failures"`
+	// The duration, in seconds, of the first lockout. Each subsequent lockout
+	// doubles it, up to MaxDurationSeconds.
+	DurationSeconds int `toml:"duration_seconds"`
+	// The maximum duration, in seconds, of a lockout. Failures are forgotten
+	// after this long without any new one.
+	MaxDurationSeconds int `toml:"max_duration_seconds"`
+}
+
+func (c LockoutConfig) IsValid() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.MaxFailures <= 0 {
+		return errors.New("invalid MaxFailures value: should be a positive number")
+	}
+	if c.DurationSeconds <= 0 {
+		return errors.New("invalid DurationSeconds value: should be a positive number")
+	}
+	if c.MaxDurationSeconds < c.DurationSeconds {
+		return errors.New("invalid MaxDurationSeconds value: should not be lower than DurationSeconds")
+	}
+	return nil
+}
+
+type failureState struct {
+	failures    int
+	lockouts    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// LockoutTracker counts authentication failures per key (e.g. a client ID or
+// a remote address) and locks keys out for exponentially growing durations.
+type LockoutTracker struct {
+	cfg       LockoutConfig
+	states    map[string]*failureState
+	lastPrune time.Time
+	mut       sync.Mutex
+}
+
+func NewLockoutTracker(cfg LockoutConfig) (*LockoutTracker, error) {
+	if err := cfg.IsValid(); err != nil {
+		return nil, err
+	}
+
+	return &LockoutTracker{
+		cfg:    cfg,
+		states: make(map[string]*failureState),
+	}, nil
+}
+
+// Check returns the remaining lockout time for any of the given keys, or zero
+// if none of them is locked out.
+func (t *LockoutTracker) Check(keys ...string) time.Duration {
+	if !t.cfg.Enable {
+		return 0
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, key := range keys {
+		state := t.states[key]
+		if state == nil {
+			continue
+		}
+		if d := state.lockedUntil.Sub(now); d > retryAfter {
+			retryAfter = d
+		}
+	}
+
+	return retryAfter
+}
+
+// Fail records an authentication failure for key. If this causes the key to
+// be locked out, the lockout duration is returned, otherwise zero.
+func (t *LockoutTracker) Fail(key string) time.Duration {
+	if !t.cfg.Enable {
+		return 0
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+
+	maxDuration := time.Duration(t.cfg.MaxDurationSeconds) * time.Second
+
+	state := t.states[key]
+	if state == nil || state.isStale(now, maxDuration) {
+		state = &failureState{}
+		t.states[key] = state
+	}
+
+	state.failures++
+	state.lastFailure = now
+
+	if state.failures < t.cfg.MaxFailures {
+		return 0
+	}
+
+	duration := time.Duration(t.cfg.DurationSeconds) * time.Second
+	for i := 0; i < state.lockouts && duration < maxDuration; i++ {
+		duration *= 2
+	}
+	duration = min(duration, maxDuration)
+
+	state.failures = 0
+	state.lockouts++
+	state.lockedUntil = now.Add(duration)
+
+	return duration
+}
+
+// Reset forgets any failure recorded for the given keys.
+func (t *LockoutTracker) Reset(keys ...string) {
+	if !t.cfg.Enable {
+		return
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	for _, key := range keys {
+		delete(t.states, key)
+	}
+}
+
+// prune removes the keys that haven't failed for longer than the maximum
+// lockout duration. Must be called with the lock held.
+func (t *LockoutTracker) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < lockoutPruneInterval {
+		return
+	}
+	t.lastPrune = now
+
+	maxDuration := time.Duration(t.cfg.MaxDurationSeconds) * time.Second
+	for key, state := range t.states {
+		if state.isStale(now, maxDuration) {
+			delete(t.states, key)
+		}
+	}
+}
+
+func (s *failureState) isStale(now time.Time, maxDuration time.Duration) bool {
+	return now.Sub(s.lastFailure) > maxDuration && now.After(s.lockedUntil)
+}
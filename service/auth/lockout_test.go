@@ -0,0 +1,105 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockoutConfigIsValid(t *testing.T) {
+	require.NoError(t, LockoutConfig{}.IsValid())
+	require.EqualError(t, LockoutConfig{Enable: true}.IsValid(),
+		"invalid MaxFailures value: should be a positive number")
+	require.EqualError(t, LockoutConfig{Enable: true, MaxFailures: 5}.IsValid(),
+		"invalid DurationSeconds value: should be a positive number")
+	require.EqualError(t, LockoutConfig{Enable: true, MaxFailures: 5, DurationSeconds: 30, MaxDurationSeconds: 10}.IsValid(),
+		"invalid MaxDurationSeconds value: should not be lower than DurationSeconds")
+	require.NoError(t, LockoutConfig{Enable: true, MaxFailures: 5, DurationSeconds: 30, MaxDurationSeconds: 3600}.IsValid())
+}
+
+func TestLockoutTracker(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		lt, err := NewLockoutTracker(LockoutConfig{})
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			require.Zero(t, lt.Fail("clientA"))
+		}
+		require.Zero(t, lt.Check("clientA"))
+	})
+
+	t.Run("exponential lockout", func(t *testing.T) {
+		lt, err := NewLockoutTracker(LockoutConfig{
+			Enable:             true,
+			MaxFailures:        3,
+			DurationSeconds:    10,
+			MaxDurationSeconds: 35,
+		})
+		require.NoError(t, err)
+
+		expected := []time.Duration{10 * time.Second, 20 * time.Second, 35 * time.Second, 35 * time.Second}
+		for _, d := range expected {
+			require.Zero(t, lt.Fail("clientA"))
+			require.Zero(t, lt.Fail("clientA"))
+			require.Equal(t, d, lt.Fail("clientA"))
+
+			retryAfter := lt.Check("clientA")
+			require.LessOrEqual(t, retryAfter, d)
+			require.Greater(t, retryAfter, d-time.Second)
+		}
+
+		// Other keys are unaffected.
+		require.Zero(t, lt.Check("clientB"))
+		require.NotZero(t, lt.Check("clientB", "clientA"))
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		lt, err := NewLockoutTracker(LockoutConfig{
+			Enable:             true,
+			MaxFailures:        2,
+			DurationSeconds:    10,
+			MaxDurationSeconds: 60,
+		})
+		require.NoError(t, err)
+
+		require.Zero(t, lt.Fail("clientA"))
+		lt.Reset("clientA")
+		require.Zero(t, lt.Fail("clientA"))
+		require.Equal(t, 10*time.Second, lt.Fail("clientA"))
+		require.NotZero(t, lt.Check("clientA"))
+
+		lt.Reset("clientA")
+		require.Zero(t, lt.Check("clientA"))
+	})
+
+	t.Run("stale failures", func(t *testing.T) {
+		lt, err := NewLockoutTracker(LockoutConfig{
+			Enable:             true,
+			MaxFailures:        2,
+			DurationSeconds:    10,
+			MaxDurationSeconds: 60,
+		})
+		require.NoError(t, err)
+
+		require.Zero(t, lt.Fail("clientA"))
+		lt.states["clientA"].lastFailure = time.Now().Add(-2 * time.Minute)
+		require.Zero(t, lt.Fail("clientA"))
+		require.Equal(t, 10*time.Second, lt.Fail("clientA"))
+
+		// Lockouts are forgotten as well, restarting from the base duration.
+		lt.states["clientA"].lastFailure = time.Now().Add(-2 * time.Minute)
+		lt.states["clientA"].lockedUntil = time.Now().Add(-time.Minute)
+		require.Zero(t, lt.Fail("clientA"))
+		require.Equal(t, 10*time.Second, lt.Fail("clientA"))
+
+		lt.states["clientA"].lastFailure = time.Now().Add(-2 * time.Minute)
+		lt.states["clientA"].lockedUntil = time.Now().Add(-time.Minute)
+		lt.lastPrune = time.Time{}
+		require.Zero(t, lt.Fail("clientB"))
+		require.NotContains(t, lt.states, "clientA")
+	})
+}
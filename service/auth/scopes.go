@@ -0,0 +1,86 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Scope is a permission granted to a client and to the tokens issued to it.
+type Scope string
+
+const (
+	ScopeJobsCreate   Scope = "jobs:create"
+	ScopeJobsRead     Scope = "jobs:read"
+	ScopeJobsLogs     Scope = "jobs:logs"
+	ScopeJobsDelete   Scope = "jobs:delete"
+	ScopeRunnersInit  Scope = "runners:init"
+	ScopeClientsAdmin Scope = "clients:admin"
+	// ScopeJobsAdmin allows accessing the jobs created by any client.
+	ScopeJobsAdmin Scope = "jobs:admin"
+)
+
+// AllScopes lists every supported scope. The admin client is implicitly
+// granted all of them.
+var AllScopes = []Scope{
+	ScopeJobsCreate,
+	ScopeJobsRead,
+	ScopeJobsLogs,
+	ScopeJobsDelete,
+	ScopeRunnersInit,
+	ScopeClientsAdmin,
+	ScopeJobsAdmin,
+}
+
+// DefaultScopes are granted to clients registered without explicit scopes,
+// which includes all the clients registered before scopes were introduced.
+var DefaultScopes = []Scope{
+	ScopeJobsCreate,
+	ScopeJobsRead,
+	ScopeJobsLogs,
+	ScopeJobsDelete,
+	ScopeRunnersInit,
+}
+
+func (s Scope) IsValid() error {
+	if !slices.Contains(AllScopes, s) {
+		return fmt.Errorf("invalid scope %q", s)
+	}
+	return nil
+}
+
+// ParseScopes parses a space separated list of scopes.
+func ParseScopes(str string) ([]Scope, error) {
+	var scopes []Scope
+	for _, field := range strings.Fields(str) {
+		scope := Scope(field)
+		if err := scope.IsValid(); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// FormatScopes returns the given scopes as a space separated list.
+func FormatScopes(scopes []Scope) string {
+	fields := make([]string, len(scopes))
+	for i, scope := range scopes {
+		fields[i] = string(scope)
+	}
+	return strings.Join(fields, " ")
+}
+
+// HasScope returns whether scope is found in scopes. An empty list
+// stands for DefaultScopes.
+func HasScope(scopes []Scope, scope Scope) bool {
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	return slices.Contains(scopes, scope)
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScopes(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		scopes, err := ParseScopes("")
+		require.NoError(t, err)
+		require.Empty(t, scopes)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		scopes, err := ParseScopes("jobs:read admin")
+		require.EqualError(t, err, `invalid scope "admin"`)
+		require.Nil(t, scopes)
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		scopes, err := ParseScopes(" jobs:read  jobs:logs jobs:read ")
+		require.NoError(t, err)
+		require.Equal(t, []Scope{ScopeJobsRead, ScopeJobsLogs}, scopes)
+		require.Equal(t, "jobs:read jobs:logs", FormatScopes(scopes))
+	})
+}
+
+func TestHasScope(t *testing.T) {
+	require.True(t, HasScope(nil, ScopeJobsCreate))
+	require.False(t, HasScope(nil, ScopeClientsAdmin))
+	require.True(t, HasScope(AllScopes, ScopeClientsAdmin))
+	require.True(t, HasScope([]Scope{ScopeJobsRead}, ScopeJobsRead))
+	require.False(t, HasScope([]Scope{ScopeJobsRead}, ScopeJobsCreate))
+}
@@ -4,8 +4,11 @@
 package auth
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/mattermost/calls-offloader/service/store"
 )
@@ -14,40 +17,118 @@ const MinKeyLen = 32
 
 var ErrAlreadyRegistered = errors.New("registration failed: already registered")
 
+// SessionManager issues and validates the bearer tokens returned upon login.
+// It's implemented by SessionCache and TokenSigner.
+type SessionManager interface {
+	Issue(clientID string, scopes []Scope) (string, error)
+	Get(token string) (CachedSession, error)
+	Revoke(token string) error
+	Delete(clientID string) error
+	Close()
+}
+
 type Service struct {
-	sessionCache *SessionCache
-	store        store.Store
+	sessions SessionManager
+	store    store.Store
+
+	// clientsMut serializes updates to client records.
+	clientsMut sync.Mutex
 }
 
-func NewService(store store.Store, sessionCache *SessionCache) (*Service, error) {
+func NewService(store store.Store, sessions SessionManager) (*Service, error) {
 	if store == nil {
 		return nil, errors.New("invalid store")
 	}
-	if sessionCache == nil {
-		return nil, errors.New("invalid session cache")
+	if sessions == nil {
+		return nil, errors.New("invalid session manager")
 	}
 	return &Service{
-		sessionCache: sessionCache,
-		store:        store,
+		sessions: sessions,
+		store:    store,
 	}, nil
 }
 
+// authenticate verifies the given key against the current key of the client
+// and, if allowPrevKey is set, against its previous one during the rotation
+// overlap window.
+func (s *Service) authenticate(id, authToken string, allowPrevKey bool) (clientRecord, error) {
+	rec, err := s.getClient(id)
+	if err != nil {
+		return rec, fmt.Errorf("authentication failed: %w", err)
+	}
+	if err := compareKeyHash(rec.KeyHash, authToken); err != nil {
+		if !allowPrevKey || rec.PrevKeyHash == "" || time.Now().UnixMilli() >= rec.PrevKeyExpiresAt ||
+			compareKeyHash(rec.PrevKeyHash, authToken) != nil {
+			return rec, errors.New("authentication failed")
+		}
+	}
+	// The client record only gets written once its last seen timestamp is
+	// stale, meaning at most once per lastSeenUpdateInterval. A failure is
+	// not worth failing authentication for as the next attempt retries it.
+	if time.Since(time.UnixMilli(rec.LastSeenAt)) >= lastSeenUpdateInterval {
+		_ = s.touchClient(id)
+	}
+	return rec, nil
+}
+
+// Authenticate verifies the key of the given client. The previous key of a
+// rotated client is accepted until the rotation overlap ends.
 func (s *Service) Authenticate(id, authToken string) error {
-	hash, err := s.store.Get(id)
+	_, err := s.authenticate(id, authToken, true)
+	return err
+}
+
+// AuthenticateCurrentKey is like Authenticate but only accepts the current
+// key, as required to manage the client itself (e.g. rotating its key).
+func (s *Service) AuthenticateCurrentKey(id, authToken string) error {
+	_, err := s.authenticate(id, authToken, false)
+	return err
+}
+
+// GetScopes returns the scopes granted to the given client.
+func (s *Service) GetScopes(id string) ([]Scope, error) {
+	rec, err := s.getClient(id)
 	if err != nil {
-		return fmt.Errorf("authentication failed: %w", err)
+		return nil, fmt.Errorf("failed to get client: %w", err)
 	}
-	if err := compareKeyHash(hash, authToken); err != nil {
-		return errors.New("authentication failed")
+	if len(rec.Scopes) == 0 {
+		return DefaultScopes, nil
 	}
-	return nil
+	return rec.Scopes, nil
+}
+
+// HasExplicitScopes returns whether the given client was registered with
+// specific scopes rather than the default ones.
+func (s *Service) HasExplicitScopes(id string) (bool, error) {
+	rec, err := s.getClient(id)
+	if err != nil {
+		return false, fmt.Errorf("failed to get client: %w", err)
+	}
+	return len(rec.Scopes) > 0, nil
 }
 
+// Register registers a new client with the default scopes.
 func (s *Service) Register(id, key string) error {
+	return s.RegisterWithScopes(id, key, nil)
+}
+
+// RegisterWithScopes registers a new client granting it the given scopes.
+// DefaultScopes are granted if none are given.
+func (s *Service) RegisterWithScopes(id, key string, scopes []Scope) error {
+	if isReservedClientID(id) {
+		return errors.New("registration failed: client id is reserved")
+	}
+
 	if len(key) < MinKeyLen {
 		return errors.New("registration failed: key not long enough")
 	}
 
+	for _, scope := range scopes {
+		if err := scope.IsValid(); err != nil {
+			return fmt.Errorf("registration failed: %w", err)
+		}
+	}
+
 	if _, err := s.store.Get(id); err == nil {
 		return ErrAlreadyRegistered
 	} else if !errors.Is(err, store.ErrNotFound) {
@@ -59,16 +140,35 @@ func (s *Service) Register(id, key string) error {
 		return fmt.Errorf("registration failed: %w", err)
 	}
 
-	if err := s.store.Put(id, hash); errors.Is(err, store.ErrConflict) {
+	data, err := json.Marshal(clientRecord{
+		KeyHash:   hash,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return fmt.Errorf("registration failed: %w", err)
+	}
+
+	s.clientsMut.Lock()
+	defer s.clientsMut.Unlock()
+
+	if err := s.store.Put(id, string(data)); errors.Is(err, store.ErrConflict) {
 		return ErrAlreadyRegistered
 	} else if err != nil {
 		return fmt.Errorf("registration failed: %w", err)
 	}
 
+	if err := s.updateClientsIndex(id, true); err != nil {
+		return fmt.Errorf("registration failed: %w", err)
+	}
+
 	return nil
 }
 
 func (s *Service) Unregister(id string) error {
+	s.clientsMut.Lock()
+	defer s.clientsMut.Unlock()
+
 	if _, err := s.store.Get(id); err != nil {
 		return fmt.Errorf("unregister failed: %w", err)
 	}
@@ -78,22 +178,42 @@ func (s *Service) Unregister(id string) error {
 		return fmt.Errorf("unregister failed: %w", err)
 	}
 
-	// Invalidate token when unregistering
-	s.sessionCache.Delete(id)
+	if err := s.updateClientsIndex(id, false); err != nil {
+		return fmt.Errorf("unregister failed: %w", err)
+	}
+
+	// Invalidate tokens when unregistering
+	if err := s.sessions.Delete(id); err != nil {
+		return fmt.Errorf("unregister failed: %w", err)
+	}
 
 	return nil
 }
 
 func (s *Service) Login(id, key string) (string, error) {
-	if err := s.Authenticate(id, key); err != nil {
-		return "", fmt.Errorf("login failed: %w", err)
-	}
-	bearerToken, err := newRandomToken()
+	rec, err := s.authenticate(id, key, true)
 	if err != nil {
 		return "", fmt.Errorf("login failed: %w", err)
 	}
-	if err = s.sessionCache.Put(id, bearerToken); err != nil {
+	scopes := rec.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	bearerToken, err := s.sessions.Issue(id, scopes)
+	if err != nil {
 		return "", fmt.Errorf("login failed: %w", err)
 	}
 	return bearerToken, nil
 }
+
+// GetSession returns the session associated with the given bearer token.
+func (s *Service) GetSession(token string) (CachedSession, error) {
+	return s.sessions.Get(token)
+}
+
+func (s *Service) Logout(token string) error {
+	if err := s.sessions.Revoke(token); err != nil {
+		return fmt.Errorf("logout failed: %w", err)
+	}
+	return nil
+}
@@ -28,7 +28,7 @@ func newTestDBStore(t *testing.T) (store.Store, func()) {
 
 func newTestSessionCache(t *testing.T) *SessionCache {
 	t.Helper()
-	sessionCache, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440})
+	sessionCache, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440}, nil)
 	require.NoError(t, err)
 	require.NotNil(t, sessionCache)
 	return sessionCache
@@ -89,6 +89,13 @@ func TestRegister(t *testing.T) {
 
 	err = s.Register("instanceA", authKey)
 	require.NoError(t, err)
+
+	err = s.Register(sessionKeyPrefix+"instanceA", authKey)
+	require.EqualError(t, err, "registration failed: client id is reserved")
+	err = s.Register(clientsIndexKey, authKey)
+	require.EqualError(t, err, "registration failed: client id is reserved")
+	err = s.Authenticate(sessionKeyPrefix+"instanceA", authKey)
+	require.EqualError(t, err, "authentication failed: error: not found")
 }
 
 func TestAuthenticate(t *testing.T) {
@@ -123,3 +130,100 @@ func TestAuthenticate(t *testing.T) {
 	require.Error(t, err)
 	require.EqualError(t, err, "authentication failed: error: not found")
 }
+
+func TestLogout(t *testing.T) {
+	dbStore, teardown := newTestDBStore(t)
+	defer teardown()
+	sessionCache := newTestSessionCache(t)
+
+	s, err := NewService(dbStore, sessionCache)
+	require.NoError(t, err)
+	require.NotNil(t, s)
+
+	authKey, err := newRandomString(MinKeyLen)
+	require.NoError(t, err)
+	err = s.Register("instanceA", authKey)
+	require.NoError(t, err)
+
+	tokenA, err := s.Login("instanceA", authKey)
+	require.NoError(t, err)
+	tokenB, err := s.Login("instanceA", authKey)
+	require.NoError(t, err)
+
+	err = s.Logout(tokenA)
+	require.NoError(t, err)
+
+	err = s.Logout(tokenA)
+	require.EqualError(t, err, "logout failed: token is invalid")
+
+	_, err = sessionCache.Get(tokenA)
+	require.Error(t, err)
+
+	session, err := sessionCache.Get(tokenB)
+	require.NoError(t, err)
+	require.Equal(t, "instanceA", session.ClientID)
+}
+
+func TestRegisterWithScopes(t *testing.T) {
+	dbStore, teardown := newTestDBStore(t)
+	defer teardown()
+	sessionCache := newTestSessionCache(t)
+
+	s, err := NewService(dbStore, sessionCache)
+	require.NoError(t, err)
+	require.NotNil(t, s)
+
+	authKey, err := newRandomString(MinKeyLen)
+	require.NoError(t, err)
+
+	t.Run("invalid scope", func(t *testing.T) {
+		err := s.RegisterWithScopes("instanceA", authKey, []Scope{"jobs:unknown"})
+		require.EqualError(t, err, `registration failed: invalid scope "jobs:unknown"`)
+	})
+
+	t.Run("default scopes", func(t *testing.T) {
+		err := s.Register("instanceA", authKey)
+		require.NoError(t, err)
+
+		scopes, err := s.GetScopes("instanceA")
+		require.NoError(t, err)
+		require.Equal(t, DefaultScopes, scopes)
+
+		explicit, err := s.HasExplicitScopes("instanceA")
+		require.NoError(t, err)
+		require.False(t, explicit)
+	})
+
+	t.Run("tokens inherit scopes", func(t *testing.T) {
+		err := s.RegisterWithScopes("instanceB", authKey, []Scope{ScopeJobsRead, ScopeJobsLogs})
+		require.NoError(t, err)
+
+		scopes, err := s.GetScopes("instanceB")
+		require.NoError(t, err)
+		require.Equal(t, []Scope{ScopeJobsRead, ScopeJobsLogs}, scopes)
+
+		explicit, err := s.HasExplicitScopes("instanceB")
+		require.NoError(t, err)
+		require.True(t, explicit)
+
+		token, err := s.Login("instanceB", authKey)
+		require.NoError(t, err)
+		session, err := s.GetSession(token)
+		require.NoError(t, err)
+		require.Equal(t, []Scope{ScopeJobsRead, ScopeJobsLogs}, session.Scopes)
+	})
+
+	t.Run("legacy client record", func(t *testing.T) {
+		hash, err := hashKey(authKey)
+		require.NoError(t, err)
+		err = dbStore.Set("instanceC", hash)
+		require.NoError(t, err)
+
+		err = s.Authenticate("instanceC", authKey)
+		require.NoError(t, err)
+
+		scopes, err := s.GetScopes("instanceC")
+		require.NoError(t, err)
+		require.Equal(t, DefaultScopes, scopes)
+	})
+}
@@ -4,58 +4,144 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/mattermost/calls-offloader/service/store"
+)
+
+const (
+	// DefaultMaxSessionsPerClient is the number of concurrent sessions allowed
+	// for each client when not otherwise configured.
+	DefaultMaxSessionsPerClient = 10
+
+	// Each persisted session is saved under this prefix followed by the
+	// hash of its token.
+	sessionKeyPrefix         = "session_"
+	sessionCacheStoreVersion = 1
 )
 
+var sessionCacheGCInterval = time.Minute
+
 type CachedSession struct {
-	ClientID       string
-	ExpirationDate time.Time
+	ClientID       string    `json:"client_id"`
+	ExpirationDate time.Time `json:"expiration_date"`
+	// Scopes granted to the session. Empty stands for DefaultScopes.
+	Scopes []Scope `json:"scopes,omitempty"`
+}
+
+// persistedSession is the format used to save a session in the store.
+// Sessions are keyed by the hash of their token so that no usable
+// credential is ever written to disk.
+type persistedSession struct {
+	Version int `json:"version"`
+	CachedSession
 }
 
 type SessionCacheConfig struct {
 	ExpirationMinutes int `toml:"expiration_minutes"`
+	// The maximum number of concurrent sessions allowed for each client.
+	// When reached, the oldest session gets invalidated upon login.
+	MaxSessionsPerClient int `toml:"max_sessions_per_client"`
+	// Whether to persist sessions in the store so that they survive restarts.
+	Persist bool `toml:"persist"`
 }
 
 func (c SessionCacheConfig) IsValid() error {
 	if c.ExpirationMinutes <= 0 {
 		return errors.New("invalid ExpirationMinutes value: should be a positive number")
 	}
+	if c.MaxSessionsPerClient < 0 {
+		return errors.New("invalid MaxSessionsPerClient value: should not be negative")
+	}
 	return nil
 }
 
 type SessionCache struct {
-	cfg        SessionCacheConfig
+	cfg SessionCacheConfig
+	// sessionMap indexes sessions by the hash of their token.
 	sessionMap map[string]CachedSession
+	// clientSessions indexes token hashes by client ID, ordered from oldest to newest.
+	clientSessions map[string][]string
+	// store is only set if sessions should be persisted.
+	store store.Store
 
-	mut sync.RWMutex
+	mut      sync.RWMutex
+	stopCh   chan struct{}
+	gcDoneCh chan struct{}
 }
 
-func NewSessionCache(cfg SessionCacheConfig) (*SessionCache, error) {
+// NewSessionCache creates a new session cache. The given store is only used,
+// and required, if cfg.Persist is set.
+func NewSessionCache(cfg SessionCacheConfig, st store.Store) (*SessionCache, error) {
 	if err := cfg.IsValid(); err != nil {
 		return nil, err
 	}
-	return &SessionCache{cfg: cfg, sessionMap: make(map[string]CachedSession)}, nil
+	if cfg.MaxSessionsPerClient == 0 {
+		cfg.MaxSessionsPerClient = DefaultMaxSessionsPerClient
+	}
+
+	t := &SessionCache{
+		cfg:            cfg,
+		sessionMap:     make(map[string]CachedSession),
+		clientSessions: make(map[string][]string),
+		stopCh:         make(chan struct{}),
+		gcDoneCh:       make(chan struct{}),
+	}
+
+	if cfg.Persist {
+		if st == nil {
+			return nil, errors.New("invalid store")
+		}
+		t.store = st
+		if err := t.load(); err != nil {
+			return nil, fmt.Errorf("failed to load sessions: %w", err)
+		}
+	}
+
+	go t.gc()
+
+	return t, nil
+}
+
+// hashToken returns the hash of the given token, encoded so that it fits
+// within the store's key size limit once prefixed.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
 }
 
 func (t *SessionCache) Get(token string) (CachedSession, error) {
+	key := hashToken(token)
 	t.mut.RLock()
-	session, ok := t.sessionMap[token]
+	session, ok := t.sessionMap[key]
 	t.mut.RUnlock()
 	if !ok {
 		return CachedSession{}, errors.New("token is invalid")
 	}
 	if time.Now().After(session.ExpirationDate) {
+		// The persisted copy, if any, expires on its own.
 		t.mut.Lock()
-		delete(t.sessionMap, token)
+		t.revoke(key)
 		t.mut.Unlock()
 		return CachedSession{}, errors.New("session is expired")
 	}
 	return session, nil
 }
 
+// Put caches a session with the default scopes for the given token.
 func (t *SessionCache) Put(clientID, token string) error {
+	return t.put(clientID, token, nil)
+}
+
+func (t *SessionCache) put(clientID, token string, scopes []Scope) error {
 	if len(clientID) == 0 {
 		return errors.New("can not cache: invalid client id")
 	}
@@ -63,34 +149,239 @@ func (t *SessionCache) Put(clientID, token string) error {
 		return errors.New("can not cache: invalid token")
 	}
 
+	key := hashToken(token)
+
 	t.mut.Lock()
 	defer t.mut.Unlock()
 
-	_, ok := t.sessionMap[token]
+	_, ok := t.sessionMap[key]
 	if ok {
 		return errors.New("can not cache: token in use")
 	}
 
-	// Make sure there is only one bearer token per client.
-	t.delete(clientID)
-	t.sessionMap[token] = CachedSession{
+	// Clearing expired sessions first so that they don't count towards the limit.
+	// Their persisted copies expire on their own.
+	now := time.Now()
+	for _, k := range t.clientSessions[clientID] {
+		if now.After(t.sessionMap[k].ExpirationDate) {
+			t.revoke(k)
+		}
+	}
+
+	// Make sure there are no more than the allowed number of sessions per client
+	// by invalidating the oldest ones.
+	prevKeys := t.clientSessions[clientID]
+	evicted := make(map[string]CachedSession)
+	for len(t.clientSessions[clientID]) >= t.cfg.MaxSessionsPerClient {
+		k := t.clientSessions[clientID][0]
+		evicted[k] = t.sessionMap[k]
+		delete(t.sessionMap, k)
+		t.clientSessions[clientID] = t.clientSessions[clientID][1:]
+	}
+
+	session := CachedSession{
 		ClientID:       clientID,
-		ExpirationDate: time.Now().Add(time.Duration(t.cfg.ExpirationMinutes) * time.Minute),
+		ExpirationDate: now.Add(time.Duration(t.cfg.ExpirationMinutes) * time.Minute),
+		Scopes:         scopes,
+	}
+	t.sessionMap[key] = session
+	t.clientSessions[clientID] = append(t.clientSessions[clientID], key)
+
+	if err := t.persistSessions(key, session, evicted); err != nil {
+		// Rolling back so that the cache keeps matching the store.
+		delete(t.sessionMap, key)
+		for k, s := range evicted {
+			t.sessionMap[k] = s
+		}
+		if len(prevKeys) == 0 {
+			delete(t.clientSessions, clientID)
+		} else {
+			t.clientSessions[clientID] = prevKeys
+		}
+		return fmt.Errorf("can not cache: %w", err)
 	}
+
 	return nil
 }
 
-func (t *SessionCache) Delete(clientID string) {
+// Issue creates and caches a new random token for the given client.
+func (t *SessionCache) Issue(clientID string, scopes []Scope) (string, error) {
+	token, err := newRandomToken()
+	if err != nil {
+		return "", err
+	}
+	if err := t.put(clientID, token, scopes); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Delete invalidates all the sessions for the given client.
+func (t *SessionCache) Delete(clientID string) error {
 	t.mut.Lock()
-	t.delete(clientID)
-	t.mut.Unlock()
+	defer t.mut.Unlock()
+	var err error
+	for _, key := range t.clientSessions[clientID] {
+		delete(t.sessionMap, key)
+		if uErr := t.unpersistSession(key); uErr != nil && err == nil {
+			err = uErr
+		}
+	}
+	delete(t.clientSessions, clientID)
+	return err
+}
+
+// Revoke invalidates the session associated with the given token.
+func (t *SessionCache) Revoke(token string) error {
+	key := hashToken(token)
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if _, ok := t.sessionMap[key]; !ok {
+		return errors.New("token is invalid")
+	}
+	t.revoke(key)
+	return t.unpersistSession(key)
+}
+
+// Close stops the background garbage collection of expired sessions.
+func (t *SessionCache) Close() {
+	close(t.stopCh)
+	<-t.gcDoneCh
 }
 
-func (t *SessionCache) delete(clientID string) {
-	for token, session := range t.sessionMap {
-		if session.ClientID == clientID {
-			delete(t.sessionMap, token)
+func (t *SessionCache) revoke(key string) {
+	session, ok := t.sessionMap[key]
+	if !ok {
+		return
+	}
+	delete(t.sessionMap, key)
+
+	keys := t.clientSessions[session.ClientID]
+	for i, k := range keys {
+		if k == key {
+			keys = append(keys[:i:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(t.clientSessions, session.ClientID)
+	} else {
+		t.clientSessions[session.ClientID] = keys
+	}
+}
+
+func (t *SessionCache) gc() {
+	defer close(t.gcDoneCh)
+
+	ticker := time.NewTicker(sessionCacheGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stopCh:
 			return
+		case <-ticker.C:
+			t.deleteExpired()
+		}
+	}
+}
+
+func (t *SessionCache) deleteExpired() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	// Persisted copies expire on their own.
+	now := time.Now()
+	for key, session := range t.sessionMap {
+		if now.After(session.ExpirationDate) {
+			t.revoke(key)
+		}
+	}
+}
+
+// persistSessions saves the given session to the store, if configured, and
+// deletes the evicted ones. The given session is deleted again on failure. It
+// must be called with the lock held.
+func (t *SessionCache) persistSessions(key string, session CachedSession, evicted map[string]CachedSession) error {
+	if t.store == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(persistedSession{
+		Version:       sessionCacheStoreVersion,
+		CachedSession: session,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	if err := t.store.SetWithTTL(sessionKeyPrefix+key, string(data), time.Until(session.ExpirationDate)); err != nil {
+		return fmt.Errorf("failed to persist session: %w", err)
+	}
+
+	for k := range evicted {
+		if err := t.unpersistSession(k); err != nil {
+			// Evicted sessions that were already deleted get restored in
+			// memory only, meaning they won't survive a restart.
+			_ = t.unpersistSession(key)
+			return err
 		}
 	}
+
+	return nil
+}
+
+// unpersistSession deletes the given session from the store, if configured.
+// It must be called with the lock held.
+func (t *SessionCache) unpersistSession(key string) error {
+	if t.store == nil {
+		return nil
+	}
+
+	if err := t.store.Delete(sessionKeyPrefix + key); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+
+	return nil
+}
+
+func (t *SessionCache) load() error {
+	now := time.Now()
+	err := t.store.Scan(sessionKeyPrefix, func(key, data string) error {
+		var ps persistedSession
+		if err := json.Unmarshal([]byte(data), &ps); err != nil {
+			return fmt.Errorf("failed to unmarshal session: %w", err)
+		}
+
+		if ps.Version != sessionCacheStoreVersion {
+			return fmt.Errorf("unsupported version %d", ps.Version)
+		}
+
+		// Expired entries are either not removed yet or lost their expiration
+		// along the way, e.g. when migrated from a bitcask store.
+		if now.After(ps.ExpirationDate) {
+			if err := t.store.Delete(key); err != nil && !errors.Is(err, store.ErrNotFound) {
+				return fmt.Errorf("failed to delete expired session: %w", err)
+			}
+			return nil
+		}
+
+		key = strings.TrimPrefix(key, sessionKeyPrefix)
+		t.sessionMap[key] = ps.CachedSession
+		t.clientSessions[ps.ClientID] = append(t.clientSessions[ps.ClientID], key)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sessions share the same lifetime so sorting by expiration
+	// gives back the order in which they were created.
+	for _, keys := range t.clientSessions {
+		sort.Slice(keys, func(i, j int) bool {
+			return t.sessionMap[keys[i]].ExpirationDate.Before(t.sessionMap[keys[j]].ExpirationDate)
+		})
+	}
+
+	return nil
 }
@@ -4,28 +4,53 @@
 package auth
 
 import (
-	"github.com/stretchr/testify/require"
+	"encoding/json"
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/mattermost/calls-offloader/service/store"
+
+	"github.com/stretchr/testify/require"
 )
 
+// failingStore fails all writes once failWrites is set.
+type failingStore struct {
+	store.Store
+	failWrites bool
+}
+
+func (s *failingStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	if s.failWrites {
+		return errors.New("write failed")
+	}
+	return s.Store.SetWithTTL(key, value, ttl)
+}
+
 func TestNewSessionCache(t *testing.T) {
 	t.Run("empty config", func(t *testing.T) {
-		tc, err := NewSessionCache(SessionCacheConfig{})
+		tc, err := NewSessionCache(SessionCacheConfig{}, nil)
 		require.Error(t, err)
 		require.Equal(t, "invalid ExpirationMinutes value: should be a positive number", err.Error())
 		require.Nil(t, tc)
 	})
 
 	t.Run("invalid session expiration minutes", func(t *testing.T) {
-		tc, err := NewSessionCache(SessionCacheConfig{})
+		tc, err := NewSessionCache(SessionCacheConfig{}, nil)
 		require.Error(t, err)
 		require.Equal(t, "invalid ExpirationMinutes value: should be a positive number", err.Error())
 		require.Nil(t, tc)
 	})
 
+	t.Run("invalid max sessions per client", func(t *testing.T) {
+		tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440, MaxSessionsPerClient: -1}, nil)
+		require.Error(t, err)
+		require.Equal(t, "invalid MaxSessionsPerClient value: should not be negative", err.Error())
+		require.Nil(t, tc)
+	})
+
 	t.Run("success", func(t *testing.T) {
-		tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440})
+		tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440}, nil)
 		require.NoError(t, err)
 		require.NotNil(t, tc)
 		require.NotEmpty(t, tc)
@@ -34,7 +59,7 @@ func TestNewSessionCache(t *testing.T) {
 }
 
 func TestGet(t *testing.T) {
-	tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440})
+	tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440}, nil)
 	require.NoError(t, err)
 
 	t.Run("token is invalid", func(t *testing.T) {
@@ -45,7 +70,7 @@ func TestGet(t *testing.T) {
 	})
 
 	t.Run("session is expired", func(t *testing.T) {
-		tc.sessionMap = map[string]CachedSession{"foo": {ClientID: "bar", ExpirationDate: time.Now().Add(-10 * time.Minute)}}
+		tc.sessionMap = map[string]CachedSession{hashToken("foo"): {ClientID: "bar", ExpirationDate: time.Now().Add(-10 * time.Minute)}}
 		session, err := tc.Get("foo")
 		require.Error(t, err)
 		require.Equal(t, "session is expired", err.Error())
@@ -54,7 +79,7 @@ func TestGet(t *testing.T) {
 
 	t.Run("valid session returned", func(t *testing.T) {
 		expirationDate := time.Now().Add(10 * time.Minute)
-		tc.sessionMap = map[string]CachedSession{"foo": {ClientID: "bar", ExpirationDate: expirationDate}}
+		tc.sessionMap = map[string]CachedSession{hashToken("foo"): {ClientID: "bar", ExpirationDate: expirationDate}}
 		session, err := tc.Get("foo")
 		require.NoError(t, err)
 		require.NotNil(t, session)
@@ -64,7 +89,7 @@ func TestGet(t *testing.T) {
 }
 
 func TestPut(t *testing.T) {
-	tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440})
+	tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440}, nil)
 	require.NoError(t, err)
 
 	t.Run("invalid client id", func(t *testing.T) {
@@ -93,24 +118,209 @@ func TestPut(t *testing.T) {
 		require.Len(t, tc.sessionMap, 1)
 	})
 
-	t.Run("existing session is deleted", func(t *testing.T) {
+	t.Run("multiple sessions per client", func(t *testing.T) {
 		require.Len(t, tc.sessionMap, 1)
 		err := tc.Put("foo", "foo")
 		require.NoError(t, err)
-		require.Len(t, tc.sessionMap, 1)
+		require.Len(t, tc.sessionMap, 2)
+		require.Equal(t, []string{hashToken("bar"), hashToken("foo")}, tc.clientSessions["foo"])
+	})
+
+	t.Run("oldest session is deleted", func(t *testing.T) {
+		tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440, MaxSessionsPerClient: 2}, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, tc.Put("foo", "tokenA"))
+		require.NoError(t, tc.Put("foo", "tokenB"))
+		require.NoError(t, tc.Put("bar", "tokenC"))
+		require.NoError(t, tc.Put("foo", "tokenD"))
+
+		require.Len(t, tc.sessionMap, 3)
+		_, err = tc.Get("tokenA")
+		require.EqualError(t, err, "token is invalid")
+		require.Equal(t, []string{hashToken("tokenB"), hashToken("tokenD")}, tc.clientSessions["foo"])
+		require.Equal(t, []string{hashToken("tokenC")}, tc.clientSessions["bar"])
 	})
 
+	t.Run("expired sessions are deleted", func(t *testing.T) {
+		tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440, MaxSessionsPerClient: 2}, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, tc.Put("foo", "tokenA"))
+		require.NoError(t, tc.Put("foo", "tokenB"))
+		tc.sessionMap[hashToken("tokenB")] = CachedSession{ClientID: "foo", ExpirationDate: time.Now().Add(-time.Minute)}
+		require.NoError(t, tc.Put("foo", "tokenC"))
+
+		require.Len(t, tc.sessionMap, 2)
+		require.Equal(t, []string{hashToken("tokenA"), hashToken("tokenC")}, tc.clientSessions["foo"])
+	})
 }
 
 func TestDelete(t *testing.T) {
-	tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440})
+	tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440}, nil)
 	require.NoError(t, err)
 
-	t.Run("session is deleted", func(t *testing.T) {
+	t.Run("sessions are deleted", func(t *testing.T) {
 		err := tc.Put("foo", "bar")
 		require.NoError(t, err)
-		require.Len(t, tc.sessionMap, 1)
+		err = tc.Put("foo", "baz")
+		require.NoError(t, err)
+		err = tc.Put("bar", "foo")
+		require.NoError(t, err)
+		require.Len(t, tc.sessionMap, 3)
 		tc.Delete("foo")
-		require.Len(t, tc.sessionMap, 0)
+		require.Len(t, tc.sessionMap, 1)
+		require.Empty(t, tc.clientSessions["foo"])
+	})
+}
+
+func TestRevoke(t *testing.T) {
+	tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440}, nil)
+	require.NoError(t, err)
+
+	t.Run("token is invalid", func(t *testing.T) {
+		err := tc.Revoke("foo")
+		require.EqualError(t, err, "token is invalid")
+	})
+
+	t.Run("only the given session is revoked", func(t *testing.T) {
+		err := tc.Put("foo", "tokenA")
+		require.NoError(t, err)
+		err = tc.Put("foo", "tokenB")
+		require.NoError(t, err)
+
+		err = tc.Revoke("tokenA")
+		require.NoError(t, err)
+
+		_, err = tc.Get("tokenA")
+		require.EqualError(t, err, "token is invalid")
+		session, err := tc.Get("tokenB")
+		require.NoError(t, err)
+		require.Equal(t, "foo", session.ClientID)
+		require.Equal(t, []string{hashToken("tokenB")}, tc.clientSessions["foo"])
+
+		err = tc.Revoke("tokenB")
+		require.NoError(t, err)
+		require.Empty(t, tc.sessionMap)
+		require.Empty(t, tc.clientSessions)
+	})
+}
+
+func TestSessionCachePersistence(t *testing.T) {
+	cfg := SessionCacheConfig{ExpirationMinutes: 1440, Persist: true}
+
+	t.Run("missing store", func(t *testing.T) {
+		tc, err := NewSessionCache(cfg, nil)
+		require.EqualError(t, err, "invalid store")
+		require.Nil(t, tc)
 	})
+
+	t.Run("sessions survive restarts", func(t *testing.T) {
+		dbStore, teardown := newTestDBStore(t)
+		defer teardown()
+
+		tc, err := NewSessionCache(cfg, dbStore)
+		require.NoError(t, err)
+		require.NoError(t, tc.Put("foo", "tokenA"))
+		require.NoError(t, tc.Put("foo", "tokenB"))
+		require.NoError(t, tc.Put("bar", "tokenC"))
+		require.NoError(t, tc.Revoke("tokenC"))
+		tc.Close()
+
+		data, err := dbStore.Get(sessionKeyPrefix + hashToken("tokenA"))
+		require.NoError(t, err)
+		require.NotContains(t, data, "tokenA")
+		_, err = dbStore.Get(sessionKeyPrefix + hashToken("tokenC"))
+		require.ErrorIs(t, err, store.ErrNotFound)
+
+		tc, err = NewSessionCache(cfg, dbStore)
+		require.NoError(t, err)
+		defer tc.Close()
+
+		session, err := tc.Get("tokenA")
+		require.NoError(t, err)
+		require.Equal(t, "foo", session.ClientID)
+		_, err = tc.Get("tokenB")
+		require.NoError(t, err)
+		_, err = tc.Get("tokenC")
+		require.EqualError(t, err, "token is invalid")
+		require.Equal(t, []string{hashToken("tokenA"), hashToken("tokenB")}, tc.clientSessions["foo"])
+	})
+
+	t.Run("expired sessions are deleted", func(t *testing.T) {
+		dbStore, teardown := newTestDBStore(t)
+		defer teardown()
+
+		data, err := json.Marshal(persistedSession{
+			Version:       sessionCacheStoreVersion,
+			CachedSession: CachedSession{ClientID: "foo", ExpirationDate: time.Now().Add(-time.Minute)},
+		})
+		require.NoError(t, err)
+		require.NoError(t, dbStore.Set(sessionKeyPrefix+hashToken("tokenA"), string(data)))
+
+		tc, err := NewSessionCache(cfg, dbStore)
+		require.NoError(t, err)
+		defer tc.Close()
+		require.Empty(t, tc.sessionMap)
+		require.Empty(t, tc.clientSessions)
+
+		// Saved without an expiration, as done when migrating from bitcask.
+		_, err = dbStore.Get(sessionKeyPrefix + hashToken("tokenA"))
+		require.ErrorIs(t, err, store.ErrNotFound)
+	})
+
+	t.Run("failed writes are rolled back", func(t *testing.T) {
+		dbStore, teardown := newTestDBStore(t)
+		defer teardown()
+		st := &failingStore{Store: dbStore}
+
+		tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440, MaxSessionsPerClient: 2, Persist: true}, st)
+		require.NoError(t, err)
+		defer tc.Close()
+
+		require.NoError(t, tc.Put("foo", "tokenA"))
+		require.NoError(t, tc.Put("foo", "tokenB"))
+
+		st.failWrites = true
+		require.EqualError(t, tc.Put("foo", "tokenC"), "can not cache: failed to persist session: write failed")
+
+		_, err = tc.Get("tokenA")
+		require.NoError(t, err)
+		_, err = tc.Get("tokenC")
+		require.EqualError(t, err, "token is invalid")
+		require.Len(t, tc.sessionMap, 2)
+		require.Equal(t, []string{hashToken("tokenA"), hashToken("tokenB")}, tc.clientSessions["foo"])
+
+		require.EqualError(t, tc.Put("bar", "tokenD"), "can not cache: failed to persist session: write failed")
+		require.NotContains(t, tc.clientSessions, "bar")
+	})
+}
+
+func TestSessionCacheGC(t *testing.T) {
+	defaultInterval := sessionCacheGCInterval
+	sessionCacheGCInterval = 10 * time.Millisecond
+	defer func() {
+		sessionCacheGCInterval = defaultInterval
+	}()
+
+	tc, err := NewSessionCache(SessionCacheConfig{ExpirationMinutes: 1440}, nil)
+	require.NoError(t, err)
+	defer tc.Close()
+
+	require.NoError(t, tc.Put("foo", "tokenA"))
+	require.NoError(t, tc.Put("foo", "tokenB"))
+
+	tc.mut.Lock()
+	tc.sessionMap[hashToken("tokenA")] = CachedSession{ClientID: "foo", ExpirationDate: time.Now().Add(-time.Minute)}
+	tc.mut.Unlock()
+
+	require.Eventually(t, func() bool {
+		tc.mut.RLock()
+		defer tc.mut.RUnlock()
+		return len(tc.sessionMap) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	tc.mut.RLock()
+	require.Equal(t, []string{hashToken("tokenB")}, tc.clientSessions["foo"])
+	tc.mut.RUnlock()
 }
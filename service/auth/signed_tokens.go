@@ -0,0 +1,437 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/calls-offloader/service/store"
+)
+
+const (
+	SigningAlgorithmHS256 = "HS256"
+	SigningAlgorithmEdDSA = "EdDSA"
+
+	minHMACSecretLen = 32
+
+	revokedTokenKeyPrefix    = "revoked_token_"
+	tokenGenerationKeyPrefix = "token_generation_"
+)
+
+type TokenMode string
+
+const (
+	// TokenModeSession issues random tokens tracked by the local SessionCache.
+	TokenModeSession TokenMode = "session"
+	// TokenModeSigned issues signed tokens that any instance sharing the
+	// same keys and store can verify.
+	TokenModeSigned TokenMode = "signed"
+)
+
+type SigningKey struct {
+	// Either HS256 or EdDSA.
+	Algorithm string `json:"algorithm"`
+	// Base64 encoded shared secret, for HS256 keys.
+	Secret string `json:"secret,omitempty"`
+	// Base64 encoded Ed25519 seed or private key, for EdDSA keys.
+	PrivateKey string `json:"private_key,omitempty"`
+	// Base64 encoded Ed25519 public key, for EdDSA keys that should only be
+	// used to verify tokens.
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+// SigningKeys maps a key ID to its key.
+type SigningKeys map[string]SigningKey
+
+func (k *SigningKeys) Decode(data string) error {
+	return json.Unmarshal([]byte(data), k)
+}
+
+func (k *SigningKeys) UnmarshalTOML(data interface{}) error {
+	js, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("invalid data found")
+	}
+	if js == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(js), k)
+}
+
+type SignedTokensConfig struct {
+	ExpirationMinutes int `toml:"expiration_minutes"`
+	// The ID of the key used to sign new tokens. All the other keys are only
+	// used for verification, which allows keys to be rotated.
+	SigningKeyID string      `toml:"signing_key_id"`
+	Keys         SigningKeys `toml:"keys"`
+}
+
+func (c SignedTokensConfig) IsValid() error {
+	if c.ExpirationMinutes <= 0 {
+		return errors.New("invalid ExpirationMinutes value: should be a positive number")
+	}
+
+	if c.SigningKeyID == "" {
+		return errors.New("invalid SigningKeyID value: should not be empty")
+	}
+
+	if _, ok := c.Keys[c.SigningKeyID]; !ok {
+		return fmt.Errorf("invalid SigningKeyID value: key %q not found", c.SigningKeyID)
+	}
+
+	for id, key := range c.Keys {
+		k, err := parseSigningKey(key)
+		if err != nil {
+			return fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		if id == c.SigningKeyID && !k.canSign() {
+			return fmt.Errorf("invalid key %q: signing key cannot be verification only", id)
+		}
+	}
+
+	return nil
+}
+
+type signingKey struct {
+	alg        string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+func parseSigningKey(key SigningKey) (signingKey, error) {
+	k := signingKey{alg: key.Algorithm}
+
+	switch key.Algorithm {
+	case SigningAlgorithmHS256:
+		secret, err := base64.StdEncoding.DecodeString(key.Secret)
+		if err != nil {
+			return k, fmt.Errorf("failed to decode secret: %w", err)
+		}
+		if len(secret) < minHMACSecretLen {
+			return k, fmt.Errorf("secret should be at least %d bytes", minHMACSecretLen)
+		}
+		k.secret = secret
+	case SigningAlgorithmEdDSA:
+		if key.PrivateKey != "" {
+			data, err := base64.StdEncoding.DecodeString(key.PrivateKey)
+			if err != nil {
+				return k, fmt.Errorf("failed to decode private key: %w", err)
+			}
+			switch len(data) {
+			case ed25519.SeedSize:
+				k.privateKey = ed25519.NewKeyFromSeed(data)
+			case ed25519.PrivateKeySize:
+				k.privateKey = ed25519.PrivateKey(data)
+			default:
+				return k, errors.New("invalid private key size")
+			}
+			k.publicKey = k.privateKey.Public().(ed25519.PublicKey)
+		} else {
+			data, err := base64.StdEncoding.DecodeString(key.PublicKey)
+			if err != nil {
+				return k, fmt.Errorf("failed to decode public key: %w", err)
+			}
+			if len(data) != ed25519.PublicKeySize {
+				return k, errors.New("invalid public key size")
+			}
+			k.publicKey = ed25519.PublicKey(data)
+		}
+	default:
+		return k, fmt.Errorf("unsupported algorithm %q", key.Algorithm)
+	}
+
+	return k, nil
+}
+
+func (k signingKey) canSign() bool {
+	return k.secret != nil || k.privateKey != nil
+}
+
+func (k signingKey) sign(data []byte) []byte {
+	if k.alg == SigningAlgorithmHS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.privateKey, data)
+}
+
+func (k signingKey) verify(data, sig []byte) bool {
+	if k.alg == SigningAlgorithmHS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+	return ed25519.Verify(k.publicKey, data, sig)
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+	Scope     string `json:"scope,omitempty"`
+	// The client's token generation at issue time. Bumping the generation
+	// invalidates all the tokens previously issued to the client.
+	Generation int64 `json:"gen"`
+}
+
+// TokenSigner issues JWT-style signed tokens that can be verified by any
+// instance configured with the same keys. Since tokens are stateless,
+// revocations are recorded in the store so that they are shared as well.
+type TokenSigner struct {
+	cfg   SignedTokensConfig
+	keys  map[string]signingKey
+	store store.Store
+	// mut serializes generation updates.
+	mut sync.Mutex
+}
+
+func NewTokenSigner(cfg SignedTokensConfig, store store.Store) (*TokenSigner, error) {
+	if err := cfg.IsValid(); err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, errors.New("invalid store")
+	}
+
+	keys := make(map[string]signingKey, len(cfg.Keys))
+	for id, key := range cfg.Keys {
+		// Keys have already been validated.
+		keys[id], _ = parseSigningKey(key)
+	}
+
+	t := &TokenSigner{
+		cfg:   cfg,
+		keys:  keys,
+		store: store,
+	}
+
+	if err := t.deleteExpiredRevocations(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// deleteExpiredRevocations removes the revocations of tokens that have since
+// expired. These normally expire on their own, unless their expiration got
+// lost along the way, e.g. when migrated from a bitcask store.
+func (t *TokenSigner) deleteExpiredRevocations() error {
+	now := time.Now()
+	return t.store.Scan(revokedTokenKeyPrefix, func(key, value string) error {
+		expiresAt, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || now.Before(time.Unix(expiresAt, 0)) {
+			return nil
+		}
+		if err := t.store.Delete(key); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("failed to delete expired revocation: %w", err)
+		}
+		return nil
+	})
+}
+
+func (t *TokenSigner) Issue(clientID string, scopes []Scope) (string, error) {
+	if len(clientID) == 0 {
+		return "", errors.New("can not issue: invalid client id")
+	}
+
+	jti, err := newRandomToken()
+	if err != nil {
+		return "", fmt.Errorf("can not issue: %w", err)
+	}
+
+	key := t.keys[t.cfg.SigningKeyID]
+	header, err := json.Marshal(tokenHeader{
+		Alg: key.alg,
+		Typ: "JWT",
+		Kid: t.cfg.SigningKeyID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("can not issue: %w", err)
+	}
+
+	generation, err := t.getGeneration(clientID)
+	if err != nil {
+		return "", fmt.Errorf("can not issue: %w", err)
+	}
+
+	now := time.Now()
+	claims, err := json.Marshal(tokenClaims{
+		Subject:    clientID,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(time.Duration(t.cfg.ExpirationMinutes) * time.Minute).Unix(),
+		ID:         jti,
+		Scope:      FormatScopes(scopes),
+		Generation: generation,
+	})
+	if err != nil {
+		return "", fmt.Errorf("can not issue: %w", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(key.sign([]byte(payload))), nil
+}
+
+// parse verifies the signature of the given token and returns its claims.
+func (t *TokenSigner) parse(token string) (tokenClaims, error) {
+	var claims tokenClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("token is invalid")
+	}
+
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errors.New("token is invalid")
+	}
+	var header tokenHeader
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return claims, errors.New("token is invalid")
+	}
+
+	// The algorithm is bound to the key so that it cannot be chosen by
+	// whoever crafted the token.
+	key, ok := t.keys[header.Kid]
+	if !ok || header.Alg != key.alg {
+		return claims, errors.New("token is invalid")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("token is invalid")
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return claims, errors.New("token is invalid")
+	}
+
+	claimsData, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("token is invalid")
+	}
+	if err := json.Unmarshal(claimsData, &claims); err != nil {
+		return claims, errors.New("token is invalid")
+	}
+
+	if claims.Subject == "" || claims.ID == "" {
+		return claims, errors.New("token is invalid")
+	}
+
+	return claims, nil
+}
+
+func (t *TokenSigner) Get(token string) (CachedSession, error) {
+	claims, err := t.parse(token)
+	if err != nil {
+		return CachedSession{}, err
+	}
+
+	expirationDate := time.Unix(claims.ExpiresAt, 0)
+	if time.Now().After(expirationDate) {
+		return CachedSession{}, errors.New("session is expired")
+	}
+
+	if _, err := t.store.Get(revokedTokenKeyPrefix + claims.ID); err == nil {
+		return CachedSession{}, errors.New("token is invalid")
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return CachedSession{}, fmt.Errorf("failed to check revocation: %w", err)
+	}
+
+	generation, err := t.getGeneration(claims.Subject)
+	if err != nil {
+		return CachedSession{}, fmt.Errorf("failed to check revocation: %w", err)
+	}
+	if claims.Generation != generation {
+		return CachedSession{}, errors.New("token is invalid")
+	}
+
+	scopes, err := ParseScopes(claims.Scope)
+	if err != nil {
+		return CachedSession{}, errors.New("token is invalid")
+	}
+
+	return CachedSession{
+		ClientID:       claims.Subject,
+		ExpirationDate: expirationDate,
+		Scopes:         scopes,
+	}, nil
+}
+
+// Revoke adds the given token to the revocation list.
+func (t *TokenSigner) Revoke(token string) error {
+	session, err := t.Get(token)
+	if err != nil {
+		return err
+	}
+
+	// Get already validated the token.
+	claims, _ := t.parse(token)
+
+	// Entries are only needed until the token expires on its own.
+	ttl := time.Until(session.ExpirationDate)
+	if ttl <= 0 {
+		return nil
+	}
+
+	if err := t.store.SetWithTTL(revokedTokenKeyPrefix+claims.ID, strconv.FormatInt(session.ExpirationDate.Unix(), 10), ttl); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	return nil
+}
+
+// Delete invalidates all the tokens issued to the given client so far.
+func (t *TokenSigner) Delete(clientID string) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	generation, err := t.getGeneration(clientID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	if err := t.store.Set(tokenGenerationKey(clientID), strconv.FormatInt(generation+1, 10)); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	return nil
+}
+
+// tokenGenerationKey returns the key under which the token generation of the
+// given client is stored. The client ID is hashed so that the key fits within
+// the store's key size limit whatever the length of the ID.
+func tokenGenerationKey(clientID string) string {
+	return tokenGenerationKeyPrefix + hashToken(clientID)
+}
+
+func (t *TokenSigner) getGeneration(clientID string) (int64, error) {
+	data, err := t.store.Get(tokenGenerationKey(clientID))
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(data, 10, 64)
+}
+
+func (t *TokenSigner) Close() {}
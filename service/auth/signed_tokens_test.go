@@ -0,0 +1,358 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/calls-offloader/service/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+// ttlStore records the TTL of the last entry set through SetWithTTL.
+type ttlStore struct {
+	store.Store
+	ttl time.Duration
+}
+
+func (s *ttlStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	s.ttl = ttl
+	return s.Store.SetWithTTL(key, value, ttl)
+}
+
+func newTestHMACKey(t *testing.T) SigningKey {
+	t.Helper()
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	return SigningKey{
+		Algorithm: SigningAlgorithmHS256,
+		Secret:    base64.StdEncoding.EncodeToString(secret),
+	}
+}
+
+func newTestEd25519Key(t *testing.T) (SigningKey, SigningKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return SigningKey{
+		Algorithm:  SigningAlgorithmEdDSA,
+		PrivateKey: base64.StdEncoding.EncodeToString(priv.Seed()),
+	}, SigningKey{
+		Algorithm: SigningAlgorithmEdDSA,
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+	}
+}
+
+func TestSignedTokensConfigIsValid(t *testing.T) {
+	hmacKey := newTestHMACKey(t)
+	privKey, pubKey := newTestEd25519Key(t)
+
+	tcs := []struct {
+		name string
+		cfg  SignedTokensConfig
+		err  string
+	}{
+		{
+			name: "invalid expiration",
+			cfg:  SignedTokensConfig{},
+			err:  "invalid ExpirationMinutes value: should be a positive number",
+		},
+		{
+			name: "missing signing key id",
+			cfg:  SignedTokensConfig{ExpirationMinutes: 10},
+			err:  "invalid SigningKeyID value: should not be empty",
+		},
+		{
+			name: "signing key not found",
+			cfg:  SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1"},
+			err:  `invalid SigningKeyID value: key "key1" not found`,
+		},
+		{
+			name: "unsupported algorithm",
+			cfg: SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+				"key1": {Algorithm: "none"},
+			}},
+			err: `invalid key "key1": unsupported algorithm "none"`,
+		},
+		{
+			name: "short secret",
+			cfg: SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+				"key1": {Algorithm: SigningAlgorithmHS256, Secret: base64.StdEncoding.EncodeToString([]byte("secret"))},
+			}},
+			err: `invalid key "key1": secret should be at least 32 bytes`,
+		},
+		{
+			name: "verification only signing key",
+			cfg: SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+				"key1": pubKey,
+			}},
+			err: `invalid key "key1": signing key cannot be verification only`,
+		},
+		{
+			name: "valid",
+			cfg: SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+				"key1": hmacKey,
+				"key2": privKey,
+				"key3": pubKey,
+			}},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.IsValid()
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTokenSigner(t *testing.T) {
+	dbStore, teardown := newTestDBStore(t)
+	defer teardown()
+
+	hmacKey := newTestHMACKey(t)
+	privKey, pubKey := newTestEd25519Key(t)
+
+	t.Run("invalid store", func(t *testing.T) {
+		ts, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, nil)
+		require.EqualError(t, err, "invalid store")
+		require.Nil(t, ts)
+	})
+
+	for _, key := range []SigningKey{hmacKey, privKey} {
+		t.Run(key.Algorithm, func(t *testing.T) {
+			ts, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+				"key1": key,
+			}}, dbStore)
+			require.NoError(t, err)
+
+			token, err := ts.Issue("clientA", nil)
+			require.NoError(t, err)
+
+			session, err := ts.Get(token)
+			require.NoError(t, err)
+			require.Equal(t, "clientA", session.ClientID)
+			require.WithinDuration(t, time.Now().Add(10*time.Minute), session.ExpirationDate, 2*time.Second)
+
+			// Tampering with the claims invalidates the signature.
+			parts := strings.Split(token, ".")
+			claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+			require.NoError(t, err)
+			parts[1] = base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(claims), "clientA", "clientB", 1)))
+			_, err = ts.Get(strings.Join(parts, "."))
+			require.EqualError(t, err, "token is invalid")
+		})
+	}
+
+	t.Run("shared across instances", func(t *testing.T) {
+		tsA, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": privKey,
+		}}, dbStore)
+		require.NoError(t, err)
+
+		// A second instance holding only the public key.
+		tsB, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key2", Keys: SigningKeys{
+			"key1": pubKey,
+			"key2": hmacKey,
+		}}, dbStore)
+		require.NoError(t, err)
+
+		token, err := tsA.Issue("clientA", nil)
+		require.NoError(t, err)
+
+		session, err := tsB.Get(token)
+		require.NoError(t, err)
+		require.Equal(t, "clientA", session.ClientID)
+
+		// Revocation on one instance applies to the other.
+		err = tsB.Revoke(token)
+		require.NoError(t, err)
+		_, err = tsA.Get(token)
+		require.EqualError(t, err, "token is invalid")
+		err = tsA.Revoke(token)
+		require.EqualError(t, err, "token is invalid")
+	})
+
+	t.Run("revocations expire with the token", func(t *testing.T) {
+		st := &ttlStore{Store: dbStore}
+		ts, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, st)
+		require.NoError(t, err)
+
+		token, err := ts.Issue("clientA", nil)
+		require.NoError(t, err)
+		require.NoError(t, ts.Revoke(token))
+		require.InDelta(t, 10*time.Minute, st.ttl, float64(2*time.Second))
+	})
+
+	t.Run("expired revocations are deleted", func(t *testing.T) {
+		// Saved without an expiration, as done when migrating from bitcask.
+		require.NoError(t, dbStore.Set(revokedTokenKeyPrefix+"expired", strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)))
+		require.NoError(t, dbStore.Set(revokedTokenKeyPrefix+"valid", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)))
+
+		_, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, dbStore)
+		require.NoError(t, err)
+
+		_, err = dbStore.Get(revokedTokenKeyPrefix + "expired")
+		require.ErrorIs(t, err, store.ErrNotFound)
+		_, err = dbStore.Get(revokedTokenKeyPrefix + "valid")
+		require.NoError(t, err)
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		newKey := newTestHMACKey(t)
+
+		tsOld, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, dbStore)
+		require.NoError(t, err)
+		oldToken, err := tsOld.Issue("clientA", nil)
+		require.NoError(t, err)
+
+		tsNew, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key2", Keys: SigningKeys{
+			"key1": hmacKey,
+			"key2": newKey,
+		}}, dbStore)
+		require.NoError(t, err)
+		newToken, err := tsNew.Issue("clientA", nil)
+		require.NoError(t, err)
+
+		_, err = tsNew.Get(oldToken)
+		require.NoError(t, err)
+		_, err = tsNew.Get(newToken)
+		require.NoError(t, err)
+
+		// Once the old key is removed its tokens are no longer accepted.
+		tsNew, err = NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key2", Keys: SigningKeys{
+			"key2": newKey,
+		}}, dbStore)
+		require.NoError(t, err)
+		_, err = tsNew.Get(oldToken)
+		require.EqualError(t, err, "token is invalid")
+		_, err = tsNew.Get(newToken)
+		require.NoError(t, err)
+	})
+
+	t.Run("algorithm mismatch", func(t *testing.T) {
+		ts, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, dbStore)
+		require.NoError(t, err)
+
+		token, err := ts.Issue("clientA", nil)
+		require.NoError(t, err)
+
+		parts := strings.Split(token, ".")
+		parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","typ":"JWT","kid":"key1"}`))
+		_, err = ts.Get(strings.Join(parts, "."))
+		require.EqualError(t, err, "token is invalid")
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ts, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, dbStore)
+		require.NoError(t, err)
+
+		ts.cfg.ExpirationMinutes = -1
+		token, err := ts.Issue("clientA", nil)
+		require.NoError(t, err)
+
+		_, err = ts.Get(token)
+		require.EqualError(t, err, "session is expired")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ts, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, dbStore)
+		require.NoError(t, err)
+
+		tokenA, err := ts.Issue("clientA", nil)
+		require.NoError(t, err)
+		tokenB, err := ts.Issue("clientB", nil)
+		require.NoError(t, err)
+
+		err = ts.Delete("clientA")
+		require.NoError(t, err)
+
+		_, err = ts.Get(tokenA)
+		require.EqualError(t, err, "token is invalid")
+		_, err = ts.Get(tokenB)
+		require.NoError(t, err)
+	})
+
+	t.Run("long client id", func(t *testing.T) {
+		ts, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, dbStore)
+		require.NoError(t, err)
+
+		// The longest client ID the store can hold as a key, which is too long
+		// to be used as is once prefixed.
+		clientID := strings.Repeat("a", 64)
+		require.NoError(t, dbStore.Set(clientID, "{}"))
+		defer func() {
+			require.NoError(t, dbStore.Delete(clientID))
+		}()
+
+		tokenA, err := ts.Issue(clientID, nil)
+		require.NoError(t, err)
+		tokenB, err := ts.Issue(clientID, nil)
+		require.NoError(t, err)
+
+		err = ts.Revoke(tokenA)
+		require.NoError(t, err)
+		_, err = ts.Get(tokenA)
+		require.EqualError(t, err, "token is invalid")
+
+		err = ts.Delete(clientID)
+		require.NoError(t, err)
+		_, err = ts.Get(tokenB)
+		require.EqualError(t, err, "token is invalid")
+	})
+
+	t.Run("scopes", func(t *testing.T) {
+		ts, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, dbStore)
+		require.NoError(t, err)
+
+		token, err := ts.Issue("clientA", []Scope{ScopeJobsRead, ScopeJobsLogs})
+		require.NoError(t, err)
+
+		session, err := ts.Get(token)
+		require.NoError(t, err)
+		require.Equal(t, []Scope{ScopeJobsRead, ScopeJobsLogs}, session.Scopes)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		ts, err := NewTokenSigner(SignedTokensConfig{ExpirationMinutes: 10, SigningKeyID: "key1", Keys: SigningKeys{
+			"key1": hmacKey,
+		}}, dbStore)
+		require.NoError(t, err)
+
+		for _, token := range []string{"", "foo", "a.b.c", "a.b.c.d"} {
+			_, err = ts.Get(token)
+			require.EqualError(t, err, "token is invalid")
+		}
+	})
+}
@@ -5,11 +5,22 @@ package service
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 
+	"github.com/mattermost/calls-offloader/service/auth"
+	"github.com/mattermost/calls-offloader/service/store"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -239,6 +250,160 @@ func TestLoginClient(t *testing.T) {
 	})
 }
 
+func TestLogoutClient(t *testing.T) {
+	th := SetupTestHelper(t, nil)
+	defer th.Teardown()
+
+	clientID := "clientA"
+	authKey := "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L"
+	err := th.srvc.auth.Register(clientID, authKey)
+	require.NoError(t, err)
+
+	t.Run("invalid method", func(t *testing.T) {
+		resp, err := http.Get(th.apiURL + "/logout")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("basic auth", func(t *testing.T) {
+		req, err := http.NewRequest("POST", th.apiURL+"/logout", nil)
+		require.NoError(t, err)
+		req.SetBasicAuth(clientID, authKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		defer resp.Body.Close()
+	})
+
+	t.Run("valid response", func(t *testing.T) {
+		tokenA, err := th.srvc.auth.Login(clientID, authKey)
+		require.NoError(t, err)
+		tokenB, err := th.srvc.auth.Login(clientID, authKey)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest("POST", th.apiURL+"/logout", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+tokenA)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		defer resp.Body.Close()
+
+		// Token has been revoked.
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		defer resp.Body.Close()
+
+		// Other sessions are still valid.
+		session, err := th.srvc.auth.GetSession(tokenB)
+		require.NoError(t, err)
+		require.Equal(t, clientID, session.ClientID)
+	})
+}
+
+func TestScopes(t *testing.T) {
+	th := SetupTestHelper(t, nil)
+	defer th.Teardown()
+
+	t.Run("invalid scope", func(t *testing.T) {
+		buf := bytes.NewBuffer([]byte(`{"clientID": "clientA", "authKey": "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L", "scopes": "jobs:read jobs:unknown"}`))
+		req, err := http.NewRequest("POST", th.apiURL+"/register", buf)
+		require.NoError(t, err)
+		req.SetBasicAuth("", th.srvc.cfg.API.Security.AdminSecretKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		defer resp.Body.Close()
+	})
+
+	readOnlyKey := "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L"
+	err := th.adminClient.RegisterWithScopes("readOnly", readOnlyKey, []string{"jobs:read"})
+	require.NoError(t, err)
+
+	t.Run("missing scope", func(t *testing.T) {
+		req, err := http.NewRequest("POST", th.apiURL+"/jobs", bytes.NewBuffer([]byte(`{}`)))
+		require.NoError(t, err)
+		req.SetBasicAuth("readOnly", readOnlyKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		defer resp.Body.Close()
+	})
+
+	t.Run("bearer token carries scopes", func(t *testing.T) {
+		token, err := th.srvc.auth.Login("readOnly", readOnlyKey)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest("POST", th.apiURL+"/jobs/init", bytes.NewBuffer([]byte(`{}`)))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		defer resp.Body.Close()
+
+		req, err = http.NewRequest("GET", th.apiURL+"/jobs/init", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		defer resp.Body.Close()
+	})
+
+	t.Run("clients without explicit scopes", func(t *testing.T) {
+		defaultKey := "Ey4-H_BJA00_TVByPi8DozFN2kdnV3xQ"
+		err := th.adminClient.Register("defaultScopes", defaultKey)
+		require.NoError(t, err)
+
+		register := func(clientID, authKey, body string) int {
+			req, err := http.NewRequest("POST", th.apiURL+"/register", bytes.NewBuffer([]byte(body)))
+			require.NoError(t, err)
+			req.SetBasicAuth(clientID, authKey)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		// They can still register clients with the default scopes.
+		require.Equal(t, http.StatusCreated, register("defaultScopes", defaultKey,
+			`{"clientID": "clientB", "authKey": "Ey4-H_BJA00_TVByPi8DozOa1xVkPq2w"}`))
+		require.Equal(t, http.StatusForbidden, register("defaultScopes", defaultKey,
+			`{"clientID": "clientC", "authKey": "Ey4-H_BJA00_TVByPi8DozOa1xVkPq2w", "scopes": "jobs:read"}`))
+
+		// Clients with explicit scopes need clients:admin.
+		require.Equal(t, http.StatusForbidden, register("readOnly", readOnlyKey,
+			`{"clientID": "clientC", "authKey": "Ey4-H_BJA00_TVByPi8DozOa1xVkPq2w"}`))
+	})
+
+	t.Run("clients admin", func(t *testing.T) {
+		adminKey := "Ey4-H_BJA00_TVByPi8DozJIF8IewuPf"
+		err := th.adminClient.RegisterWithScopes("clientsAdmin", adminKey, []string{"clients:admin"})
+		require.NoError(t, err)
+
+		// Unregistering another client requires clients:admin.
+		buf := bytes.NewBuffer([]byte(`{"clientID": "clientsAdmin"}`))
+		req, err := http.NewRequest("POST", th.apiURL+"/unregister", buf)
+		require.NoError(t, err)
+		req.SetBasicAuth("readOnly", readOnlyKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		defer resp.Body.Close()
+
+		buf = bytes.NewBuffer([]byte(`{"clientID": "readOnly"}`))
+		req, err = http.NewRequest("POST", th.apiURL+"/unregister", buf)
+		require.NoError(t, err)
+		req.SetBasicAuth("clientsAdmin", adminKey)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		defer resp.Body.Close()
+	})
+}
+
 func registerClient(t *testing.T, th *TestHelper, clientID string, authKey string) {
 	bufStr := fmt.Sprintf(`{"clientID": "%s", "authKey": "%s"}`, clientID, authKey)
 	buf := bytes.NewBuffer([]byte(bufStr))
@@ -255,3 +420,251 @@ func registerClient(t *testing.T, th *TestHelper, clientID string, authKey strin
 	require.NoError(t, err)
 	require.NotEmpty(t, response["clientID"])
 }
+
+func TestAuthLockout(t *testing.T) {
+	cfg := MakeDefaultCfg(t)
+	cfg.API.Security.Lockout = auth.LockoutConfig{
+		Enable:             true,
+		MaxFailures:        3,
+		DurationSeconds:    60,
+		MaxDurationSeconds: 600,
+	}
+	th := SetupTestHelper(t, cfg)
+	defer th.Teardown()
+
+	err := th.adminClient.Register("clientA", "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L")
+	require.NoError(t, err)
+
+	doRequest := func(clientID, authKey string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", th.apiURL+"/jobs/init", nil)
+		require.NoError(t, err)
+		req.SetBasicAuth(clientID, authKey)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := doRequest("clientA", "wrong-key-wrong-key-wrong-key-00")
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// Even the right key is rejected while locked out.
+	resp := doRequest("clientA", "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	require.Greater(t, retryAfter, 0)
+	require.LessOrEqual(t, retryAfter, 60)
+
+	// The remote address is locked out as well.
+	resp = doRequest("", th.srvc.cfg.API.Security.AdminSecretKey)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	count := testutil.ToFloat64(th.srvc.metrics.authLockouts.WithLabelValues(lockoutTypeClient))
+	require.Equal(t, float64(1), count)
+	count = testutil.ToFloat64(th.srvc.metrics.authLockouts.WithLabelValues(lockoutTypeAddress))
+	require.Equal(t, float64(1), count)
+}
+
+func TestAuthLockoutKeys(t *testing.T) {
+	st, err := store.New(t.TempDir())
+	require.NoError(t, err)
+	defer st.Close()
+
+	sessions, err := auth.NewSessionCache(auth.SessionCacheConfig{ExpirationMinutes: 1440}, nil)
+	require.NoError(t, err)
+	authService, err := auth.NewService(st, sessions)
+	require.NoError(t, err)
+	lockouts, err := auth.NewLockoutTracker(auth.LockoutConfig{
+		Enable:             true,
+		MaxFailures:        3,
+		DurationSeconds:    60,
+		MaxDurationSeconds: 600,
+	})
+	require.NoError(t, err)
+
+	s := &Service{
+		auth:     authService,
+		lockouts: lockouts,
+		metrics:  newMetrics(),
+		log:      mlog.CreateConsoleTestLogger(t),
+	}
+	s.cfg.API.Security.EnableAdmin = true
+	s.cfg.API.Security.AdminSecretKey = "admin_secret_key"
+
+	clientKey := "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L"
+	err = authService.Register("clientA", clientKey)
+	require.NoError(t, err)
+
+	basicAuth := func(addr, clientID, authKey string) int {
+		req := httptest.NewRequest("GET", "/jobs/init", nil)
+		req.RemoteAddr = addr
+		req.SetBasicAuth(clientID, authKey)
+		_, _, code, _ := s.basicAuthHandler(httptest.NewRecorder(), req)
+		return code
+	}
+
+	t.Run("admin key is only locked out per address", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			require.Equal(t, http.StatusUnauthorized, basicAuth("10.0.0.1:1234", "", "wrong_key"))
+		}
+		require.Equal(t, http.StatusTooManyRequests, basicAuth("10.0.0.1:1234", "", "admin_secret_key"))
+		require.Equal(t, http.StatusOK, basicAuth("10.0.0.2:1234", "", "admin_secret_key"))
+	})
+
+	t.Run("bearer token failures are not counted", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest("GET", "/jobs/init", nil)
+			req.RemoteAddr = "10.0.0.3:1234"
+			req.Header.Set("Authorization", "Bearer invalid")
+			_, _, code, _ := s.bearerAuthHandler(httptest.NewRecorder(), req)
+			require.Equal(t, http.StatusUnauthorized, code)
+		}
+		require.Equal(t, http.StatusOK, basicAuth("10.0.0.3:1234", "clientA", clientKey))
+	})
+
+	t.Run("success resets the address", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			require.Equal(t, http.StatusUnauthorized, basicAuth("10.0.0.4:1234", "clientB", "wrong_key"))
+		}
+		require.Equal(t, http.StatusOK, basicAuth("10.0.0.4:1234", "clientA", clientKey))
+		for i := 0; i < 2; i++ {
+			require.Equal(t, http.StatusUnauthorized, basicAuth("10.0.0.4:1234", "clientC", "wrong_key"))
+		}
+		require.Equal(t, http.StatusOK, basicAuth("10.0.0.4:1234", "clientA", clientKey))
+	})
+}
+
+func TestCertAuthHandler(t *testing.T) {
+	dbDir := t.TempDir()
+	st, err := store.New(dbDir)
+	require.NoError(t, err)
+	defer st.Close()
+
+	sessions, err := auth.NewSessionCache(auth.SessionCacheConfig{ExpirationMinutes: 1440}, nil)
+	require.NoError(t, err)
+	authService, err := auth.NewService(st, sessions)
+	require.NoError(t, err)
+
+	s := &Service{
+		auth: authService,
+		log:  mlog.CreateConsoleTestLogger(t),
+	}
+	s.cfg.API.Security.CertClientIDs = auth.CertIdentities{
+		"cn:mattermost":   "clientA",
+		"dns:mm.internal": "clientB",
+	}
+
+	newRequest := func(cert *x509.Certificate) *http.Request {
+		req := httptest.NewRequest("GET", "/jobs/init", nil)
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}
+		return req
+	}
+
+	t.Run("unknown certificate", func(t *testing.T) {
+		clientID, _, code, err := s.certAuthHandler(newRequest(&x509.Certificate{
+			Subject: pkix.Name{CommonName: "other"},
+		}))
+		require.EqualError(t, err, "authentication failed: unknown client certificate")
+		require.Equal(t, http.StatusUnauthorized, code)
+		require.Empty(t, clientID)
+	})
+
+	t.Run("unregistered client", func(t *testing.T) {
+		clientID, scopes, code, err := s.certAuthHandler(newRequest(&x509.Certificate{
+			Subject: pkix.Name{CommonName: "mattermost"},
+		}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "clientA", clientID)
+		require.Equal(t, auth.DefaultScopes, scopes)
+	})
+
+	t.Run("registered client", func(t *testing.T) {
+		err := authService.RegisterWithScopes("clientB", "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L", []auth.Scope{auth.ScopeJobsRead})
+		require.NoError(t, err)
+
+		clientID, scopes, code, err := s.certAuthHandler(newRequest(&x509.Certificate{
+			Subject:  pkix.Name{CommonName: "node1"},
+			DNSNames: []string{"mm.internal"},
+		}))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "clientB", clientID)
+		require.Equal(t, []auth.Scope{auth.ScopeJobsRead}, scopes)
+	})
+}
+
+func TestAdminOnly(t *testing.T) {
+	st, err := store.New(t.TempDir())
+	require.NoError(t, err)
+	defer st.Close()
+
+	sessions, err := auth.NewSessionCache(auth.SessionCacheConfig{ExpirationMinutes: 1440}, nil)
+	require.NoError(t, err)
+	authService, err := auth.NewService(st, sessions)
+	require.NoError(t, err)
+	lockouts, err := auth.NewLockoutTracker(auth.LockoutConfig{})
+	require.NoError(t, err)
+
+	s := &Service{
+		auth:     authService,
+		lockouts: lockouts,
+		metrics:  newMetrics(),
+		log:      mlog.CreateConsoleTestLogger(t),
+	}
+	s.cfg.API.Security.EnableAdmin = true
+	s.cfg.API.Security.AdminSecretKey = "admin_secret_key"
+
+	err = authService.Register("clientA", "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L")
+	require.NoError(t, err)
+
+	h := s.adminOnly(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tcs := []struct {
+		name     string
+		clientID string
+		authKey  string
+		code     int
+	}{
+		{
+			name: "no auth",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name:    "invalid admin key",
+			authKey: "invalid",
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:     "client",
+			clientID: "clientA",
+			authKey:  "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L",
+			code:     http.StatusForbidden,
+		},
+		{
+			name:    "admin",
+			authKey: "admin_secret_key",
+			code:    http.StatusTeapot,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/debug/pprof/heap", nil)
+			if tc.authKey != "" {
+				req.SetBasicAuth(tc.clientID, tc.authKey)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			require.Equal(t, tc.code, w.Code)
+		})
+	}
+}
@@ -5,7 +5,11 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/mattermost/calls-offloader/public"
@@ -56,6 +60,39 @@ func TestNewClient(t *testing.T) {
 		require.Equal(t, apiURL, c.URL())
 	})
 
+	t.Run("invalid unix socket url", func(t *testing.T) {
+		c, err := public.NewClient(public.ClientConfig{URL: "unix://"})
+		require.Error(t, err)
+		require.Equal(t, "failed to parse config: invalid url path: should not be empty", err.Error())
+		require.Nil(t, c)
+	})
+
+	t.Run("unix socket", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "offloader.sock")
+		listener, err := net.Listen("unix", socketPath)
+		require.NoError(t, err)
+
+		var called bool
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = r.URL.Path == "/register"
+			w.WriteHeader(http.StatusCreated)
+		})}
+		go func() {
+			_ = srv.Serve(listener)
+		}()
+		defer srv.Close()
+
+		apiURL := "unix://" + socketPath
+		c, err := public.NewClient(public.ClientConfig{URL: apiURL})
+		require.NoError(t, err)
+		require.NotNil(t, c)
+		require.Equal(t, apiURL, c.URL())
+
+		err = c.Register("clientA", "Ey4-H_BJA00_TVByPi8DozE12ekN3S7L")
+		require.NoError(t, err)
+		require.True(t, called)
+	})
+
 	t.Run("custom dialing function", func(t *testing.T) {
 		var called bool
 		dialFn := func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -299,3 +336,147 @@ func TestClientAutoRegister(t *testing.T) {
 		require.NoError(t, err)
 	})
 }
+
+func TestClientRotateKey(t *testing.T) {
+	th := SetupTestHelper(t, nil)
+	defer th.Teardown()
+
+	authKey, err := random.NewSecureString(auth.MinKeyLen)
+	require.NoError(t, err)
+	err = th.adminClient.Register("clientA", authKey)
+	require.NoError(t, err)
+	err = th.adminClient.Register("clientB", authKey)
+	require.NoError(t, err)
+
+	c, err := public.NewClient(public.ClientConfig{
+		URL:      th.apiURL,
+		ClientID: "clientA",
+		AuthKey:  authKey,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	defer c.Close()
+
+	newKey, err := random.NewSecureString(auth.MinKeyLen)
+	require.NoError(t, err)
+
+	t.Run("other client", func(t *testing.T) {
+		err := c.RotateKey("clientB", newKey)
+		require.Error(t, err)
+		require.Equal(t, "request failed: client id not valid", err.Error())
+	})
+
+	t.Run("success", func(t *testing.T) {
+		err := c.RotateKey("clientA", newKey)
+		require.NoError(t, err)
+
+		// Both keys are valid during the overlap window.
+		err = th.srvc.auth.Authenticate("clientA", authKey)
+		require.NoError(t, err)
+		err = th.srvc.auth.Authenticate("clientA", newKey)
+		require.NoError(t, err)
+	})
+
+	t.Run("previous key", func(t *testing.T) {
+		// The previous key keeps working for regular requests.
+		err := c.Login("clientA", authKey)
+		require.NoError(t, err)
+
+		rotatedKey, err := random.NewSecureString(auth.MinKeyLen)
+		require.NoError(t, err)
+		err = c.RotateKey("clientA", rotatedKey)
+		require.EqualError(t, err, "request failed: forbidden: current key required")
+		err = c.DeleteSessions("clientA")
+		require.EqualError(t, err, "request failed: forbidden: current key required")
+		err = c.Unregister("clientA")
+		require.EqualError(t, err, "request failed: forbidden: current key required")
+
+		err = th.srvc.auth.Authenticate("clientA", newKey)
+		require.NoError(t, err)
+	})
+
+	t.Run("bearer token requires current key", func(t *testing.T) {
+		token, err := th.srvc.auth.Login("clientA", newKey)
+		require.NoError(t, err)
+		rotatedKey, err := random.NewSecureString(auth.MinKeyLen)
+		require.NoError(t, err)
+
+		rotate := func(body string) int {
+			req, err := http.NewRequest("POST", th.apiURL+"/clients/clientA/rotate", strings.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		require.Equal(t, http.StatusForbidden, rotate(fmt.Sprintf(`{"authKey": %q}`, rotatedKey)))
+		require.Equal(t, http.StatusOK, rotate(fmt.Sprintf(`{"authKey": %q, "currentAuthKey": %q}`, rotatedKey, newKey)))
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		err := th.adminClient.RotateKey("clientB", newKey)
+		require.NoError(t, err)
+	})
+}
+
+func TestClientListClients(t *testing.T) {
+	th := SetupTestHelper(t, nil)
+	defer th.Teardown()
+
+	authKey, err := random.NewSecureString(auth.MinKeyLen)
+	require.NoError(t, err)
+	err = th.adminClient.Register("clientA", authKey)
+	require.NoError(t, err)
+
+	t.Run("forbidden", func(t *testing.T) {
+		c, err := public.NewClient(public.ClientConfig{
+			URL:      th.apiURL,
+			ClientID: "clientA",
+			AuthKey:  authKey,
+		})
+		require.NoError(t, err)
+		defer c.Close()
+
+		_, err = c.ListClients()
+		require.Error(t, err)
+		require.Equal(t, "request failed: forbidden: missing clients:admin scope", err.Error())
+	})
+
+	t.Run("success", func(t *testing.T) {
+		clients, err := th.adminClient.ListClients()
+		require.NoError(t, err)
+		require.Len(t, clients, 1)
+		require.Equal(t, "clientA", clients[0].ID)
+		require.NotZero(t, clients[0].CreatedAt)
+		require.NotZero(t, clients[0].LastSeenAt)
+	})
+}
+
+func TestClientDeleteSessions(t *testing.T) {
+	th := SetupTestHelper(t, nil)
+	defer th.Teardown()
+
+	authKey, err := random.NewSecureString(auth.MinKeyLen)
+	require.NoError(t, err)
+	err = th.adminClient.Register("clientA", authKey)
+	require.NoError(t, err)
+
+	tokenA, err := th.srvc.auth.Login("clientA", authKey)
+	require.NoError(t, err)
+
+	t.Run("not found", func(t *testing.T) {
+		err := th.adminClient.DeleteSessions("clientB")
+		require.Error(t, err)
+		require.Equal(t, "request failed: failed to delete sessions: error: not found", err.Error())
+	})
+
+	t.Run("success", func(t *testing.T) {
+		err := th.adminClient.DeleteSessions("clientA")
+		require.NoError(t, err)
+
+		_, err = th.srvc.auth.GetSession(tokenA)
+		require.Error(t, err)
+	})
+}
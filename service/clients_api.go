@@ -0,0 +1,156 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/calls-offloader/public"
+	"github.com/mattermost/calls-offloader/service/auth"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+func (s *Service) handleListClients(w http.ResponseWriter, r *http.Request) {
+	data := newHTTPData()
+	defer s.httpAudit("handleListClients", data, w, r)
+
+	clientID, code, err := s.authorize(w, r, auth.ScopeClientsAdmin)
+	if err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+	data.clientID = clientID
+
+	clients, err := s.auth.ListClients()
+	if err != nil {
+		data.err = err.Error()
+		data.code = http.StatusInternalServerError
+		return
+	}
+
+	infos := make([]public.ClientInfo, 0, len(clients))
+	for _, c := range clients {
+		scopes := make([]string, len(c.Scopes))
+		for i, scope := range c.Scopes {
+			scopes[i] = string(scope)
+		}
+		infos = append(infos, public.ClientInfo{
+			ID:         c.ID,
+			Scopes:     scopes,
+			CreatedAt:  c.CreatedAt,
+			LastSeenAt: c.LastSeenAt,
+		})
+	}
+
+	data.code = http.StatusOK
+
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		s.log.Error("failed to encode response", mlog.Err(err))
+	}
+}
+
+func (s *Service) handleRotateClientKey(w http.ResponseWriter, r *http.Request) {
+	data := newHTTPData()
+	defer s.httpAudit("handleRotateClientKey", data, w, r)
+
+	authedClientID, scopes, code, err := s.authHandler(w, r)
+	if err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+	data.clientID = authedClientID
+
+	if code, err := s.requireCurrentKey(r, authedClientID); err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+
+	clientID := mux.Vars(r)["id"]
+
+	// Rotating any other client's key requires the clients:admin scope.
+	isAdmin := auth.HasScope(scopes, auth.ScopeClientsAdmin)
+	if authedClientID != clientID && !isAdmin {
+		data.err = "client id not valid"
+		data.code = http.StatusForbidden
+		return
+	}
+
+	var reqData map[string]string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiRequestBodyMaxSizeBytes)).Decode(&reqData); err != nil {
+		data.err = "failed to decode request body: " + err.Error()
+		data.code = http.StatusBadRequest
+		return
+	}
+
+	// Clients rotating their own key need to prove they hold the current one,
+	// so that a leaked bearer token can't be turned into a permanent key.
+	// Basic auth already did through requireCurrentKey.
+	if _, _, isBasicAuth := r.BasicAuth(); !isAdmin && !isBasicAuth {
+		if code, err := s.checkLockout(w, clientLockoutKey(clientID)); err != nil {
+			data.err = err.Error()
+			data.code = code
+			return
+		}
+		if err := s.auth.AuthenticateCurrentKey(clientID, reqData["currentAuthKey"]); err != nil {
+			s.authFailed(r, clientID)
+			data.err = "current key is not valid"
+			data.code = http.StatusForbidden
+			return
+		}
+	}
+
+	overlap := time.Duration(s.cfg.API.Security.KeyRotationOverlapMinutes) * time.Minute
+	if err := s.auth.RotateKey(clientID, reqData["authKey"], overlap); err != nil {
+		data.err = err.Error()
+		data.code = http.StatusBadRequest
+		return
+	}
+
+	s.log.Debug("rotated client key", mlog.String("clientID", clientID), mlog.Any("overlap", overlap))
+	data.code = http.StatusOK
+}
+
+func (s *Service) handleDeleteClientSessions(w http.ResponseWriter, r *http.Request) {
+	data := newHTTPData()
+	defer s.httpAudit("handleDeleteClientSessions", data, w, r)
+
+	authedClientID, scopes, code, err := s.authHandler(w, r)
+	if err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+	data.clientID = authedClientID
+
+	if code, err := s.requireCurrentKey(r, authedClientID); err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+
+	clientID := mux.Vars(r)["id"]
+
+	if authedClientID != clientID && !auth.HasScope(scopes, auth.ScopeClientsAdmin) {
+		data.err = "client id not valid"
+		data.code = http.StatusForbidden
+		return
+	}
+
+	if err := s.auth.DeleteSessions(clientID); err != nil {
+		data.err = err.Error()
+		data.code = http.StatusBadRequest
+		return
+	}
+
+	s.log.Debug("deleted client sessions", mlog.String("clientID", clientID))
+	data.code = http.StatusOK
+}
@@ -15,7 +15,9 @@ import (
 	"github.com/mattermost/calls-offloader/service/api"
 	"github.com/mattermost/calls-offloader/service/auth"
 	"github.com/mattermost/calls-offloader/service/docker"
+	"github.com/mattermost/calls-offloader/service/encryption"
 	"github.com/mattermost/calls-offloader/service/kubernetes"
+	"github.com/mattermost/calls-offloader/service/store"
 
 	"github.com/kelseyhightower/envconfig"
 )
@@ -30,17 +32,67 @@ type SecurityConfig struct {
 	// The secret key used to authenticate admin requests.
 	AdminSecretKey string `toml:"admin_secret_key"`
 	// Whether or not to allow clients to self-register.
-	AllowSelfRegistration bool                    `toml:"allow_self_registration"`
-	SessionCache          auth.SessionCacheConfig `toml:"session_cache"`
+	AllowSelfRegistration bool `toml:"allow_self_registration"`
+	// The kind of bearer tokens issued upon login. Defaults to session
+	// when empty.
+	TokenMode    auth.TokenMode          `toml:"token_mode"`
+	SessionCache auth.SessionCacheConfig `toml:"session_cache"`
+	SignedTokens auth.SignedTokensConfig `toml:"signed_tokens"`
+	// The time, in minutes, during which the previous key of a client remains
+	// valid after being rotated.
+	KeyRotationOverlapMinutes int `toml:"key_rotation_overlap_minutes"`
+	// Lockout of client IDs and remote addresses after repeated
+	// authentication failures.
+	Lockout auth.LockoutConfig `toml:"lockout"`
+	// A mapping of client certificate identities to client IDs, used to
+	// authenticate clients through mTLS.
+	CertClientIDs auth.CertIdentities `toml:"cert_client_ids"`
 }
 
 func (c SecurityConfig) IsValid() error {
-	if !c.EnableAdmin {
+	if c.EnableAdmin && c.AdminSecretKey == "" {
+		return fmt.Errorf("invalid AdminSecretKey value: should not be empty")
+	}
+
+	if c.KeyRotationOverlapMinutes < 0 {
+		return fmt.Errorf("invalid KeyRotationOverlapMinutes value: should not be negative")
+	}
+
+	if err := c.Lockout.IsValid(); err != nil {
+		return fmt.Errorf("failed to validate lockout config: %w", err)
+	}
+
+	if err := c.CertClientIDs.IsValid(); err != nil {
+		return fmt.Errorf("invalid CertClientIDs value: %w", err)
+	}
+
+	switch c.TokenMode {
+	case "", auth.TokenModeSession:
+	case auth.TokenModeSigned:
+		if err := c.SignedTokens.IsValid(); err != nil {
+			return fmt.Errorf("failed to validate signed tokens config: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid TokenMode value: %q", c.TokenMode)
+	}
+
+	return nil
+}
+
+type AdminAPIConfig struct {
+	// Whether to serve the pprof, metrics and admin endpoints on a separate
+	// listener, as opposed to the main API one.
+	Enable bool       `toml:"enable"`
+	HTTP   api.Config `toml:"http"`
+}
+
+func (c AdminAPIConfig) IsValid() error {
+	if !c.Enable {
 		return nil
 	}
 
-	if c.AdminSecretKey == "" {
-		return fmt.Errorf("invalid AdminSecretKey value: should not be empty")
+	if err := c.HTTP.IsValid(); err != nil {
+		return fmt.Errorf("failed to validate http config: %w", err)
 	}
 
 	return nil
@@ -49,6 +101,9 @@ func (c SecurityConfig) IsValid() error {
 type APIConfig struct {
 	HTTP     api.Config     `toml:"http"`
 	Security SecurityConfig `toml:"security"`
+	Admin    AdminAPIConfig `toml:"admin"`
+	// Whether to expose the pprof debug endpoints. These require the admin key.
+	EnableDebug bool `toml:"enable_debug"`
 }
 
 func (c APIConfig) IsValid() error {
@@ -60,20 +115,64 @@ func (c APIConfig) IsValid() error {
 		return fmt.Errorf("failed to validate http config: %w", err)
 	}
 
+	if err := c.Admin.IsValid(); err != nil {
+		return fmt.Errorf("failed to validate admin config: %w", err)
+	}
+
+	if c.EnableDebug && !c.Security.EnableAdmin {
+		return fmt.Errorf("invalid EnableDebug value: admin should be enabled")
+	}
+
+	if len(c.Security.CertClientIDs) > 0 && (c.HTTP.TLS.ClientAuth == "" || c.HTTP.TLS.ClientAuth == api.ClientAuthNone) {
+		return fmt.Errorf("invalid CertClientIDs value: client certificates are not verified")
+	}
+
 	return nil
 }
 
 type StoreConfig struct {
-	DataSource string `toml:"data_source"`
+	// The store backend. Defaults to bitcask when empty.
+	Driver     store.Driver `toml:"driver"`
+	DataSource string       `toml:"data_source"`
+	// The interval, in minutes, at which the store is checked for compaction.
+	// Zero disables scheduled compaction.
+	CompactionIntervalMinutes int `toml:"compaction_interval_minutes"`
+	// The minimum fraction, between 0 and 1, of the store size that should be
+	// reclaimable for a scheduled compaction to run.
+	CompactionGarbageThreshold float64 `toml:"compaction_garbage_threshold"`
+	// Encryption at rest of sensitive job data.
+	Encryption encryption.Config `toml:"encryption"`
 }
 
 func (c StoreConfig) IsValid() error {
+	if c.Driver != "" {
+		if err := c.Driver.IsValid(); err != nil {
+			return fmt.Errorf("invalid Driver value: %w", err)
+		}
+	}
 	if c.DataSource == "" {
 		return fmt.Errorf("invalid DataSource value: should not be empty")
 	}
+	if c.CompactionIntervalMinutes < 0 {
+		return fmt.Errorf("invalid CompactionIntervalMinutes value: should not be negative")
+	}
+	if c.CompactionGarbageThreshold < 0 || c.CompactionGarbageThreshold > 1 {
+		return fmt.Errorf("invalid CompactionGarbageThreshold value: should be between 0 and 1")
+	}
+	if err := c.Encryption.IsValid(); err != nil {
+		return fmt.Errorf("invalid Encryption value: %w", err)
+	}
 	return nil
 }
 
+// GetDriver returns the configured store driver, defaulting to bitcask.
+func (c StoreConfig) GetDriver() store.Driver {
+	if c.Driver == "" {
+		return store.DriverBitcask
+	}
+	return c.Driver
+}
+
 type JobAPIType string
 
 const (
@@ -94,12 +193,31 @@ func (rt *RetentionTime) UnmarshalText(data []byte) error {
 }
 
 type JobsConfig struct {
-	APIType                 JobAPIType                  `toml:"api_type"`
-	MaxConcurrentJobs       int                         `toml:"max_concurrent_jobs"`
-	FailedJobsRetentionTime RetentionTime               `toml:"failed_jobs_retention_time" ignored:"true"`
-	ImageRegistry           string                      `toml:"image_registry"`
-	Kubernetes              kubernetes.JobServiceConfig `toml:"kubernetes"`
-	Docker                  docker.JobServiceConfig     `toml:"docker"`
+	APIType                 JobAPIType    `toml:"api_type"`
+	MaxConcurrentJobs       int           `toml:"max_concurrent_jobs"`
+	FailedJobsRetentionTime RetentionTime `toml:"failed_jobs_retention_time" ignored:"true"`
+	// The time to retain the records of stopped jobs in the store. Defaults
+	// to FailedJobsRetentionTime when zero.
+	JobRecordsRetentionTime RetentionTime `toml:"job_records_retention_time" ignored:"true"`
+	ImageRegistry           string        `toml:"image_registry"`
+	// A directory holding JSON Schemas to validate the input data of jobs
+	// against, per job type and runner version. Validation is skipped when
+	// empty.
+	InputDataSchemasDir string `toml:"input_data_schemas_dir"`
+	// A prefix prepended to the names of the environment variables input
+	// data is passed to jobs through.
+	InputDataEnvPrefix string                      `toml:"input_data_env_prefix"`
+	Kubernetes         kubernetes.JobServiceConfig `toml:"kubernetes"`
+	Docker             docker.JobServiceConfig     `toml:"docker"`
+}
+
+// GetJobRecordsRetentionTime returns the time to retain the records of
+// stopped jobs. A zero value means keeping them indefinitely.
+func (c JobsConfig) GetJobRecordsRetentionTime() time.Duration {
+	if c.JobRecordsRetentionTime == 0 {
+		return time.Duration(c.FailedJobsRetentionTime)
+	}
+	return time.Duration(c.JobRecordsRetentionTime)
 }
 
 // We need some custom parsing since duration doesn't support days.
@@ -145,6 +263,18 @@ func (c JobsConfig) IsValid() error {
 		return fmt.Errorf("invalid FailedJobsRetentionTime value: should be at least one minute")
 	}
 
+	if c.JobRecordsRetentionTime < 0 {
+		return fmt.Errorf("invalid JobRecordsRetentionTime value: should be a positive duration")
+	}
+
+	if c.JobRecordsRetentionTime > 0 && time.Duration(c.JobRecordsRetentionTime) < time.Minute {
+		return fmt.Errorf("invalid JobRecordsRetentionTime value: should be at least one minute")
+	}
+
+	if err := job.InputDataEnvPrefixIsValid(c.InputDataEnvPrefix); err != nil {
+		return fmt.Errorf("invalid InputDataEnvPrefix value: %w", err)
+	}
+
 	switch c.APIType {
 	case JobAPITypeDocker:
 		return c.Docker.IsValid()
@@ -171,6 +301,14 @@ func (c *Config) ParseFromEnv() error {
 		c.Jobs.FailedJobsRetentionTime = RetentionTime(d)
 	}
 
+	if val := os.Getenv("JOBS_JOBRECORDSRETENTIONTIME"); val != "" {
+		d, err := parseRetentionTime(val)
+		if err != nil {
+			return fmt.Errorf("failed to parse JobRecordsRetentionTime: %w", err)
+		}
+		c.Jobs.JobRecordsRetentionTime = RetentionTime(d)
+	}
+
 	return envconfig.Process("", c)
 }
 
@@ -193,7 +331,18 @@ func (c Config) IsValid() error {
 func (c *Config) SetDefaults() {
 	c.API.HTTP.ListenAddress = ":4545"
 	c.API.Security.SessionCache.ExpirationMinutes = 1440
+	c.API.Security.SessionCache.MaxSessionsPerClient = auth.DefaultMaxSessionsPerClient
+	c.API.Security.TokenMode = auth.TokenModeSession
+	c.API.Security.SignedTokens.ExpirationMinutes = 1440
+	c.API.Security.KeyRotationOverlapMinutes = 60
+	c.API.Security.Lockout.Enable = true
+	c.API.Security.Lockout.MaxFailures = 10
+	c.API.Security.Lockout.DurationSeconds = 30
+	c.API.Security.Lockout.MaxDurationSeconds = 3600
+	c.Store.Driver = store.DriverBitcask
 	c.Store.DataSource = "/tmp/calls-offloader-db"
+	c.Store.CompactionIntervalMinutes = 60
+	c.Store.CompactionGarbageThreshold = 0.5
 	c.Jobs.APIType = JobAPITypeDocker
 	c.Jobs.MaxConcurrentJobs = 2
 	c.Jobs.ImageRegistry = job.ImageRegistryDefault
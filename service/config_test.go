@@ -10,7 +10,10 @@ import (
 	"time"
 
 	"github.com/mattermost/calls-offloader/public/job"
+	"github.com/mattermost/calls-offloader/service/api"
+	"github.com/mattermost/calls-offloader/service/auth"
 	"github.com/mattermost/calls-offloader/service/kubernetes"
+	"github.com/mattermost/calls-offloader/service/store"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -94,6 +97,24 @@ func TestParseFromEnv(t *testing.T) {
 		require.Equal(t, RetentionTime(time.Hour*24), cfg.Jobs.FailedJobsRetentionTime)
 	})
 
+	t.Run("JobRecordsRetentionTime", func(t *testing.T) {
+		os.Setenv("JOBS_FAILEDJOBSRETENTIONTIME", "1d")
+		defer os.Unsetenv("JOBS_FAILEDJOBSRETENTIONTIME")
+
+		var cfg Config
+		err := cfg.ParseFromEnv()
+		require.NoError(t, err)
+		require.Equal(t, time.Hour*24, cfg.Jobs.GetJobRecordsRetentionTime())
+
+		os.Setenv("JOBS_JOBRECORDSRETENTIONTIME", "2h")
+		defer os.Unsetenv("JOBS_JOBRECORDSRETENTIONTIME")
+
+		err = cfg.ParseFromEnv()
+		require.NoError(t, err)
+		require.Equal(t, RetentionTime(time.Hour*2), cfg.Jobs.JobRecordsRetentionTime)
+		require.Equal(t, time.Hour*2, cfg.Jobs.GetJobRecordsRetentionTime())
+	})
+
 	t.Run("override", func(t *testing.T) {
 		var cfg Config
 		cfg.Jobs.APIType = JobAPITypeKubernetes
@@ -151,4 +172,143 @@ func TestParseFromEnv(t *testing.T) {
 			require.Equal(t, requirements, cfg.Jobs.Kubernetes.JobsResourceRequirements)
 		})
 	})
+
+	t.Run("kubernetes.JobsVolumeSizes", func(t *testing.T) {
+		os.Setenv("JOBS_KUBERNETES_JOBSVOLUMESIZES", `{"recording":"10Gi","transcribing":"1Gi"}`)
+		defer os.Unsetenv("JOBS_KUBERNETES_JOBSVOLUMESIZES")
+
+		var cfg Config
+		err := cfg.ParseFromEnv()
+		require.NoError(t, err)
+		require.Equal(t, kubernetes.JobsVolumeSizes{
+			job.TypeRecording:    resource.MustParse("10Gi"),
+			job.TypeTranscribing: resource.MustParse("1Gi"),
+		}, cfg.Jobs.Kubernetes.JobsVolumeSizes)
+	})
+
+	t.Run("kubernetes.ClientNamespaces", func(t *testing.T) {
+		os.Setenv("JOBS_KUBERNETES_CLIENTNAMESPACES", `{"clientA":"tenant-a"}`)
+		defer os.Unsetenv("JOBS_KUBERNETES_CLIENTNAMESPACES")
+		os.Setenv("JOBS_KUBERNETES_NAMESPACES", `{"tenant-a":{"max_concurrent_jobs":4,"jobs_resource_requirements":{"recording":{"limits":{"cpu":"1"}}}}}`)
+		defer os.Unsetenv("JOBS_KUBERNETES_NAMESPACES")
+
+		var cfg Config
+		err := cfg.ParseFromEnv()
+		require.NoError(t, err)
+		require.Equal(t, kubernetes.ClientNamespaces{"clientA": "tenant-a"}, cfg.Jobs.Kubernetes.ClientNamespaces)
+		require.Equal(t, kubernetes.Namespaces{
+			"tenant-a": {
+				MaxConcurrentJobs: 4,
+				JobsResourceRequirements: kubernetes.JobsResourceRequirements{
+					job.TypeRecording: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{
+							"cpu": resource.MustParse("1"),
+						},
+					},
+				},
+			},
+		}, cfg.Jobs.Kubernetes.Namespaces)
+	})
+
+	t.Run("security.SignedTokens", func(t *testing.T) {
+		os.Setenv("API_SECURITY_TOKENMODE", "signed")
+		defer os.Unsetenv("API_SECURITY_TOKENMODE")
+		os.Setenv("API_SECURITY_SIGNEDTOKENS_SIGNINGKEYID", "key1")
+		defer os.Unsetenv("API_SECURITY_SIGNEDTOKENS_SIGNINGKEYID")
+		os.Setenv("API_SECURITY_SIGNEDTOKENS_KEYS", `{"key1":{"algorithm":"HS256","secret":"c2VjcmV0X3NlY3JldF9zZWNyZXRfc2VjcmV0X3NlY3JldA=="}}`)
+		defer os.Unsetenv("API_SECURITY_SIGNEDTOKENS_KEYS")
+
+		var cfg Config
+		err := cfg.ParseFromEnv()
+		require.NoError(t, err)
+		require.Equal(t, auth.TokenModeSigned, cfg.API.Security.TokenMode)
+		require.Equal(t, "key1", cfg.API.Security.SignedTokens.SigningKeyID)
+		require.Equal(t, auth.SigningKeys{
+			"key1": {
+				Algorithm: auth.SigningAlgorithmHS256,
+				Secret:    "c2VjcmV0X3NlY3JldF9zZWNyZXRfc2VjcmV0X3NlY3JldA==",
+			},
+		}, cfg.API.Security.SignedTokens.Keys)
+	})
+}
+
+func TestAPIConfigIsValid(t *testing.T) {
+	makeCfg := func() APIConfig {
+		return APIConfig{
+			HTTP: api.Config{
+				ListenAddress: ":4545",
+			},
+			Security: SecurityConfig{
+				EnableAdmin:    true,
+				AdminSecretKey: "admin_secret_key",
+			},
+		}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		cfg := makeCfg()
+		require.NoError(t, cfg.IsValid())
+	})
+
+	t.Run("invalid admin listener", func(t *testing.T) {
+		cfg := makeCfg()
+		cfg.Admin.Enable = true
+		require.EqualError(t, cfg.IsValid(), "failed to validate admin config: failed to validate http config: invalid ListenAddress value: should not be empty")
+
+		cfg.Admin.HTTP.ListenAddress = "localhost:4546"
+		require.NoError(t, cfg.IsValid())
+	})
+
+	t.Run("debug without admin", func(t *testing.T) {
+		cfg := makeCfg()
+		cfg.EnableDebug = true
+		require.NoError(t, cfg.IsValid())
+
+		cfg.Security.EnableAdmin = false
+		require.EqualError(t, cfg.IsValid(), "invalid EnableDebug value: admin should be enabled")
+	})
+}
+
+func TestStoreConfigIsValid(t *testing.T) {
+	cfg := StoreConfig{DataSource: "/tmp/db"}
+	require.NoError(t, cfg.IsValid())
+	require.Equal(t, store.DriverBitcask, cfg.GetDriver())
+
+	cfg.Driver = store.DriverSQLite
+	require.NoError(t, cfg.IsValid())
+	require.Equal(t, store.DriverSQLite, cfg.GetDriver())
+
+	cfg.Driver = "leveldb"
+	require.EqualError(t, cfg.IsValid(), `invalid Driver value: invalid driver "leveldb"`)
+
+	cfg.Driver = store.DriverBitcask
+	cfg.CompactionIntervalMinutes = -1
+	require.EqualError(t, cfg.IsValid(), "invalid CompactionIntervalMinutes value: should not be negative")
+
+	cfg.CompactionIntervalMinutes = 60
+	cfg.CompactionGarbageThreshold = 1.5
+	require.EqualError(t, cfg.IsValid(), "invalid CompactionGarbageThreshold value: should be between 0 and 1")
+
+	cfg.CompactionGarbageThreshold = 0.5
+	require.NoError(t, cfg.IsValid())
+
+	cfg.Encryption.Enable = true
+	require.EqualError(t, cfg.IsValid(), "invalid Encryption value: invalid ActiveKeyID value: should not be empty")
+
+	cfg.Encryption.Enable = false
+	require.NoError(t, cfg.IsValid())
+}
+
+func TestJobsConfigIsValid(t *testing.T) {
+	cfg := JobsConfig{
+		APIType:           JobAPITypeDocker,
+		MaxConcurrentJobs: 2,
+	}
+	require.NoError(t, cfg.IsValid())
+
+	cfg.InputDataEnvPrefix = "calls_"
+	require.EqualError(t, cfg.IsValid(), "invalid InputDataEnvPrefix value: prefix should start with an uppercase letter and only contain uppercase letters, digits and underscores")
+
+	cfg.InputDataEnvPrefix = "CALLS_"
+	require.NoError(t, cfg.IsValid())
 }
@@ -0,0 +1,314 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mattermost/calls-offloader/public/job"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+)
+
+const (
+	dockerEventsMinReconnectDelay = time.Second
+	dockerEventsMaxReconnectDelay = 30 * time.Second
+)
+
+// runningJob holds the state needed to track a job until its container exits.
+type runningJob struct {
+	job       job.Job
+	onStopCb  job.StopCb
+	timer     *time.Timer
+	oomKilled bool
+	// secretsDir is the host directory holding the job's secret files, if
+	// any. It's removed as soon as the container exits.
+	secretsDir string
+}
+
+func (s *JobService) trackJob(jb job.Job, onStopCb job.StopCb, secretsDir string) {
+	s.jobsMut.Lock()
+	defer s.jobsMut.Unlock()
+	s.runningJobs[jb.ID] = &runningJob{
+		job:        jb,
+		onStopCb:   onStopCb,
+		secretsDir: secretsDir,
+	}
+}
+
+func (s *JobService) untrackJob(jobID string) *runningJob {
+	s.jobsMut.Lock()
+	defer s.jobsMut.Unlock()
+	rj := s.runningJobs[jobID]
+	delete(s.runningJobs, jobID)
+	if rj != nil && rj.timer != nil {
+		rj.timer.Stop()
+	}
+	return rj
+}
+
+// setJobTimeout stops the job's container once the given duration has elapsed
+// so that it cannot run past the configured MaxDurationSec.
+func (s *JobService) setJobTimeout(jobID string, d time.Duration) {
+	s.jobsMut.Lock()
+	defer s.jobsMut.Unlock()
+	rj := s.runningJobs[jobID]
+	if rj == nil {
+		return
+	}
+	rj.timer = time.AfterFunc(d, func() {
+		s.log.Warn("timeout reached, stopping job", mlog.String("jobID", jobID))
+		if err := s.stopJob(jobID); err != nil {
+			s.log.Error("failed to stop job", mlog.Err(err), mlog.String("jobID", jobID))
+		}
+	})
+}
+
+// eventsHandler consumes the Docker events stream for the containers managed by
+// this service. It drives job completion, OOM detection and retention of failed
+// jobs. On stream errors it reconnects and resyncs the state to account for any
+// missed event.
+func (s *JobService) eventsHandler() {
+	s.log.Info("events handler is starting")
+	defer func() {
+		s.log.Info("exiting events handler")
+		close(s.eventsHandlerDoneCh)
+	}()
+
+	delay := dockerEventsMinReconnectDelay
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// Subscribing before resyncing guarantees no event can be missed in
+		// between. Events already accounted for by the resync are ignored.
+		msgCh, errCh := s.client.Events(ctx, types.EventsOptions{
+			Filters: filters.NewArgs(
+				filters.Arg("type", "container"),
+				filters.Arg("label", "app=mattermost-calls-offloader"),
+				filters.Arg("event", "die"),
+				filters.Arg("event", "oom"),
+				filters.Arg("event", "destroy"),
+			),
+		})
+
+		err := s.resync()
+		if err != nil {
+			s.log.Error("failed to resync state", mlog.Err(err))
+		} else {
+			delay = dockerEventsMinReconnectDelay
+		}
+
+		for err == nil {
+			select {
+			case <-s.stopCh:
+				cancel()
+				return
+			case msg := <-msgCh:
+				s.handleEvent(msg)
+			case err = <-errCh:
+				s.log.Error("events stream failed", mlog.Err(err))
+			}
+		}
+		cancel()
+
+		s.log.Info("reconnecting to events stream", mlog.Any("delay", delay))
+		select {
+		case <-s.stopCh:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, dockerEventsMaxReconnectDelay)
+	}
+}
+
+func (s *JobService) handleEvent(msg events.Message) {
+	if len(msg.Actor.ID) < 12 {
+		return
+	}
+	jobID := msg.Actor.ID[:12]
+
+	s.log.Debug("container event", mlog.String("jobID", jobID), mlog.String("action", msg.Action))
+
+	switch msg.Action {
+	case "oom":
+		s.jobsMut.Lock()
+		if rj := s.runningJobs[jobID]; rj != nil {
+			rj.oomKilled = true
+		}
+		s.jobsMut.Unlock()
+	case "die":
+		exitCode, err := strconv.Atoi(msg.Actor.Attributes["exitCode"])
+		if err != nil {
+			s.log.Error("failed to parse exit code", mlog.Err(err), mlog.String("jobID", jobID))
+			exitCode = -1
+		}
+		s.onJobExit(jobID, exitCode, false)
+
+		finishedAt := time.Now()
+		if msg.TimeNano > 0 {
+			finishedAt = time.Unix(0, msg.TimeNano)
+		}
+		s.scheduleRetention(jobID, finishedAt)
+	case "destroy":
+		s.cancelRetention(jobID)
+	}
+}
+
+// onJobExit runs the stop callback for the given job if it's being tracked.
+func (s *JobService) onJobExit(jobID string, exitCode int, oomKilled bool) {
+	rj := s.untrackJob(jobID)
+	if rj == nil {
+		return
+	}
+
+	if oomKilled || rj.oomKilled {
+		s.log.Error("job was killed due to running out of memory", mlog.String("jobID", jobID))
+	}
+
+	s.log.Debug("container exited", mlog.String("jobID", jobID), mlog.Int("exitCode", exitCode))
+
+	if rj.secretsDir != "" {
+		if err := removeJobSecrets(rj.secretsDir); err != nil {
+			s.log.Error("failed to remove job secrets", mlog.Err(err), mlog.String("jobID", jobID))
+		}
+	}
+
+	go func() {
+		if err := rj.onStopCb(rj.job, exitCode == 0 && !oomKilled && !rj.oomKilled); err != nil {
+			s.log.Error("failed to run onStopCb", mlog.Err(err), mlog.String("jobID", jobID))
+		}
+	}()
+}
+
+func (s *JobService) scheduleRetention(jobID string, finishedAt time.Time) {
+	if s.cfg.FailedJobsRetentionTime <= 0 {
+		return
+	}
+
+	s.retentionMut.Lock()
+	defer s.retentionMut.Unlock()
+
+	if _, ok := s.retentionTimers[jobID]; ok {
+		return
+	}
+
+	s.retentionTimers[jobID] = time.AfterFunc(time.Until(finishedAt.Add(s.cfg.FailedJobsRetentionTime)), func() {
+		s.log.Info("configured retention time has elapsed since the container finished, deleting",
+			mlog.String("id", jobID),
+			mlog.Any("retention_time", s.cfg.FailedJobsRetentionTime),
+			mlog.Any("finish_at", finishedAt),
+		)
+
+		s.cancelRetention(jobID)
+
+		if err := s.DeleteJob("", jobID); err != nil {
+			s.log.Error("failed to delete job", mlog.Err(err), mlog.String("jobID", jobID))
+		}
+	})
+}
+
+func (s *JobService) cancelRetention(jobID string) {
+	s.retentionMut.Lock()
+	defer s.retentionMut.Unlock()
+	if timer, ok := s.retentionTimers[jobID]; ok {
+		timer.Stop()
+		delete(s.retentionTimers, jobID)
+	}
+}
+
+// resync reconciles the tracked state with the actual containers. It's used
+// upon (re)connecting to the events stream.
+func (s *JobService) resync() error {
+	s.jobsMut.Lock()
+	jobIDs := make([]string, 0, len(s.runningJobs))
+	for jobID := range s.runningJobs {
+		jobIDs = append(jobIDs, jobID)
+	}
+	s.jobsMut.Unlock()
+
+	for _, jobID := range jobIDs {
+		ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+		cnt, err := s.client.ContainerInspect(ctx, jobID)
+		cancel()
+		if docker.IsErrNotFound(err) {
+			s.log.Warn("container is missing", mlog.String("jobID", jobID))
+			s.onJobExit(jobID, -1, false)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to inspect container: %w", err)
+		}
+
+		if cnt.State == nil {
+			s.log.Error("container state is missing", mlog.String("jobID", jobID))
+			continue
+		}
+
+		// Jobs are tracked right before their container gets started.
+		if !cnt.State.Running && cnt.State.Status != "created" {
+			s.onJobExit(jobID, cnt.State.ExitCode, cnt.State.OOMKilled)
+		}
+	}
+
+	if s.cfg.FailedJobsRetentionTime <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(filters.KeyValuePair{
+			Key:   "status",
+			Value: "exited",
+		}, filters.KeyValuePair{
+			Key:   "label",
+			Value: "app=mattermost-calls-offloader",
+		}),
+	})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	for _, c := range containers {
+		jobID := c.ID[:12]
+
+		s.retentionMut.Lock()
+		_, scheduled := s.retentionTimers[jobID]
+		s.retentionMut.Unlock()
+		if scheduled {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+		cnt, err := s.client.ContainerInspect(ctx, c.ID)
+		cancel()
+		if err != nil {
+			s.log.Error("failed to get container", mlog.Err(err))
+			continue
+		}
+
+		if cnt.State == nil {
+			s.log.Error("container state is missing", mlog.String("id", c.ID))
+			continue
+		}
+
+		finishedAt, err := time.Parse(time.RFC3339, cnt.State.FinishedAt)
+		if err != nil {
+			s.log.Error("failed to parse finish time", mlog.Err(err))
+			continue
+		}
+
+		s.scheduleRetention(jobID, finishedAt)
+	}
+
+	return nil
+}
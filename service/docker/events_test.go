@@ -0,0 +1,140 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package docker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/calls-offloader/public/job"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleEvent(t *testing.T) {
+	log, err := mlog.NewLogger()
+	require.NoError(t, err)
+	defer func() {
+		err := log.Shutdown()
+		require.NoError(t, err)
+	}()
+
+	newJobService := func() *JobService {
+		return &JobService{
+			log:             log,
+			runningJobs:     make(map[string]*runningJob),
+			retentionTimers: make(map[string]*time.Timer),
+		}
+	}
+
+	containerID := "0123456789abcdef0123456789abcdef"
+	jobID := containerID[:12]
+
+	trackJob := func(s *JobService) chan bool {
+		successCh := make(chan bool, 1)
+		s.trackJob(job.Job{ID: jobID}, func(jb job.Job, success bool) error {
+			require.Equal(t, jobID, jb.ID)
+			successCh <- success
+			return nil
+		}, "")
+		return successCh
+	}
+
+	waitStop := func(t *testing.T, successCh chan bool) bool {
+		t.Helper()
+		select {
+		case success := <-successCh:
+			return success
+		case <-time.After(time.Second):
+			require.FailNow(t, "timed out waiting for onStopCb")
+		}
+		return false
+	}
+
+	dieEvent := func(exitCode string) events.Message {
+		return events.Message{
+			Action: "die",
+			Actor: events.Actor{
+				ID:         containerID,
+				Attributes: map[string]string{"exitCode": exitCode},
+			},
+		}
+	}
+
+	t.Run("ignores untracked containers", func(t *testing.T) {
+		s := newJobService()
+		s.handleEvent(dieEvent("0"))
+		require.Empty(t, s.runningJobs)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		s := newJobService()
+		successCh := trackJob(s)
+		s.handleEvent(dieEvent("0"))
+		require.True(t, waitStop(t, successCh))
+		require.Empty(t, s.runningJobs)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		s := newJobService()
+		successCh := trackJob(s)
+		s.handleEvent(dieEvent("1"))
+		require.False(t, waitStop(t, successCh))
+		require.Empty(t, s.runningJobs)
+	})
+
+	t.Run("oom", func(t *testing.T) {
+		s := newJobService()
+		successCh := trackJob(s)
+		s.handleEvent(events.Message{
+			Action: "oom",
+			Actor: events.Actor{
+				ID: containerID,
+			},
+		})
+		s.handleEvent(dieEvent("0"))
+		require.False(t, waitStop(t, successCh))
+		require.Empty(t, s.runningJobs)
+	})
+}
+
+func TestRetentionScheduling(t *testing.T) {
+	log, err := mlog.NewLogger()
+	require.NoError(t, err)
+	defer func() {
+		err := log.Shutdown()
+		require.NoError(t, err)
+	}()
+
+	s := &JobService{
+		cfg: JobServiceConfig{
+			FailedJobsRetentionTime: time.Hour,
+		},
+		log:             log,
+		runningJobs:     make(map[string]*runningJob),
+		retentionTimers: make(map[string]*time.Timer),
+	}
+
+	containerID := "0123456789abcdef0123456789abcdef"
+	jobID := containerID[:12]
+
+	s.scheduleRetention(jobID, time.Now())
+	require.Len(t, s.retentionTimers, 1)
+
+	// Scheduling is idempotent.
+	s.scheduleRetention(jobID, time.Now())
+	require.Len(t, s.retentionTimers, 1)
+
+	// Destroying the container cancels retention.
+	s.handleEvent(events.Message{
+		Action: "destroy",
+		Actor: events.Actor{
+			ID: containerID,
+		},
+	})
+	require.Empty(t, s.retentionTimers)
+}
@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/mattermost/calls-offloader/public/job"
@@ -29,18 +31,28 @@ const (
 	dockerRequestTimeout   = 10 * time.Second
 	dockerImagePullTimeout = 2 * time.Minute
 	dockerVolumePath       = "/data"
+	dockerSecretsPath      = "/run/secrets/calls-offloader"
 )
 
 var (
-	dockerStopTimeout          = 5 * time.Minute
-	dockerRetentionJobInterval = time.Minute
+	dockerStopTimeout = 5 * time.Minute
 )
 
 type JobServiceConfig struct {
 	MaxConcurrentJobs       int
 	FailedJobsRetentionTime time.Duration
 	ImageRegistry           string
+	InputDataEnvPrefix      string
 	OutputLogs              bool `toml:"output_logs"`
+	// A directory where secret job input data is written to files, one
+	// directory per job, which get bind-mounted in job containers instead of
+	// passing secrets as environment variables. It's only accessible to the
+	// service and files are only readable by the user the runner image runs
+	// as, when it's numeric and the service can give them to it, or else by
+	// any user in the job container. It should be on a tmpfs (e.g. under
+	// /run) and, when the service runs in a container, be mounted at the same
+	// path as on the host.
+	SecretsDir string `toml:"secrets_dir"`
 }
 
 func (c JobServiceConfig) IsValid() error {
@@ -52,6 +64,10 @@ func (c JobServiceConfig) IsValid() error {
 		return fmt.Errorf("invalid FailedJobsRetentionTime value: should be at least one minute")
 	}
 
+	if c.SecretsDir != "" && !filepath.IsAbs(c.SecretsDir) {
+		return fmt.Errorf("invalid SecretsDir value: should be an absolute path")
+	}
+
 	return nil
 }
 
@@ -59,9 +75,18 @@ type JobService struct {
 	cfg JobServiceConfig
 	log mlog.LoggerIFace
 
-	client             *docker.Client
-	stopCh             chan struct{}
-	retentionJobDoneCh chan struct{}
+	client              *docker.Client
+	stopCh              chan struct{}
+	eventsHandlerDoneCh chan struct{}
+
+	runningJobs map[string]*runningJob
+	jobsMut     sync.Mutex
+
+	retentionTimers map[string]*time.Timer
+	retentionMut    sync.Mutex
+
+	initStatus job.ServiceStatus
+	initMut    sync.RWMutex
 }
 
 func NewJobService(log mlog.LoggerIFace, cfg JobServiceConfig) (*JobService, error) {
@@ -83,109 +108,116 @@ func NewJobService(log mlog.LoggerIFace, cfg JobServiceConfig) (*JobService, err
 	)
 
 	s := &JobService{
-		cfg:                cfg,
-		log:                log,
-		client:             client,
-		stopCh:             make(chan struct{}),
-		retentionJobDoneCh: make(chan struct{}),
+		cfg:                 cfg,
+		log:                 log,
+		client:              client,
+		stopCh:              make(chan struct{}),
+		eventsHandlerDoneCh: make(chan struct{}),
+		runningJobs:         make(map[string]*runningJob),
+		retentionTimers:     make(map[string]*time.Timer),
 	}
 
-	if s.cfg.FailedJobsRetentionTime > 0 {
-		go s.retentionJob()
-	} else {
-		s.log.Info("skipping retention job", mlog.Any("retention_time", s.cfg.FailedJobsRetentionTime))
-		close(s.retentionJobDoneCh)
+	if s.cfg.FailedJobsRetentionTime <= 0 {
+		s.log.Info("skipping retention of failed jobs", mlog.Any("retention_time", s.cfg.FailedJobsRetentionTime))
 	}
 
+	if s.cfg.SecretsDir != "" {
+		// Checked here rather than when creating jobs so that a misconfigured
+		// directory is reported right away.
+		if err := prepareSecretsDir(s.cfg.SecretsDir); err != nil {
+			return nil, fmt.Errorf("invalid SecretsDir value: %w", err)
+		}
+		if err := s.removeStaleSecrets(); err != nil {
+			s.log.Error("failed to remove stale job secrets", mlog.Err(err))
+		}
+	}
+
+	go s.eventsHandler()
+
 	return s, nil
 }
 
-func (s *JobService) retentionJob() {
-	s.log.Info("retention job is starting",
-		mlog.Any("retention_time", s.cfg.FailedJobsRetentionTime),
-	)
-	defer func() {
-		s.log.Info("exiting retention job")
-		close(s.retentionJobDoneCh)
-	}()
-
-	ticker := time.NewTicker(dockerRetentionJobInterval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-s.stopCh:
-			return
-		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
-			containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{
-				All: true,
-				Filters: filters.NewArgs(filters.KeyValuePair{
-					Key:   "status",
-					Value: "exited",
-				}, filters.KeyValuePair{
-					Key:   "label",
-					Value: "app=mattermost-calls-offloader",
-				}),
-			})
-			cancel()
-			if err != nil {
-				s.log.Error("failed to list containers", mlog.Err(err))
-				continue
-			}
+// removeStaleSecrets removes the secrets left behind by jobs that exited while
+// the service wasn't running, or that it failed to clean up after.
+func (s *JobService) removeStaleSecrets() error {
+	entries, err := os.ReadDir(s.cfg.SecretsDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read secrets directory: %w", err)
+	}
 
-			if len(containers) == 0 {
-				// nothing to do
-				continue
-			}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	defer cancel()
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(filters.KeyValuePair{
+			Key:   "label",
+			Value: "app=mattermost-calls-offloader",
+		}),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
 
-			for _, cnt := range containers {
-				ctx, cancel = context.WithTimeout(context.Background(), dockerRequestTimeout)
-				c, err := s.client.ContainerInspect(ctx, cnt.ID)
-				cancel()
-				if err != nil {
-					s.log.Error("failed to get container", mlog.Err(err))
-					continue
-				}
-
-				if c.State == nil {
-					s.log.Error("container state is missing", mlog.String("id", cnt.ID))
-					continue
-				}
-
-				finishedAt, err := time.Parse(time.RFC3339, c.State.FinishedAt)
-				if err != nil {
-					s.log.Error("failed to parse finish time", mlog.Err(err))
-					continue
-				}
-
-				if since := time.Since(finishedAt); since > s.cfg.FailedJobsRetentionTime {
-					s.log.Info("configured retention time has elapsed since the container finished, deleting",
-						mlog.String("id", cnt.ID),
-						mlog.Any("retention_time", s.cfg.FailedJobsRetentionTime),
-						mlog.Any("finish_at", finishedAt),
-						mlog.Any("since", since),
-					)
-
-					if err := s.DeleteJob(cnt.ID); err != nil {
-						s.log.Error("failed to delete job", mlog.Err(err), mlog.String("jobID", cnt.ID))
-						continue
-					}
-				}
+	// Secrets are still needed by the jobs that haven't exited yet.
+	inUse := make(map[string]bool)
+	for _, c := range containers {
+		if c.State == "exited" || c.State == "dead" {
+			continue
+		}
+		for _, m := range c.Mounts {
+			if m.Type == mount.TypeBind && m.Destination == dockerSecretsPath {
+				inUse[filepath.Clean(m.Source)] = true
 			}
 		}
 	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(s.cfg.SecretsDir, entry.Name())
+		if inUse[dir] {
+			continue
+		}
+		s.log.Debug("removing stale job secrets", mlog.String("dir", dir))
+		if err := removeJobSecrets(dir); err != nil {
+			s.log.Error("failed to remove job secrets", mlog.Err(err), mlog.String("dir", dir))
+		}
+	}
+
+	return nil
 }
 
 func (s *JobService) Shutdown() error {
 	s.log.Info("docker job service shutting down")
 
 	close(s.stopCh)
-	<-s.retentionJobDoneCh
+	<-s.eventsHandlerDoneCh
+
+	s.jobsMut.Lock()
+	for _, rj := range s.runningJobs {
+		if rj.timer != nil {
+			rj.timer.Stop()
+		}
+	}
+	s.jobsMut.Unlock()
+
+	s.retentionMut.Lock()
+	for _, timer := range s.retentionTimers {
+		timer.Stop()
+	}
+	s.retentionMut.Unlock()
 
 	return s.client.Close()
 }
 
 func (s *JobService) Init(cfg job.ServiceConfig) error {
+	s.initMut.Lock()
+	s.initStatus = job.ServiceStatus{
+		Runners:      cfg.Runners,
+		NodesDesired: 1,
+	}
+	s.initMut.Unlock()
+
 	errCh := make(chan error, len(cfg.Runners))
 	for _, runner := range cfg.Runners {
 		go func(r string) {
@@ -199,9 +231,20 @@ func (s *JobService) Init(cfg job.ServiceConfig) error {
 		}
 	}
 
+	s.initMut.Lock()
+	s.initStatus.Ready = true
+	s.initStatus.NodesReady = 1
+	s.initMut.Unlock()
+
 	return nil
 }
 
+func (s *JobService) GetInitStatus() (job.ServiceStatus, error) {
+	s.initMut.RLock()
+	defer s.initMut.RUnlock()
+	return s.initStatus, nil
+}
+
 func (s *JobService) updateJobRunner(runner string) error {
 	if os.Getenv("DEV_MODE") == "true" {
 		runner = getImageNameFromRunner(runner) + ":master"
@@ -238,7 +281,7 @@ func (s *JobService) updateJobRunner(runner string) error {
 	return nil
 }
 
-func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, error) {
+func (s *JobService) CreateJob(_ string, cfg job.Config, onStopCb job.StopCb) (job.Job, error) {
 	if err := cfg.IsValid(s.cfg.ImageRegistry); err != nil {
 		return job.Job{}, fmt.Errorf("invalid job config: %w", err)
 	}
@@ -288,7 +331,11 @@ func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, er
 	}
 
 	cfg.InputData.SetSiteURL(getSiteURLForJob(cfg.InputData.GetSiteURL()))
-	env := cfg.InputData.ToEnv()
+	inputEnv, secretsEnv, err := cfg.InputData.SplitEnvMap(cfg.Type, s.cfg.InputDataEnvPrefix)
+	if err != nil {
+		return job.Job{}, fmt.Errorf("invalid job config: %w", err)
+	}
+	env := getEnvList(inputEnv)
 
 	var networkMode container.NetworkMode
 	if devMode {
@@ -307,8 +354,57 @@ func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, er
 	ctx, cancel = context.WithTimeout(context.Background(), dockerRequestTimeout)
 	defer cancel()
 
+	// Secrets are kept out of the container config, which can be inspected,
+	// by delivering them as files only readable by the user the job runs as.
+	var secretsDir string
+	if s.cfg.SecretsDir != "" && len(secretsEnv) > 0 {
+		img, _, err := s.client.ImageInspectWithRaw(ctx, jb.Runner)
+		if err != nil {
+			return job.Job{}, fmt.Errorf("failed to get job runner: %w", err)
+		}
+		var imgUser string
+		if img.Config != nil {
+			imgUser = img.Config.User
+		}
+
+		secretsDir = filepath.Join(s.cfg.SecretsDir, jobPrefix+"-"+random.NewID())
+		secretsFileEnv, err := writeJobSecrets(secretsDir, secretsEnv, imgUser)
+		if err != nil {
+			return job.Job{}, fmt.Errorf("failed to write job secrets: %w", err)
+		}
+		env = append(env, secretsFileEnv...)
+	} else {
+		env = append(env, getEnvList(secretsEnv)...)
+	}
+
+	removeSecrets := func() {
+		if secretsDir == "" {
+			return
+		}
+		if err := removeJobSecrets(secretsDir); err != nil {
+			s.log.Error("failed to remove job secrets", mlog.Err(err))
+		}
+	}
+
 	volumeID := jobPrefix + "-" + random.NewID()
 
+	mounts := []mount.Mount{
+		{
+			Target: dockerVolumePath,
+			Source: volumeID,
+			Type:   "volume",
+		},
+	}
+
+	if secretsDir != "" {
+		mounts = append(mounts, mount.Mount{
+			Target:   dockerSecretsPath,
+			Source:   secretsDir,
+			Type:     "bind",
+			ReadOnly: true,
+		})
+	}
+
 	securityOpts := []string{dockerSecurityOpts}
 
 	resp, err := s.client.ContainerCreate(ctx, &container.Config{
@@ -322,77 +418,41 @@ func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, er
 		},
 	}, &container.HostConfig{
 		NetworkMode: networkMode,
-		Mounts: []mount.Mount{
-			{
-				Target: dockerVolumePath,
-				Source: volumeID,
-				Type:   "volume",
-			},
-		},
+		Mounts:      mounts,
 		SecurityOpt: securityOpts,
 	}, nil, nil, "")
 	if err != nil {
+		removeSecrets()
 		return job.Job{}, fmt.Errorf("failed to create container: %w", err)
 	}
 
 	jb.ID = resp.ID[:12]
+	jb.StartAt = time.Now().UnixMilli()
+
+	// The job needs to be tracked before starting the container as it could
+	// exit before we get a chance to.
+	s.trackJob(jb, onStopCb, secretsDir)
 
 	if err := s.client.ContainerStart(ctx, jb.ID, types.ContainerStartOptions{}); err != nil {
+		s.untrackJob(jb.ID)
+		removeSecrets()
 		return job.Job{}, fmt.Errorf("failed to start container: %w", err)
 	}
 
-	jb.StartAt = time.Now().UnixMilli()
+	// The events handler takes care of notifying the caller through the provided
+	// callback when the container exits, either because of an unexpected error or the
+	// execution reaching the configured MaxDurationSec.
+	s.setJobTimeout(jb.ID, time.Duration(cfg.MaxDurationSec)*time.Second)
 
-	// We wait for the container to exit to cover both the case of unexpected error or
-	// the execution reaching the configured MaxDurationSec. The provided callback is used
-	// to update the caller about this occurrence.
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.MaxDurationSec)*time.Second)
-		defer cancel()
-
-		waitCh, errCh := s.client.ContainerWait(ctx, jb.ID, container.WaitConditionNotRunning)
-
-		if s.cfg.OutputLogs {
-			go func() {
-				if err := s.getJobLogs(ctx, jb.ID, os.Stdout, os.Stderr, true); err != nil {
-					s.log.Error("failed to get job logs", mlog.Err(err), mlog.String("jobID", jb.ID))
-				}
-			}()
-		}
-
-		var exitCode int
-		select {
-		case res := <-waitCh:
-			exitCode = int(res.StatusCode)
-		case err := <-errCh:
-			s.log.Warn("timeout reached, stopping job", mlog.Err(err), mlog.String("jobID", jb.ID))
-			if err := s.stopJob(jb.ID); err != nil {
-				s.log.Error("failed to stop job", mlog.Err(err), mlog.String("jobID", jb.ID))
-				return
-			}
-
-			ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	if s.cfg.OutputLogs {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.MaxDurationSec)*time.Second+dockerStopTimeout)
 			defer cancel()
-			cnt, err := s.client.ContainerInspect(ctx, jb.ID)
-			if err != nil {
-				s.log.Error("failed to inspect container", mlog.Err(err), mlog.String("jobID", jb.ID))
-				return
-			}
-
-			if cnt.State == nil {
-				s.log.Error("container state is missing", mlog.String("jobID", jb.ID))
-				return
+			if err := s.getJobLogs(ctx, jb.ID, os.Stdout, os.Stderr, true); err != nil {
+				s.log.Error("failed to get job logs", mlog.Err(err), mlog.String("jobID", jb.ID))
 			}
-
-			exitCode = cnt.State.ExitCode
-		}
-
-		s.log.Debug("container exited", mlog.String("jobID", jb.ID), mlog.Int("exitCode", exitCode))
-
-		if err := onStopCb(jb, exitCode == 0); err != nil {
-			s.log.Error("failed to run onStopCb", mlog.Err(err), mlog.String("jobID", jb.ID))
-		}
-	}()
+		}()
+	}
 
 	return jb, nil
 }
@@ -429,19 +489,26 @@ func (s *JobService) getJobLogs(ctx context.Context, jobID string, stdout, stder
 	return nil
 }
 
-func (s *JobService) GetJobLogs(jobID string, stdout, stderr io.Writer) error {
+func (s *JobService) GetJobLogs(_, jobID string, stdout, stderr io.Writer, opts job.LogsOptions) error {
+	// Docker jobs run in a single container which is identified by the job ID.
+	if opts.Container != "" && opts.Container != jobID {
+		return fmt.Errorf("failed to get container %q: %w", opts.Container, job.ErrContainerNotFound)
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
 	defer cancel()
 
 	return s.getJobLogs(ctx, jobID, stdout, stderr, false)
 }
 
-func (s *JobService) DeleteJob(jobID string) error {
+func (s *JobService) DeleteJob(_, jobID string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
 	defer cancel()
 
 	cnt, err := s.client.ContainerInspect(ctx, jobID)
-	if err != nil {
+	if docker.IsErrNotFound(err) {
+		return fmt.Errorf("failed to get container: %w", job.ErrNotFound)
+	} else if err != nil {
 		return fmt.Errorf("failed to get container: %w", err)
 	}
 
@@ -449,11 +516,25 @@ func (s *JobService) DeleteJob(jobID string) error {
 		return fmt.Errorf("failed to remove container: %w", err)
 	}
 
-	if len(cnt.Mounts) == 0 {
+	var volumeName string
+	for _, m := range cnt.Mounts {
+		switch {
+		case m.Type == mount.TypeVolume:
+			volumeName = m.Name
+		case m.Type == mount.TypeBind && m.Destination == dockerSecretsPath:
+			// Secrets are normally removed when the container exits but the
+			// service may not have been running at the time.
+			if err := removeJobSecrets(m.Source); err != nil {
+				s.log.Error("failed to remove job secrets", mlog.Err(err), mlog.String("jobID", jobID))
+			}
+		}
+	}
+
+	if volumeName == "" {
 		return fmt.Errorf("container should have one volume")
 	}
 
-	if err := s.client.VolumeRemove(ctx, cnt.Mounts[0].Name, false); err != nil {
+	if err := s.client.VolumeRemove(ctx, volumeName, false); err != nil {
 		return fmt.Errorf("failed to remove volume: %w", err)
 	}
 
@@ -73,8 +73,9 @@ func TestCreateJob(t *testing.T) {
 	os.Setenv("TEST_MODE", "true")
 	defer os.Unsetenv("TEST_MODE")
 
+	var logsOpts job.LogsOptions
 	stopCh := make(chan struct{})
-	job, err := jobService.CreateJob(job.Config{
+	job, err := jobService.CreateJob("clientID", job.Config{
 		Type:           job.TypeRecording,
 		Runner:         testRunner,
 		MaxDurationSec: 60,
@@ -103,11 +104,11 @@ func TestCreateJob(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	err = jobService.GetJobLogs(job.ID, &buf, io.Discard)
+	err = jobService.GetJobLogs("", job.ID, &buf, io.Discard, logsOpts)
 	require.NoError(t, err)
 	require.Contains(t, buf.String(), "Hello from Docker!")
 
-	err = jobService.DeleteJob(job.ID)
+	err = jobService.DeleteJob("", job.ID)
 	require.NoError(t, err)
 }
 
@@ -118,12 +119,6 @@ func TestFailedJobsRetention(t *testing.T) {
 	os.Setenv("TEST_MODE", "true")
 	defer os.Unsetenv("TEST_MODE")
 
-	interval := dockerRetentionJobInterval
-	dockerRetentionJobInterval = time.Second
-	defer func() {
-		dockerRetentionJobInterval = interval
-	}()
-
 	jobService, err := NewJobService(log, JobServiceConfig{
 		MaxConcurrentJobs:       100,
 		FailedJobsRetentionTime: 5 * time.Second,
@@ -132,7 +127,7 @@ func TestFailedJobsRetention(t *testing.T) {
 	require.NotNil(t, jobService)
 
 	stopCh := make(chan struct{})
-	job, err := jobService.CreateJob(job.Config{
+	job, err := jobService.CreateJob("clientID", job.Config{
 		Type:           job.TypeRecording,
 		Runner:         testRunner,
 		MaxDurationSec: 60,
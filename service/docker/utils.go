@@ -4,10 +4,20 @@
 package docker
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/calls-offloader/public/job"
 )
 
 var dockerImageRE = regexp.MustCompile(`^mattermost\/(.+):v(?:0|[1-9]\d*)\.(?:0|[1-9]\d*)\.(?:0|[1-9]\d*)(?:-dev\d*)*$`)
@@ -35,3 +45,140 @@ func getImageNameFromRunner(runner string) string {
 	}
 	return matches[1]
 }
+
+// prepareSecretsDir creates the directory job secrets are written to, making
+// sure it's only accessible to the service and that files can be written to
+// it.
+func prepareSecretsDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Secret files may be readable by anyone, the directory keeps them from
+	// other users on the host.
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// writeJobSecrets writes each secret environment variable to its own file in
+// dir, which is created within the directory prepared by prepareSecretsDir and
+// later bind-mounted at dockerSecretsPath in the job container. It returns the
+// environment variables referencing the files from within the container.
+//
+// Files are only readable by the user the image runs as when they can be given
+// to it, that is when the user is numeric and the service runs as that user,
+// as root or with CAP_CHOWN. Otherwise they are readable by any user in the
+// job container.
+func writeJobSecrets(dir string, secrets map[string]string, imageUser string) ([]string, error) {
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+
+	writeFiles := func() ([]string, error) {
+		fileMode, dirMode := os.FileMode(0400), os.FileMode(0500)
+		uid, gid, ok := parseImageUser(imageUser)
+		if ok {
+			if err := chownIfNeeded(dir, uid, gid); errors.Is(err, fs.ErrPermission) {
+				ok = false
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to set secrets directory owner: %w", err)
+			}
+		}
+		if !ok {
+			fileMode, dirMode = 0444, 0555
+		}
+
+		env := make([]string, 0, len(secrets))
+		for name, val := range secrets {
+			filePath := filepath.Join(dir, name)
+			if err := os.WriteFile(filePath, []byte(val), fileMode); err != nil {
+				return nil, fmt.Errorf("failed to write secret file: %w", err)
+			}
+			if ok {
+				if err := chownIfNeeded(filePath, uid, gid); err != nil {
+					return nil, fmt.Errorf("failed to set secret file owner: %w", err)
+				}
+			}
+			env = append(env, name+job.InputDataFileEnvSuffix+"="+path.Join(dockerSecretsPath, name))
+		}
+		sort.Strings(env)
+
+		if err := os.Chmod(dir, dirMode); err != nil {
+			return nil, fmt.Errorf("failed to set secrets directory mode: %w", err)
+		}
+
+		return env, nil
+	}
+
+	env, err := writeFiles()
+	if err != nil {
+		_ = removeJobSecrets(dir)
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// removeJobSecrets removes a directory written by writeJobSecrets.
+func removeJobSecrets(dir string) error {
+	// Write permission is needed to remove the files within it.
+	if err := os.Chmod(dir, 0700); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// chownIfNeeded changes the owner of the given file unless it's already owned
+// by the given user and group, which only requires privileges when not.
+func chownIfNeeded(name string, uid, gid int) error {
+	if uid == os.Geteuid() && gid == os.Getegid() {
+		return nil
+	}
+	return os.Chown(name, uid, gid)
+}
+
+// parseImageUser returns the numeric user and group IDs from the user an
+// image is configured to run as (e.g. "1000:1000"). An empty user stands for
+// root. It returns false for names, which can't be resolved outside of the
+// image.
+func parseImageUser(user string) (int, int, bool) {
+	if user == "" {
+		return 0, 0, true
+	}
+
+	uidStr, gidStr, hasGID := strings.Cut(user, ":")
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil || uid < 0 {
+		return 0, 0, false
+	}
+
+	// The group doesn't matter much as secret files are only readable by
+	// their owner.
+	var gid int
+	if hasGID {
+		gid, err = strconv.Atoi(gidStr)
+		if err != nil || gid < 0 {
+			return 0, 0, false
+		}
+	}
+
+	return uid, gid, true
+}
+
+// getEnvList returns the given environment variables as a sorted list of
+// NAME=value entries.
+func getEnvList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for name, val := range env {
+		list = append(list, name+"="+val)
+	}
+	sort.Strings(list)
+	return list
+}
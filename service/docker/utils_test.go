@@ -4,6 +4,9 @@
 package docker
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -43,3 +46,154 @@ func TestGetImageNameFromRunner(t *testing.T) {
 		})
 	}
 }
+
+func TestPrepareSecretsDir(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "run", "secrets")
+		require.NoError(t, prepareSecretsDir(dir))
+		info, err := os.Stat(dir)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("too permissive", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "secrets")
+		require.NoError(t, os.Mkdir(dir, 0755))
+		require.NoError(t, prepareSecretsDir(dir))
+		info, err := os.Stat(dir)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	})
+
+	t.Run("not a directory", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "secrets")
+		require.NoError(t, os.WriteFile(file, nil, 0600))
+		require.Error(t, prepareSecretsDir(file))
+	})
+}
+
+func TestWriteJobSecrets(t *testing.T) {
+	secretsDir := filepath.Join(t.TempDir(), "secrets")
+	require.NoError(t, prepareSecretsDir(secretsDir))
+	dir := filepath.Join(secretsDir, "calls-recorder-id")
+	imageUser := fmt.Sprintf("%d:%d", os.Geteuid(), os.Getegid())
+
+	env, err := writeJobSecrets(dir, map[string]string{
+		"AUTH_TOKEN": "authToken",
+		"PORT":       "8065",
+	}, imageUser)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"AUTH_TOKEN_FILE=/run/secrets/calls-offloader/AUTH_TOKEN",
+		"PORT_FILE=/run/secrets/calls-offloader/PORT",
+	}, env)
+
+	data, err := os.ReadFile(filepath.Join(dir, "AUTH_TOKEN"))
+	require.NoError(t, err)
+	require.Equal(t, "authToken", string(data))
+	data, err = os.ReadFile(filepath.Join(dir, "PORT"))
+	require.NoError(t, err)
+	require.Equal(t, "8065", string(data))
+
+	info, err := os.Stat(filepath.Join(dir, "AUTH_TOKEN"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0400), info.Mode().Perm())
+	info, err = os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0500), info.Mode().Perm())
+
+	t.Run("existing directory", func(t *testing.T) {
+		_, err := writeJobSecrets(dir, map[string]string{"AUTH_TOKEN": "authToken"}, imageUser)
+		require.Error(t, err)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		require.NoError(t, removeJobSecrets(dir))
+		_, err := os.Stat(dir)
+		require.True(t, os.IsNotExist(err))
+		require.NoError(t, removeJobSecrets(dir))
+	})
+
+	requireReadableByAll := func(t *testing.T, dir string) {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(dir, "AUTH_TOKEN"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0444), info.Mode().Perm())
+		info, err = os.Stat(dir)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0555), info.Mode().Perm())
+	}
+
+	t.Run("named user", func(t *testing.T) {
+		dir := filepath.Join(secretsDir, "calls-recorder-named")
+		_, err := writeJobSecrets(dir, map[string]string{"AUTH_TOKEN": "authToken"}, "calls")
+		require.NoError(t, err)
+		requireReadableByAll(t, dir)
+		require.NoError(t, removeJobSecrets(dir))
+	})
+
+	t.Run("chown not permitted", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("running as root")
+		}
+		dir := filepath.Join(secretsDir, "calls-recorder-other")
+		_, err := writeJobSecrets(dir, map[string]string{"AUTH_TOKEN": "authToken"}, "0")
+		require.NoError(t, err)
+		requireReadableByAll(t, dir)
+		require.NoError(t, removeJobSecrets(dir))
+	})
+}
+
+func TestParseImageUser(t *testing.T) {
+	tcs := []struct {
+		user string
+		uid  int
+		gid  int
+		ok   bool
+	}{
+		{user: "", ok: true},
+		{user: "0", ok: true},
+		{user: "1000", uid: 1000, ok: true},
+		{user: "1000:1001", uid: 1000, gid: 1001, ok: true},
+		{user: "calls"},
+		{user: "1000:calls"},
+		{user: "-1"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.user, func(t *testing.T) {
+			uid, gid, ok := parseImageUser(tc.user)
+			require.Equal(t, tc.ok, ok)
+			require.Equal(t, tc.uid, uid)
+			require.Equal(t, tc.gid, gid)
+		})
+	}
+}
+
+func TestJobServiceConfigIsValid(t *testing.T) {
+	cfg := JobServiceConfig{}
+	require.NoError(t, cfg.IsValid())
+
+	cfg.SecretsDir = "run/secrets"
+	require.EqualError(t, cfg.IsValid(), "invalid SecretsDir value: should be an absolute path")
+
+	cfg.SecretsDir = "/run/calls-offloader/secrets"
+	require.NoError(t, cfg.IsValid())
+}
+
+func TestGetEnvList(t *testing.T) {
+	require.Empty(t, getEnvList(nil))
+	require.Equal(t, []string{
+		"CALL_ID=callID",
+		"OPTIONS={\"model\":\"base\"}",
+		"SITE_URL=http://localhost:8065",
+	}, getEnvList(map[string]string{
+		"SITE_URL": "http://localhost:8065",
+		"OPTIONS":  `{"model":"base"}`,
+		"CALL_ID":  "callID",
+	}))
+}
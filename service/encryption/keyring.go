@@ -0,0 +1,253 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// KeySize is the size, in bytes, of the keys used to encrypt data keys
+// (AES-256).
+const KeySize = 32
+
+// Keys maps a key ID to its base64 encoded key.
+type Keys map[string]string
+
+func (k *Keys) Decode(data string) error {
+	return json.Unmarshal([]byte(data), k)
+}
+
+func (k *Keys) UnmarshalTOML(data interface{}) error {
+	js, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("invalid data found")
+	}
+	if js == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(js), k)
+}
+
+type Config struct {
+	// Whether to encrypt new data. Configured keys are still used to decrypt
+	// existing data when disabled.
+	Enable bool `toml:"enable"`
+	// The ID of the key used to encrypt new data. All the other keys are only
+	// used for decryption, which allows keys to be rotated.
+	ActiveKeyID string `toml:"active_key_id"`
+	Keys        Keys   `toml:"keys"`
+	// A path to a file holding the keys, in the same JSON format as Keys. It
+	// can be used instead of Keys to keep them out of the config.
+	KeysFile string `toml:"keys_file"`
+}
+
+func (c Config) IsValid() error {
+	if c.KeysFile != "" && len(c.Keys) > 0 {
+		return errors.New("invalid KeysFile value: Keys should not be set as well")
+	}
+
+	keys, err := c.loadKeys()
+	if err != nil {
+		return err
+	}
+
+	if !c.Enable {
+		return nil
+	}
+
+	if c.ActiveKeyID == "" {
+		return errors.New("invalid ActiveKeyID value: should not be empty")
+	}
+
+	if _, ok := keys[c.ActiveKeyID]; !ok {
+		return fmt.Errorf("invalid ActiveKeyID value: key %q not found", c.ActiveKeyID)
+	}
+
+	return nil
+}
+
+// HasKeys returns whether any key is configured, meaning encrypted data can
+// be decrypted.
+func (c Config) HasKeys() bool {
+	return c.KeysFile != "" || len(c.Keys) > 0
+}
+
+func (c Config) loadKeys() (map[string][]byte, error) {
+	encodedKeys := c.Keys
+	if c.KeysFile != "" {
+		data, err := os.ReadFile(c.KeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys file: %w", err)
+		}
+		if err := json.Unmarshal(data, &encodedKeys); err != nil {
+			return nil, fmt.Errorf("failed to decode keys file: %w", err)
+		}
+	}
+
+	keys := make(map[string][]byte, len(encodedKeys))
+	for id, encodedKey := range encodedKeys {
+		if id == "" {
+			return nil, errors.New("invalid key: ID should not be empty")
+		}
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: failed to decode: %w", id, err)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("invalid key %q: should be %d bytes", id, KeySize)
+		}
+		keys[id] = key
+	}
+
+	return keys, nil
+}
+
+// Envelope holds data encrypted with a random data key, itself encrypted
+// with one of the keys of a Keyring. Both are encrypted through AES-256-GCM
+// and prefixed with their nonce.
+type Envelope struct {
+	// The ID of the key used to encrypt the data key.
+	KeyID        string `json:"key_id"`
+	EncryptedKey []byte `json:"encrypted_key"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+// Keyring encrypts data with its active key and decrypts data encrypted with
+// any of its keys.
+type Keyring struct {
+	activeKeyID string
+	keys        map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring holding the configured keys. The active key is
+// only set if encryption is enabled.
+func NewKeyring(cfg Config) (*Keyring, error) {
+	if err := cfg.IsValid(); err != nil {
+		return nil, fmt.Errorf("failed to validate config: %w", err)
+	}
+
+	keys, err := cfg.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{
+		keys: make(map[string]cipher.AEAD, len(keys)),
+	}
+	if cfg.Enable {
+		k.activeKeyID = cfg.ActiveKeyID
+	}
+
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		k.keys[id] = aead
+	}
+
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, aad []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], aad)
+}
+
+// Enabled returns whether the keyring encrypts new data.
+func (k *Keyring) Enabled() bool {
+	return k.activeKeyID != ""
+}
+
+// ActiveKeyID returns the ID of the key used to encrypt new data, if any.
+func (k *Keyring) ActiveKeyID() string {
+	return k.activeKeyID
+}
+
+// Encrypt encrypts plaintext with a new data key. The additional data (e.g.
+// the ID of the record holding the envelope) is authenticated but not
+// encrypted, and should be passed to Decrypt as well.
+func (k *Keyring) Encrypt(plaintext, aad []byte) (*Envelope, error) {
+	if !k.Enabled() {
+		return nil, errors.New("encryption is not enabled")
+	}
+
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	ciphertext, err := seal(dataAEAD, plaintext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data: %w", err)
+	}
+
+	// The key ID is authenticated so that an envelope can't be tampered to
+	// point to a different key.
+	encryptedKey, err := seal(k.keys[k.activeKeyID], dataKey, []byte(k.activeKeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+
+	return &Envelope{
+		KeyID:        k.activeKeyID,
+		EncryptedKey: encryptedKey,
+		Ciphertext:   ciphertext,
+	}, nil
+}
+
+// Decrypt returns the plaintext held by the envelope.
+func (k *Keyring) Decrypt(env *Envelope, aad []byte) ([]byte, error) {
+	aead, ok := k.keys[env.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found", env.KeyID)
+	}
+
+	dataKey, err := open(aead, env.EncryptedKey, []byte(env.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	plaintext, err := open(dataAEAD, env.Ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data: %w", err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestConfigIsValid(t *testing.T) {
+	key := newTestKey(t)
+
+	tcs := []struct {
+		name string
+		cfg  Config
+		err  string
+	}{
+		{
+			name: "disabled",
+			cfg:  Config{},
+		},
+		{
+			name: "disabled with keys",
+			cfg:  Config{Keys: Keys{"key1": key}},
+		},
+		{
+			name: "missing active key ID",
+			cfg:  Config{Enable: true, Keys: Keys{"key1": key}},
+			err:  "invalid ActiveKeyID value: should not be empty",
+		},
+		{
+			name: "active key not found",
+			cfg:  Config{Enable: true, ActiveKeyID: "key2", Keys: Keys{"key1": key}},
+			err:  `invalid ActiveKeyID value: key "key2" not found`,
+		},
+		{
+			name: "invalid encoding",
+			cfg:  Config{Enable: true, ActiveKeyID: "key1", Keys: Keys{"key1": "%%%"}},
+			err:  `invalid key "key1": failed to decode: illegal base64 data at input byte 0`,
+		},
+		{
+			name: "invalid size",
+			cfg:  Config{Enable: true, ActiveKeyID: "key1", Keys: Keys{"key1": base64.StdEncoding.EncodeToString([]byte("short"))}},
+			err:  `invalid key "key1": should be 32 bytes`,
+		},
+		{
+			name: "both keys and file",
+			cfg:  Config{Keys: Keys{"key1": key}, KeysFile: "keys.json"},
+			err:  "invalid KeysFile value: Keys should not be set as well",
+		},
+		{
+			name: "missing file",
+			cfg:  Config{KeysFile: filepath.Join(t.TempDir(), "keys.json")},
+			err:  "failed to read keys file",
+		},
+		{
+			name: "valid",
+			cfg:  Config{Enable: true, ActiveKeyID: "key1", Keys: Keys{"key1": key}},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.IsValid()
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestKeysUnmarshalTOML(t *testing.T) {
+	var keys Keys
+	require.NoError(t, keys.UnmarshalTOML(""))
+	require.Nil(t, keys)
+
+	require.NoError(t, keys.UnmarshalTOML(`{"key1": "secret"}`))
+	require.Equal(t, Keys{"key1": "secret"}, keys)
+
+	require.Error(t, keys.UnmarshalTOML(42))
+}
+
+func TestKeyring(t *testing.T) {
+	key1 := newTestKey(t)
+	key2 := newTestKey(t)
+	aad := []byte("jobID")
+
+	k1, err := NewKeyring(Config{Enable: true, ActiveKeyID: "key1", Keys: Keys{"key1": key1}})
+	require.NoError(t, err)
+	require.True(t, k1.Enabled())
+	require.Equal(t, "key1", k1.ActiveKeyID())
+
+	env, err := k1.Encrypt([]byte("secret data"), aad)
+	require.NoError(t, err)
+	require.Equal(t, "key1", env.KeyID)
+	require.NotContains(t, string(env.Ciphertext), "secret data")
+
+	t.Run("decrypt", func(t *testing.T) {
+		data, err := k1.Decrypt(env, aad)
+		require.NoError(t, err)
+		require.Equal(t, "secret data", string(data))
+	})
+
+	t.Run("unique data keys", func(t *testing.T) {
+		other, err := k1.Encrypt([]byte("secret data"), aad)
+		require.NoError(t, err)
+		require.NotEqual(t, env.EncryptedKey, other.EncryptedKey)
+		require.NotEqual(t, env.Ciphertext, other.Ciphertext)
+	})
+
+	t.Run("wrong additional data", func(t *testing.T) {
+		_, err := k1.Decrypt(env, []byte("otherJobID"))
+		require.EqualError(t, err, "failed to decrypt data: cipher: message authentication failed")
+	})
+
+	t.Run("tampered key ID", func(t *testing.T) {
+		k, err := NewKeyring(Config{Enable: true, ActiveKeyID: "key1", Keys: Keys{"key1": key1, "key2": key1}})
+		require.NoError(t, err)
+		tampered := *env
+		tampered.KeyID = "key2"
+		_, err = k.Decrypt(&tampered, aad)
+		require.EqualError(t, err, "failed to decrypt data key: cipher: message authentication failed")
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		k2, err := NewKeyring(Config{Enable: true, ActiveKeyID: "key2", Keys: Keys{"key1": key1, "key2": key2}})
+		require.NoError(t, err)
+
+		// Data encrypted with the previous key can still be decrypted.
+		data, err := k2.Decrypt(env, aad)
+		require.NoError(t, err)
+		require.Equal(t, "secret data", string(data))
+
+		newEnv, err := k2.Encrypt(data, aad)
+		require.NoError(t, err)
+		require.Equal(t, "key2", newEnv.KeyID)
+
+		_, err = k1.Decrypt(newEnv, aad)
+		require.EqualError(t, err, `key "key2" not found`)
+	})
+
+	t.Run("decrypt only", func(t *testing.T) {
+		k, err := NewKeyring(Config{Keys: Keys{"key1": key1}})
+		require.NoError(t, err)
+		require.False(t, k.Enabled())
+
+		data, err := k.Decrypt(env, aad)
+		require.NoError(t, err)
+		require.Equal(t, "secret data", string(data))
+
+		_, err = k.Encrypt(data, aad)
+		require.EqualError(t, err, "encryption is not enabled")
+	})
+
+	t.Run("keys file", func(t *testing.T) {
+		keysFile := filepath.Join(t.TempDir(), "keys.json")
+		err := os.WriteFile(keysFile, []byte(`{"key1": "`+key1+`"}`), 0600)
+		require.NoError(t, err)
+
+		k, err := NewKeyring(Config{Enable: true, ActiveKeyID: "key1", KeysFile: keysFile})
+		require.NoError(t, err)
+
+		data, err := k.Decrypt(env, aad)
+		require.NoError(t, err)
+		require.Equal(t, "secret data", string(data))
+	})
+}
@@ -5,36 +5,164 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/mattermost/calls-offloader/public/job"
+	"github.com/mattermost/calls-offloader/service/auth"
+	"github.com/mattermost/calls-offloader/service/encryption"
+	"github.com/mattermost/calls-offloader/service/store"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
 )
 
 const jobKeyPrefix = "job_"
 
+// jobRecordExpiration returns the time, in Unix milliseconds, at which the
+// record of the given job should expire. Zero is returned for running jobs or
+// if records should be kept indefinitely.
+func (s *Service) jobRecordExpiration(j job.Job) int64 {
+	retention := s.cfg.Jobs.GetJobRecordsRetentionTime()
+	if j.StopAt == 0 || retention <= 0 {
+		return 0
+	}
+	return time.UnixMilli(j.StopAt).Add(retention).UnixMilli()
+}
+
+// jobRecordTTL returns the time left before the record of the given job
+// should expire. Zero is returned for running jobs or if records should be
+// kept indefinitely.
+func (s *Service) jobRecordTTL(j job.Job) time.Duration {
+	expiresAt := s.jobRecordExpiration(j)
+	if expiresAt == 0 {
+		return 0
+	}
+
+	// Records past their retention expire right away, zero would mean never.
+	return max(time.Until(time.UnixMilli(expiresAt)), time.Millisecond)
+}
+
+// jobRecord is the representation of a job in the store. When encryption is
+// enabled the input data, which carries credentials, is only saved encrypted.
+type jobRecord struct {
+	job.Job
+	EncryptedInputData *encryption.Envelope `json:"encrypted_input_data,omitempty"`
+	// The time, in Unix milliseconds, at which the record was set to expire
+	// when saved, if ever.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// needsReencryption returns whether the record's input data isn't saved as
+// currently configured: in cleartext while encryption is enabled, with a key
+// other than the active one, or encrypted (or holding secrets) while
+// encryption is disabled.
+func (s *Service) needsReencryption(rec jobRecord) bool {
+	if s.keyring == nil || !s.keyring.Enabled() {
+		return rec.EncryptedInputData != nil || rec.InputData.HasSecrets(rec.Type)
+	}
+	if rec.EncryptedInputData != nil {
+		return rec.EncryptedInputData.KeyID != s.keyring.ActiveKeyID()
+	}
+	return len(rec.InputData) > 0
+}
+
+// SaveJob saves the job to the store. Secret input data, which is only needed
+// to start the job, is saved encrypted if encryption is enabled and dropped
+// otherwise.
 func (s *Service) SaveJob(job job.Job) error {
-	js, err := json.Marshal(&job)
+	rec := jobRecord{Job: job}
+
+	if s.keyring != nil && s.keyring.Enabled() && len(job.InputData) > 0 {
+		data, err := json.Marshal(job.InputData)
+		if err != nil {
+			return fmt.Errorf("failed to marshal input data: %w", err)
+		}
+		// Binding the ciphertext to the job so that it can't be moved to a
+		// different record.
+		rec.EncryptedInputData, err = s.keyring.Encrypt(data, []byte(job.ID))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt input data: %w", err)
+		}
+		rec.InputData = nil
+	} else {
+		rec.InputData = job.InputData.WithoutSecrets(job.Type)
+	}
+
+	rec.ExpiresAt = s.jobRecordExpiration(job)
+
+	js, err := json.Marshal(&rec)
 	if err != nil {
 		return fmt.Errorf("failed to marshal: %w", err)
 	}
-	if err := s.store.Set(jobKeyPrefix+job.ID, string(js)); err != nil {
+
+	if ttl := s.jobRecordTTL(job); ttl > 0 {
+		err = s.store.SetWithTTL(jobKeyPrefix+job.ID, string(js), ttl)
+	} else {
+		err = s.store.Set(jobKeyPrefix+job.ID, string(js))
+	}
+	if err != nil {
 		return fmt.Errorf("failed to save to store: %w", err)
 	}
+
 	return nil
 }
 
-func (s *Service) GetJob(jobID string) (job.Job, error) {
+func (s *Service) getJobRecord(jobID string) (jobRecord, error) {
 	js, err := s.store.Get(jobKeyPrefix + jobID)
 	if err != nil {
-		return job.Job{}, fmt.Errorf("failed to get job: %w", err)
+		return jobRecord{}, fmt.Errorf("failed to get job: %w", err)
 	}
 
-	var j job.Job
-	if err := json.Unmarshal([]byte(js), &j); err != nil {
-		return job.Job{}, fmt.Errorf("failed to unmarshal: %w", err)
+	var rec jobRecord
+	if err := json.Unmarshal([]byte(js), &rec); err != nil {
+		return jobRecord{}, fmt.Errorf("failed to unmarshal: %w", err)
 	}
 
-	return j, nil
+	return rec, nil
+}
+
+// getJobOwner returns the ID of the client that created the given job if
+// clientID, granted the given scopes, is allowed to access it. That is if it
+// created the job or was granted the jobs:admin scope. Jobs the client can't
+// access are reported as not found so that their existence isn't disclosed.
+// Jobs saved before their client was recorded have no owner and remain
+// accessible to any client, as they were before, until their record expires
+// or gets deleted.
+func (s *Service) getJobOwner(clientID string, scopes []auth.Scope, jobID string) (string, error) {
+	rec, err := s.getJobRecord(jobID)
+	if err != nil {
+		return "", err
+	}
+
+	if rec.ClientID != "" && rec.ClientID != clientID && !auth.HasScope(scopes, auth.ScopeJobsAdmin) {
+		return "", fmt.Errorf("failed to get job: %w", store.ErrNotFound)
+	}
+
+	return rec.ClientID, nil
+}
+
+func (s *Service) GetJob(jobID string) (job.Job, error) {
+	rec, err := s.getJobRecord(jobID)
+	if err != nil {
+		return job.Job{}, err
+	}
+
+	if rec.EncryptedInputData != nil {
+		if s.keyring == nil {
+			return job.Job{}, errors.New("failed to decrypt input data: no encryption keys configured")
+		}
+		data, err := s.keyring.Decrypt(rec.EncryptedInputData, []byte(jobID))
+		if err != nil {
+			return job.Job{}, fmt.Errorf("failed to decrypt input data: %w", err)
+		}
+		if err := json.Unmarshal(data, &rec.InputData); err != nil {
+			return job.Job{}, fmt.Errorf("failed to unmarshal input data: %w", err)
+		}
+	}
+
+	return rec.Job, nil
 }
 
 func (s *Service) DeleteJob(jobID string) error {
@@ -43,3 +171,120 @@ func (s *Service) DeleteJob(jobID string) error {
 	}
 	return nil
 }
+
+// deleteJob removes the resources of a job created by the given client
+// through the job service and then its record from the store. Resources
+// already gone (e.g. removed by retention) only have their record deleted. If
+// the job service fails the record is kept so that deletion can be retried.
+func (s *Service) deleteJob(clientID, jobID string) error {
+	if err := s.jobService.DeleteJob(clientID, jobID); err != nil && !errors.Is(err, job.ErrNotFound) {
+		return err
+	}
+	return s.DeleteJob(jobID)
+}
+
+// updateJob applies fn to the job and saves it, holding jobsMut so that
+// concurrent updates of the same record aren't lost.
+func (s *Service) updateJob(jobID string, fn func(j *job.Job) bool) error {
+	s.jobsMut.Lock()
+	defer s.jobsMut.Unlock()
+
+	j, err := s.GetJob(jobID)
+	if err != nil {
+		return err
+	}
+
+	if !fn(&j) {
+		return nil
+	}
+
+	return s.SaveJob(j)
+}
+
+// setJobStopped records the time the job stopped, unless already set.
+func (s *Service) setJobStopped(jobID string) error {
+	return s.updateJob(jobID, func(j *job.Job) bool {
+		if j.StopAt != 0 {
+			return false
+		}
+		j.StopAt = time.Now().UnixMilli()
+		return true
+	})
+}
+
+// expireJobRecords sets the expiration of the records of stopped jobs which
+// were saved without one (e.g. by previous versions) or with one that no
+// longer matches the retention time. Records past their expiration, which
+// lost it along the way (e.g. when migrated from a bitcask store), are
+// deleted.
+// It returns the number of records saved.
+func (s *Service) expireJobRecords() (int, error) {
+	if s.cfg.Jobs.GetJobRecordsRetentionTime() <= 0 {
+		return 0, nil
+	}
+
+	var n int
+	now := time.Now().UnixMilli()
+	err := s.store.Scan(jobKeyPrefix, func(key, value string) error {
+		var rec jobRecord
+		if err := json.Unmarshal([]byte(value), &rec); err != nil {
+			return nil
+		}
+		if expiresAt := s.jobRecordExpiration(rec.Job); rec.ExpiresAt == expiresAt {
+			if expiresAt != 0 && expiresAt <= now {
+				if err := s.store.Delete(key); err != nil {
+					s.log.Warn("failed to delete expired job record", mlog.String("key", key), mlog.Err(err))
+				}
+			}
+			return nil
+		}
+		if err := s.updateJob(strings.TrimPrefix(key, jobKeyPrefix), func(j *job.Job) bool {
+			return j.StopAt != 0
+		}); err != nil {
+			s.log.Warn("failed to expire job record", mlog.String("key", key), mlog.Err(err))
+			return nil
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to expire job records: %w", err)
+	}
+
+	if n > 0 {
+		s.log.Info("set expiration of job records", mlog.Int("count", n))
+	}
+
+	return n, nil
+}
+
+// reencryptJobRecords saves again the job records whose input data isn't
+// encrypted as configured (e.g. after enabling encryption or rotating keys)
+// or which still hold cleartext secrets.
+// It returns the number of records saved.
+func (s *Service) reencryptJobRecords() (int, error) {
+	var n int
+	err := s.store.Scan(jobKeyPrefix, func(key, value string) error {
+		var rec jobRecord
+		if err := json.Unmarshal([]byte(value), &rec); err != nil || !s.needsReencryption(rec) {
+			return nil
+		}
+		if err := s.updateJob(strings.TrimPrefix(key, jobKeyPrefix), func(_ *job.Job) bool {
+			return true
+		}); err != nil {
+			s.log.Warn("failed to re-encrypt job record", mlog.String("key", key), mlog.Err(err))
+			return nil
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to re-encrypt job records: %w", err)
+	}
+
+	if n > 0 {
+		s.log.Info("re-encrypted job records", mlog.Int("count", n))
+	}
+
+	return n, nil
+}
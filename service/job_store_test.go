@@ -0,0 +1,352 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mattermost/calls-offloader/public/job"
+	"github.com/mattermost/calls-offloader/service/encryption"
+	"github.com/mattermost/calls-offloader/service/store"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+	"github.com/stretchr/testify/require"
+)
+
+type deleteJobServiceMock struct {
+	JobService
+	err error
+}
+
+func (m *deleteJobServiceMock) DeleteJob(_, _ string) error {
+	return m.err
+}
+
+func newJobStoreTestService(t *testing.T) *Service {
+	t.Helper()
+
+	st, err := store.New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, st.Close())
+	})
+
+	s := &Service{
+		store: st,
+		log:   mlog.CreateConsoleTestLogger(t),
+	}
+	s.cfg.Jobs.JobRecordsRetentionTime = RetentionTime(time.Hour)
+
+	return s
+}
+
+func TestJobRecordTTL(t *testing.T) {
+	s := newJobStoreTestService(t)
+
+	t.Run("running", func(t *testing.T) {
+		require.Zero(t, s.jobRecordTTL(job.Job{StartAt: time.Now().UnixMilli()}))
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		ttl := s.jobRecordTTL(job.Job{StopAt: time.Now().Add(-10 * time.Minute).UnixMilli()})
+		require.InDelta(t, 50*time.Minute, ttl, float64(time.Second))
+	})
+
+	t.Run("past retention", func(t *testing.T) {
+		ttl := s.jobRecordTTL(job.Job{StopAt: time.Now().Add(-2 * time.Hour).UnixMilli()})
+		require.Equal(t, time.Millisecond, ttl)
+	})
+
+	t.Run("keep indefinitely", func(t *testing.T) {
+		s.cfg.Jobs.JobRecordsRetentionTime = 0
+		defer func() {
+			s.cfg.Jobs.JobRecordsRetentionTime = RetentionTime(time.Hour)
+		}()
+		require.Zero(t, s.jobRecordTTL(job.Job{StopAt: time.Now().Add(-2 * time.Hour).UnixMilli()}))
+	})
+}
+
+func TestSaveJobExpiration(t *testing.T) {
+	s := newJobStoreTestService(t)
+
+	err := s.SaveJob(job.Job{ID: "running", StartAt: time.Now().UnixMilli()})
+	require.NoError(t, err)
+	err = s.SaveJob(job.Job{ID: "expired", StopAt: time.Now().Add(-2 * time.Hour).UnixMilli()})
+	require.NoError(t, err)
+	err = s.SaveJob(job.Job{ID: "stopped", StopAt: time.Now().UnixMilli()})
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, s.store.DeleteExpired())
+
+	_, err = s.GetJob("running")
+	require.NoError(t, err)
+	_, err = s.GetJob("stopped")
+	require.NoError(t, err)
+	_, err = s.GetJob("expired")
+	require.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestExpireJobRecords(t *testing.T) {
+	s := newJobStoreTestService(t)
+
+	// Records saved without an expiration, as done by previous versions.
+	for id, stopAt := range map[string]int64{
+		"running": 0,
+		"expired": time.Now().Add(-2 * time.Hour).UnixMilli(),
+		"stopped": time.Now().UnixMilli(),
+	} {
+		err := s.store.Set(jobKeyPrefix+id, fmt.Sprintf(`{"id":%q,"stop_at":%d}`, id, stopAt))
+		require.NoError(t, err)
+	}
+	err := s.store.Set(jobKeyPrefix+"invalid", "not json")
+	require.NoError(t, err)
+
+	// Running jobs and invalid records are left alone.
+	n, err := s.expireJobRecords()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// Records already expiring as configured aren't saved again.
+	n, err = s.expireJobRecords()
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, s.store.DeleteExpired())
+
+	n, err = s.store.Count(jobKeyPrefix)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	_, err = s.GetJob("expired")
+	require.ErrorIs(t, err, store.ErrNotFound)
+
+	// Changing the retention time updates the expiration of existing records.
+	s.cfg.Jobs.JobRecordsRetentionTime = s.cfg.Jobs.JobRecordsRetentionTime * 2
+	n, err = s.expireJobRecords()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// Records past their expiration which lost it, as done when migrating
+	// from bitcask, are deleted.
+	stopAt := time.Now().Add(-3 * time.Hour).UnixMilli()
+	expiresAt := s.jobRecordExpiration(job.Job{StopAt: stopAt})
+	err = s.store.Set(jobKeyPrefix+"migrated", fmt.Sprintf(`{"id":"migrated","stop_at":%d,"expires_at":%d}`, stopAt, expiresAt))
+	require.NoError(t, err)
+	n, err = s.expireJobRecords()
+	require.NoError(t, err)
+	require.Zero(t, n)
+	_, err = s.GetJob("migrated")
+	require.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestDeleteJob(t *testing.T) {
+	s := newJobStoreTestService(t)
+	jobService := &deleteJobServiceMock{}
+	s.jobService = jobService
+
+	saveJob := func(id string) {
+		t.Helper()
+		err := s.SaveJob(job.Job{ID: id, StopAt: time.Now().UnixMilli()})
+		require.NoError(t, err)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		saveJob("jobA")
+		err := s.deleteJob("clientA", "jobA")
+		require.NoError(t, err)
+		_, err = s.GetJob("jobA")
+		require.ErrorIs(t, err, store.ErrNotFound)
+	})
+
+	t.Run("resources already removed", func(t *testing.T) {
+		jobService.err = fmt.Errorf("failed to get container: %w", job.ErrNotFound)
+		saveJob("jobB")
+		err := s.deleteJob("clientA", "jobB")
+		require.NoError(t, err)
+		_, err = s.GetJob("jobB")
+		require.ErrorIs(t, err, store.ErrNotFound)
+	})
+
+	t.Run("job service failure", func(t *testing.T) {
+		jobService.err = errors.New("service unavailable")
+		saveJob("jobC")
+		err := s.deleteJob("clientA", "jobC")
+		require.EqualError(t, err, "service unavailable")
+		_, err = s.GetJob("jobC")
+		require.NoError(t, err)
+	})
+}
+
+func newTestEncryptionKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, encryption.KeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestJobInputDataEncryption(t *testing.T) {
+	s := newJobStoreTestService(t)
+	key1 := newTestEncryptionKey(t)
+	key2 := newTestEncryptionKey(t)
+
+	setKeyring := func(cfg encryption.Config) {
+		t.Helper()
+		if !cfg.HasKeys() {
+			s.keyring = nil
+			return
+		}
+		var err error
+		s.keyring, err = encryption.NewKeyring(cfg)
+		require.NoError(t, err)
+	}
+
+	getRecord := func(id string) jobRecord {
+		t.Helper()
+		rec, err := s.getJobRecord(id)
+		require.NoError(t, err)
+		return rec
+	}
+
+	inputData := job.InputData{
+		"site_url":   "http://localhost:8065",
+		"auth_token": "secretToken",
+	}
+
+	setKeyring(encryption.Config{Enable: true, ActiveKeyID: "key1", Keys: encryption.Keys{"key1": key1}})
+
+	t.Run("round trip", func(t *testing.T) {
+		err := s.SaveJob(job.Job{ID: "jobA", Config: job.Config{InputData: inputData}})
+		require.NoError(t, err)
+
+		val, err := s.store.Get(jobKeyPrefix + "jobA")
+		require.NoError(t, err)
+		require.NotContains(t, val, "secretToken")
+		require.NotContains(t, val, `"input_data"`)
+
+		rec := getRecord("jobA")
+		require.Nil(t, rec.InputData)
+		require.Equal(t, "key1", rec.EncryptedInputData.KeyID)
+
+		j, err := s.GetJob("jobA")
+		require.NoError(t, err)
+		require.Equal(t, inputData, j.InputData)
+	})
+
+	t.Run("no input data", func(t *testing.T) {
+		err := s.SaveJob(job.Job{ID: "jobB"})
+		require.NoError(t, err)
+		require.Nil(t, getRecord("jobB").EncryptedInputData)
+	})
+
+	t.Run("moved record", func(t *testing.T) {
+		val, err := s.store.Get(jobKeyPrefix + "jobA")
+		require.NoError(t, err)
+		require.NoError(t, s.store.Set(jobKeyPrefix+"jobC", val))
+
+		_, err = s.GetJob("jobC")
+		require.EqualError(t, err, "failed to decrypt input data: failed to decrypt data: cipher: message authentication failed")
+		require.NoError(t, s.store.Delete(jobKeyPrefix+"jobC"))
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		setKeyring(encryption.Config{Enable: true, ActiveKeyID: "key2", Keys: encryption.Keys{"key1": key1, "key2": key2}})
+
+		// Records encrypted with the previous key are still readable.
+		j, err := s.GetJob("jobA")
+		require.NoError(t, err)
+		require.Equal(t, inputData, j.InputData)
+
+		n, err := s.reencryptJobRecords()
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		require.Equal(t, "key2", getRecord("jobA").EncryptedInputData.KeyID)
+
+		n, err = s.reencryptJobRecords()
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		// The previous key can now be removed.
+		setKeyring(encryption.Config{Enable: true, ActiveKeyID: "key2", Keys: encryption.Keys{"key2": key2}})
+		j, err = s.GetJob("jobA")
+		require.NoError(t, err)
+		require.Equal(t, inputData, j.InputData)
+	})
+
+	t.Run("missing keys", func(t *testing.T) {
+		setKeyring(encryption.Config{})
+		_, err := s.GetJob("jobA")
+		require.EqualError(t, err, "failed to decrypt input data: no encryption keys configured")
+	})
+
+	t.Run("enabling encryption", func(t *testing.T) {
+		// Secrets are dropped when saved without encryption.
+		err := s.SaveJob(job.Job{ID: "jobD", Config: job.Config{InputData: inputData}})
+		require.NoError(t, err)
+		require.Equal(t, job.InputData{"site_url": "http://localhost:8065"}, getRecord("jobD").InputData)
+
+		setKeyring(encryption.Config{Enable: true, ActiveKeyID: "key2", Keys: encryption.Keys{"key2": key2}})
+		n, err := s.reencryptJobRecords()
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		require.Nil(t, getRecord("jobD").InputData)
+		require.Equal(t, "key2", getRecord("jobD").EncryptedInputData.KeyID)
+	})
+
+	t.Run("disabling encryption", func(t *testing.T) {
+		setKeyring(encryption.Config{Keys: encryption.Keys{"key2": key2}})
+		n, err := s.reencryptJobRecords()
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+
+		for _, id := range []string{"jobA", "jobD"} {
+			rec := getRecord(id)
+			require.Nil(t, rec.EncryptedInputData)
+			require.Equal(t, job.InputData{"site_url": "http://localhost:8065"}, rec.InputData)
+		}
+	})
+}
+
+func TestSaveJobSecrets(t *testing.T) {
+	s := newJobStoreTestService(t)
+
+	cfg := job.Config{
+		Type: job.TypeRecording,
+		InputData: job.InputData{
+			"site_url":   "http://localhost:8065",
+			"auth_token": "secretToken",
+			"call_id":    "callID",
+		},
+	}
+
+	err := s.SaveJob(job.Job{ID: "jobA", Config: cfg})
+	require.NoError(t, err)
+
+	val, err := s.store.Get(jobKeyPrefix + "jobA")
+	require.NoError(t, err)
+	require.NotContains(t, val, "secretToken")
+
+	j, err := s.GetJob("jobA")
+	require.NoError(t, err)
+	require.Equal(t, job.InputData{"site_url": "http://localhost:8065", "call_id": "callID"}, j.InputData)
+
+	t.Run("legacy records", func(t *testing.T) {
+		err := s.store.Set(jobKeyPrefix+"jobB", `{"id":"jobB","type":"recording","input_data":{"auth_token":"secretToken","call_id":"callID"}}`)
+		require.NoError(t, err)
+
+		n, err := s.reencryptJobRecords()
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+
+		val, err := s.store.Get(jobKeyPrefix + "jobB")
+		require.NoError(t, err)
+		require.NotContains(t, val, "secretToken")
+	})
+}
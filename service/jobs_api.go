@@ -5,12 +5,14 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"time"
 
 	"github.com/mattermost/calls-offloader/public/job"
+	"github.com/mattermost/calls-offloader/service/auth"
+	"github.com/mattermost/calls-offloader/service/schema"
 
 	"github.com/gorilla/mux"
 
@@ -21,7 +23,7 @@ func (s *Service) handleCreateJob(w http.ResponseWriter, r *http.Request) {
 	data := newHTTPData()
 	defer s.httpAudit("handleCreateJob", data, w, r)
 
-	clientID, code, err := s.authHandler(r)
+	clientID, code, err := s.authorize(w, r, auth.ScopeJobsCreate)
 	if err != nil {
 		data.err = err.Error()
 		data.code = code
@@ -42,30 +44,45 @@ func (s *Service) handleCreateJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	job, err := s.jobService.CreateJob(cfg, func(job job.Job, success bool) error {
-		s.log.Info("job stopped", mlog.String("jobID", job.ID))
-
-		job, err := s.GetJob(job.ID)
-		if err != nil {
-			return err
+	// Input data is passed to jobs as environment variables, so it's checked
+	// here to fail early rather than when the job service creates the job.
+	if _, err := cfg.InputData.ToEnvMap(s.cfg.Jobs.InputDataEnvPrefix); err != nil {
+		var envErr *job.InputDataEnvError
+		if errors.As(err, &envErr) {
+			data.resData["errors"] = envErr.Errors
 		}
+		data.err = err.Error()
+		data.code = http.StatusBadRequest
+		return
+	}
 
-		if job.StopAt == 0 {
-			job.StopAt = time.Now().UnixMilli()
-			if err := s.SaveJob(job); err != nil {
-				return err
+	if s.schemas != nil {
+		if err := s.schemas.Validate(cfg); err != nil {
+			var ve *schema.ValidationError
+			if errors.As(err, &ve) {
+				data.resData["errors"] = ve.Errors
+				data.code = http.StatusBadRequest
+			} else {
+				data.code = http.StatusInternalServerError
 			}
+			data.err = err.Error()
+			return
+		}
+	}
+
+	job, err := s.jobService.CreateJob(clientID, cfg, func(job job.Job, success bool) error {
+		s.log.Info("job stopped", mlog.String("jobID", job.ID))
+
+		if err := s.setJobStopped(job.ID); err != nil {
+			return err
 		}
 
 		if success {
 			s.log.Debug("job completed successfully, removing",
 				mlog.String("jobID", job.ID))
-			if err := s.jobService.DeleteJob(job.ID); err != nil {
+			if err := s.deleteJob(clientID, job.ID); err != nil {
 				return fmt.Errorf("failed to delete recording job: %w", err)
 			}
-			if err := s.DeleteJob(job.ID); err != nil {
-				return err
-			}
 		}
 
 		return nil
@@ -76,6 +93,7 @@ func (s *Service) handleCreateJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	job.ClientID = clientID
 	if err := s.SaveJob(job); err != nil {
 		data.err = "failed to save job: " + err.Error()
 		data.code = http.StatusInternalServerError
@@ -84,7 +102,7 @@ func (s *Service) handleCreateJob(w http.ResponseWriter, r *http.Request) {
 
 	data.code = http.StatusOK
 
-	if err := json.NewEncoder(w).Encode(job); err != nil {
+	if err := json.NewEncoder(w).Encode(job.Redacted()); err != nil {
 		s.log.Error("failed to encode response", mlog.Err(err))
 	}
 }
@@ -92,7 +110,7 @@ func (s *Service) handleCreateJob(w http.ResponseWriter, r *http.Request) {
 func (s *Service) handleGetJob(w http.ResponseWriter, r *http.Request) {
 	data := newHTTPData()
 	defer s.httpAudit("handleGetJob", data, w, r)
-	clientID, code, err := s.authHandler(r)
+	clientID, scopes, code, err := s.authorizeScopes(w, r, auth.ScopeJobsRead)
 	if err != nil {
 		data.err = err.Error()
 		data.code = code
@@ -107,6 +125,12 @@ func (s *Service) handleGetJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := s.getJobOwner(clientID, scopes, jobID); err != nil {
+		data.err = "failed to get job " + err.Error()
+		data.code = http.StatusNotFound
+		return
+	}
+
 	job, err := s.GetJob(jobID)
 	if err != nil {
 		data.err = "failed to get job " + err.Error()
@@ -116,7 +140,7 @@ func (s *Service) handleGetJob(w http.ResponseWriter, r *http.Request) {
 
 	data.code = http.StatusOK
 
-	if err := json.NewEncoder(w).Encode(job); err != nil {
+	if err := json.NewEncoder(w).Encode(job.Redacted()); err != nil {
 		s.log.Error("failed to encode response", mlog.Err(err))
 	}
 }
@@ -125,7 +149,7 @@ func (s *Service) handleJobGetLogs(w http.ResponseWriter, r *http.Request) {
 	data := newHTTPData()
 	defer s.httpAudit("handleJobGetLogs", data, w, r)
 
-	clientID, code, err := s.authHandler(r)
+	clientID, scopes, code, err := s.authorizeScopes(w, r, auth.ScopeJobsLogs)
 	if err != nil {
 		data.err = err.Error()
 		data.code = code
@@ -140,10 +164,30 @@ func (s *Service) handleJobGetLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.jobService.GetJobLogs(jobID, io.Discard, w)
+	ownerID, err := s.getJobOwner(clientID, scopes, jobID)
 	if err != nil {
+		data.err = "failed to get job " + err.Error()
+		data.code = http.StatusNotFound
+		return
+	}
+
+	opts := job.LogsOptions{
+		Container: r.URL.Query().Get("container"),
+	}
+
+	cw := &countingWriter{w: w}
+	err = s.jobService.GetJobLogs(ownerID, jobID, io.Discard, cw, opts)
+	if err != nil && cw.n > 0 {
+		// The status has already been sent along with part of the logs.
+		s.log.Error("failed to write job logs", mlog.Err(err), mlog.String("jobID", jobID))
+		data.code = http.StatusOK
+		return
+	} else if err != nil {
 		data.err = "failed to get recording job logs: " + err.Error()
-		data.code = http.StatusForbidden
+		data.code = http.StatusInternalServerError
+		if errors.Is(err, job.ErrNotFound) || errors.Is(err, job.ErrContainerNotFound) {
+			data.code = http.StatusNotFound
+		}
 		return
 	}
 
@@ -154,7 +198,7 @@ func (s *Service) handleDeleteJob(w http.ResponseWriter, r *http.Request) {
 	data := newHTTPData()
 	defer s.httpAudit("handleDeleteJob", data, w, r)
 
-	clientID, code, err := s.authHandler(r)
+	clientID, scopes, code, err := s.authorizeScopes(w, r, auth.ScopeJobsDelete)
 	if err != nil {
 		data.err = err.Error()
 		data.code = code
@@ -169,6 +213,12 @@ func (s *Service) handleDeleteJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := s.getJobOwner(clientID, scopes, jobID); err != nil {
+		data.err = "failed to get job " + err.Error()
+		data.code = http.StatusNotFound
+		return
+	}
+
 	job, err := s.GetJob(jobID)
 	if err != nil {
 		data.err = "failed to get job " + err.Error()
@@ -183,7 +233,7 @@ func (s *Service) handleDeleteJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.jobService.DeleteJob(jobID)
+	err = s.deleteJob(job.ClientID, jobID)
 	if err != nil {
 		data.err = "failed to delete recording job: " + err.Error()
 		data.code = http.StatusInternalServerError
@@ -197,7 +247,7 @@ func (s *Service) handleInit(w http.ResponseWriter, r *http.Request) {
 	data := newHTTPData()
 	defer s.httpAudit("handleInit", data, w, r)
 
-	clientID, code, err := s.authHandler(r)
+	clientID, code, err := s.authorize(w, r, auth.ScopeRunnersInit)
 	if err != nil {
 		data.err = err.Error()
 		data.code = code
@@ -226,3 +276,69 @@ func (s *Service) handleInit(w http.ResponseWriter, r *http.Request) {
 
 	data.code = http.StatusOK
 }
+
+func (s *Service) handleGetInitStatus(w http.ResponseWriter, r *http.Request) {
+	data := newHTTPData()
+	defer s.httpAudit("handleGetInitStatus", data, w, r)
+
+	clientID, code, err := s.authorize(w, r, auth.ScopeJobsRead)
+	if err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+	data.clientID = clientID
+
+	status, err := s.jobService.GetInitStatus()
+	if err != nil {
+		data.err = "failed to get job service status: " + err.Error()
+		data.code = http.StatusInternalServerError
+		return
+	}
+
+	data.code = http.StatusOK
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.log.Error("failed to encode response", mlog.Err(err))
+	}
+}
+
+func (s *Service) handleGetJobSchemas(w http.ResponseWriter, r *http.Request) {
+	data := newHTTPData()
+	defer s.httpAudit("handleGetJobSchemas", data, w, r)
+
+	clientID, code, err := s.authorize(w, r, auth.ScopeJobsRead)
+	if err != nil {
+		data.err = err.Error()
+		data.code = code
+		return
+	}
+	data.clientID = clientID
+
+	schemas := job.InputDataSchemas{}
+	if s.schemas != nil {
+		schemas = s.schemas.Schemas()
+	}
+
+	data.code = http.StatusOK
+
+	if err := json.NewEncoder(w).Encode(schemas); err != nil {
+		s.log.Error("failed to encode response", mlog.Err(err))
+	}
+}
+
+// countingWriter keeps track of the number of bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	// Empty writes would still commit the response status.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
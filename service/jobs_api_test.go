@@ -0,0 +1,295 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattermost/calls-offloader/public/job"
+	"github.com/mattermost/calls-offloader/service/auth"
+	"github.com/mattermost/calls-offloader/service/schema"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+type createJobServiceMock struct {
+	JobService
+	logsErr error
+	// logs is written to stderr before returning logsErr.
+	logs string
+	// ownerID is the client ID last passed to the job service.
+	ownerID string
+}
+
+func (m *createJobServiceMock) CreateJob(_ string, cfg job.Config, _ job.StopCb) (job.Job, error) {
+	return job.Job{
+		ID:      "abcdefghijklmnopqrstuvwxyz",
+		Config:  cfg,
+		StartAt: time.Now().UnixMilli(),
+	}, nil
+}
+
+func (m *createJobServiceMock) GetJobLogs(clientID, _ string, _, stderr io.Writer, _ job.LogsOptions) error {
+	m.ownerID = clientID
+	if _, err := io.WriteString(stderr, m.logs); err != nil {
+		return err
+	}
+	return m.logsErr
+}
+
+func (m *createJobServiceMock) DeleteJob(clientID, _ string) error {
+	m.ownerID = clientID
+	return nil
+}
+
+func newJobsAPITestService(t *testing.T) *Service {
+	t.Helper()
+
+	s := newJobStoreTestService(t)
+	s.jobService = &createJobServiceMock{}
+	s.cfg.Jobs.ImageRegistry = job.ImageRegistryDefault
+	s.cfg.API.Security.EnableAdmin = true
+	s.cfg.API.Security.AdminSecretKey = "admin_secret_key"
+
+	var err error
+	s.lockouts, err = auth.NewLockoutTracker(auth.LockoutConfig{})
+	require.NoError(t, err)
+	s.sessions, err = auth.NewSessionCache(auth.SessionCacheConfig{ExpirationMinutes: 1440}, nil)
+	require.NoError(t, err)
+	s.auth, err = auth.NewService(s.store, s.sessions)
+	require.NoError(t, err)
+
+	return s
+}
+
+func TestJobsAPIInputDataValidation(t *testing.T) {
+	s := newJobsAPITestService(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "recording"), 0700))
+	err := os.WriteFile(filepath.Join(dir, "recording", "v0.6.0.json"), []byte(`{
+  "type": "object",
+  "properties": {"call_id": {"type": "string"}},
+  "required": ["call_id"]
+}`), 0600)
+	require.NoError(t, err)
+	s.schemas, err = schema.Load(dir)
+	require.NoError(t, err)
+
+	createJob := func(inputData job.InputData) *httptest.ResponseRecorder {
+		t.Helper()
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(job.Config{
+			Type:           job.TypeRecording,
+			Runner:         "mattermost/calls-recorder:v0.6.2",
+			MaxDurationSec: 60,
+			InputData:      inputData,
+		})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("POST", "/jobs", &buf)
+		req.SetBasicAuth("", "admin_secret_key")
+		w := httptest.NewRecorder()
+		s.handleCreateJob(w, req)
+		return w
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		w := createJob(job.InputData{"call_id": "callID", "auth_token": "secretToken"})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NotContains(t, w.Body.String(), "secretToken")
+
+		var j job.Job
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&j))
+		require.Equal(t, job.InputData{"call_id": "callID", "auth_token": job.InputDataRedactedValue}, j.InputData)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := createJob(job.InputData{"call_id": 45, "auth_token": "secretToken"})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.NotContains(t, w.Body.String(), "secretToken")
+
+		var resp struct {
+			Error  string                    `json:"error"`
+			Errors []job.InputDataFieldError `json:"errors"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, "invalid input data for recording v0.6.0: /call_id: expected string, but got number", resp.Error)
+		require.Equal(t, []job.InputDataFieldError{{Field: "/call_id", Message: "expected string, but got number"}}, resp.Errors)
+	})
+
+	t.Run("invalid env", func(t *testing.T) {
+		w := createJob(job.InputData{"call_id": "callID", "dev_mode": true, "post-id": "postID"})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		var resp struct {
+			Errors []job.InputDataFieldError `json:"errors"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, []job.InputDataFieldError{
+			{Field: "/dev_mode", Message: "DEV_MODE is a reserved environment variable"},
+			{Field: "/post-id", Message: "key should start with a letter and only contain letters, digits and underscores"},
+		}, resp.Errors)
+	})
+
+	t.Run("get schemas", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/jobs/schemas", nil)
+		req.SetBasicAuth("", "admin_secret_key")
+		w := httptest.NewRecorder()
+		s.handleGetJobSchemas(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var schemas job.InputDataSchemas
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&schemas))
+		require.Len(t, schemas[job.TypeRecording], 1)
+		require.JSONEq(t, `{"type": "object", "properties": {"call_id": {"type": "string"}}, "required": ["call_id"]}`,
+			string(schemas[job.TypeRecording]["v0.6.0"]))
+	})
+
+	t.Run("no schemas", func(t *testing.T) {
+		s.schemas = nil
+
+		w := createJob(job.InputData{"call_id": 45})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		req := httptest.NewRequest("GET", "/jobs/schemas", nil)
+		req.SetBasicAuth("", "admin_secret_key")
+		w = httptest.NewRecorder()
+		s.handleGetJobSchemas(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{}`, w.Body.String())
+	})
+}
+
+func TestJobsAPIGetLogs(t *testing.T) {
+	s := newJobsAPITestService(t)
+	jobService := s.jobService.(*createJobServiceMock)
+	require.NoError(t, s.SaveJob(job.Job{ID: "jobID"}))
+
+	getLogs := func(container string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/jobs/jobID/logs?container="+container, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "jobID"})
+		req.SetBasicAuth("", "admin_secret_key")
+		w := httptest.NewRecorder()
+		s.handleJobGetLogs(w, req)
+		return w
+	}
+
+	t.Run("success", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, getLogs("").Code)
+	})
+
+	t.Run("container not found", func(t *testing.T) {
+		jobService.logsErr = fmt.Errorf("no containers found: %w", job.ErrContainerNotFound)
+		require.Equal(t, http.StatusNotFound, getLogs("sidecar").Code)
+	})
+
+	t.Run("job not found", func(t *testing.T) {
+		jobService.logsErr = fmt.Errorf("failed to get job namespace: %w", job.ErrNotFound)
+		require.Equal(t, http.StatusNotFound, getLogs("").Code)
+	})
+
+	t.Run("backend error", func(t *testing.T) {
+		jobService.logsErr = errors.New("connection refused")
+		require.Equal(t, http.StatusInternalServerError, getLogs("").Code)
+	})
+
+	t.Run("failure after streaming", func(t *testing.T) {
+		jobService.logs = "some logs\n"
+		jobService.logsErr = errors.New("stream interrupted")
+		defer func() { jobService.logs = "" }()
+		w := getLogs("")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "some logs\n", w.Body.String())
+	})
+}
+
+func TestJobsAPIJobOwnership(t *testing.T) {
+	s := newJobsAPITestService(t)
+	jobService := s.jobService.(*createJobServiceMock)
+
+	const authKey = "Ey4-H_BJA00_TVByPi8DozE12ekN3S7A"
+	require.NoError(t, s.auth.Register("clientA", authKey))
+	require.NoError(t, s.auth.Register("clientB", authKey))
+	require.NoError(t, s.auth.RegisterWithScopes("monitoring", authKey, []auth.Scope{auth.ScopeJobsRead, auth.ScopeJobsAdmin}))
+
+	doRequest := func(clientID, method, url string, body io.Reader, h http.HandlerFunc) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, url, body)
+		req = mux.SetURLVars(req, map[string]string{"id": "abcdefghijklmnopqrstuvwxyz"})
+		if clientID == "" {
+			req.SetBasicAuth("", "admin_secret_key")
+		} else {
+			req.SetBasicAuth(clientID, authKey)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, json.NewEncoder(&buf).Encode(job.Config{
+		Type:           job.TypeRecording,
+		Runner:         "mattermost/calls-recorder:v0.6.2",
+		MaxDurationSec: 60,
+	}))
+	w := doRequest("clientA", "POST", "/jobs", &buf, s.handleCreateJob)
+	require.Equal(t, http.StatusOK, w.Code)
+	var j job.Job
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&j))
+	require.Equal(t, "clientA", j.ClientID)
+
+	jobURL := "/jobs/" + j.ID
+
+	t.Run("get", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, doRequest("clientA", "GET", jobURL, nil, s.handleGetJob).Code)
+		require.Equal(t, http.StatusNotFound, doRequest("clientB", "GET", jobURL, nil, s.handleGetJob).Code)
+		require.Equal(t, http.StatusOK, doRequest("monitoring", "GET", jobURL, nil, s.handleGetJob).Code)
+		require.Equal(t, http.StatusOK, doRequest("", "GET", jobURL, nil, s.handleGetJob).Code)
+	})
+
+	t.Run("logs", func(t *testing.T) {
+		require.Equal(t, http.StatusNotFound, doRequest("clientB", "GET", jobURL+"/logs", nil, s.handleJobGetLogs).Code)
+		require.Empty(t, jobService.ownerID)
+
+		require.Equal(t, http.StatusOK, doRequest("clientA", "GET", jobURL+"/logs", nil, s.handleJobGetLogs).Code)
+		require.Equal(t, "clientA", jobService.ownerID)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, s.setJobStopped(j.ID))
+		jobService.ownerID = ""
+
+		require.Equal(t, http.StatusNotFound, doRequest("clientB", "DELETE", jobURL, nil, s.handleDeleteJob).Code)
+		require.Empty(t, jobService.ownerID)
+
+		require.Equal(t, http.StatusOK, doRequest("", "DELETE", jobURL, nil, s.handleDeleteJob).Code)
+		require.Equal(t, "clientA", jobService.ownerID)
+	})
+
+	t.Run("unknown owner", func(t *testing.T) {
+		// Jobs saved before their client was recorded remain accessible to
+		// all clients.
+		require.NoError(t, s.SaveJob(job.Job{ID: j.ID}))
+		require.Equal(t, http.StatusOK, doRequest("clientA", "GET", jobURL, nil, s.handleGetJob).Code)
+		require.Equal(t, http.StatusOK, doRequest("clientB", "GET", jobURL, nil, s.handleGetJob).Code)
+		require.Equal(t, http.StatusOK, doRequest("monitoring", "GET", jobURL, nil, s.handleGetJob).Code)
+
+		jobService.ownerID = "unset"
+		require.Equal(t, http.StatusOK, doRequest("clientB", "GET", jobURL+"/logs", nil, s.handleJobGetLogs).Code)
+		require.Empty(t, jobService.ownerID)
+	})
+}
@@ -17,9 +17,10 @@ import (
 
 type JobService interface {
 	Init(cfg job.ServiceConfig) error
-	CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, error)
-	DeleteJob(jobID string) error
-	GetJobLogs(jobID string, stdout, stderr io.Writer) error
+	GetInitStatus() (job.ServiceStatus, error)
+	CreateJob(clientID string, cfg job.Config, onStopCb job.StopCb) (job.Job, error)
+	DeleteJob(clientID, jobID string) error
+	GetJobLogs(clientID, jobID string, stdout, stderr io.Writer, opts job.LogsOptions) error
 	Shutdown() error
 }
 
@@ -33,12 +34,14 @@ func NewJobService(cfg JobsConfig, log mlog.LoggerIFace) (JobService, error) {
 		cfg.Docker.MaxConcurrentJobs = cfg.MaxConcurrentJobs
 		cfg.Docker.FailedJobsRetentionTime = time.Duration(cfg.FailedJobsRetentionTime)
 		cfg.Docker.ImageRegistry = cfg.ImageRegistry
+		cfg.Docker.InputDataEnvPrefix = cfg.InputDataEnvPrefix
 		log.Info("creating new job service", mlog.Any("apiType", cfg.APIType), mlog.String("config", fmt.Sprintf("%+v", cfg.Docker)))
 		return docker.NewJobService(log, cfg.Docker)
 	case JobAPITypeKubernetes:
 		cfg.Kubernetes.MaxConcurrentJobs = cfg.MaxConcurrentJobs
 		cfg.Kubernetes.FailedJobsRetentionTime = time.Duration(cfg.FailedJobsRetentionTime)
 		cfg.Kubernetes.ImageRegistry = cfg.ImageRegistry
+		cfg.Kubernetes.InputDataEnvPrefix = cfg.InputDataEnvPrefix
 		log.Info("creating new job service", mlog.Any("apiType", cfg.APIType), mlog.String("config", fmt.Sprintf("%+v", cfg.Kubernetes)))
 		return kubernetes.NewJobService(log, cfg.Kubernetes)
 	default:
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/mattermost/calls-offloader/public/job"
@@ -18,6 +20,8 @@ import (
 
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/apimachinery/pkg/watch"
@@ -31,8 +35,37 @@ const (
 	k8sRequestTimeout     = 10 * time.Second
 	k8sInitContainerImage = "busybox:1.36"
 	k8sVolumePath         = "/data"
+	k8sPauseImage         = "registry.k8s.io/pause:3.9"
+	k8sImagePrePullerName = "calls-offloader-image-prepuller"
+	k8sDefaultVolumeSize  = "10Gi"
+	k8sSecretsPath        = "/run/secrets/calls-offloader"
 )
 
+// SecretsDelivery controls how secret job input data is passed to jobs.
+type SecretsDelivery string
+
+const (
+	// SecretsDeliveryEnv passes secrets as plain environment variables in the
+	// job spec.
+	SecretsDeliveryEnv SecretsDelivery = "env"
+	// SecretsDeliverySecretEnv stores secrets in a per-job Secret referenced
+	// by the environment variables of the job.
+	SecretsDeliverySecretEnv SecretsDelivery = "secret_env"
+	// SecretsDeliverySecretFile stores secrets in a per-job Secret mounted in
+	// the job container. Files are referenced through *_FILE environment
+	// variables.
+	SecretsDeliverySecretFile SecretsDelivery = "secret_file"
+)
+
+func (d SecretsDelivery) IsValid() error {
+	switch d {
+	case SecretsDeliveryEnv, SecretsDeliverySecretEnv, SecretsDeliverySecretFile:
+		return nil
+	default:
+		return fmt.Errorf("invalid secrets delivery %q", d)
+	}
+}
+
 // Type alias and custom decoders to support passing JSON from both TOML config and env
 // variable.
 
@@ -50,13 +83,73 @@ func (r *JobsResourceRequirements) UnmarshalTOML(data interface{}) error {
 	return yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer([]byte(js)), 0).Decode(r)
 }
 
+type JobsVolumeSizes map[job.Type]resource.Quantity
+
+func (s *JobsVolumeSizes) Decode(data string) error {
+	return yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer([]byte(data)), 0).Decode(s)
+}
+
+func (s *JobsVolumeSizes) UnmarshalTOML(data interface{}) error {
+	js, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("invalid data found")
+	}
+	return yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer([]byte(js)), 0).Decode(s)
+}
+
+// NamespaceConfig holds settings that apply to jobs created in a specific
+// namespace, overriding the global ones when set.
+type NamespaceConfig struct {
+	MaxConcurrentJobs        int                      `json:"max_concurrent_jobs"`
+	JobsResourceRequirements JobsResourceRequirements `json:"jobs_resource_requirements"`
+}
+
+// Namespaces maps a namespace to its specific settings.
+type Namespaces map[string]NamespaceConfig
+
+func (n *Namespaces) Decode(data string) error {
+	return yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer([]byte(data)), 0).Decode(n)
+}
+
+func (n *Namespaces) UnmarshalTOML(data interface{}) error {
+	js, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("invalid data found")
+	}
+	return yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer([]byte(js)), 0).Decode(n)
+}
+
+// ClientNamespaces maps a client ID to the namespace its jobs should be created in.
+type ClientNamespaces map[string]string
+
+func (n *ClientNamespaces) Decode(data string) error {
+	return yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer([]byte(data)), 0).Decode(n)
+}
+
+func (n *ClientNamespaces) UnmarshalTOML(data interface{}) error {
+	js, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("invalid data found")
+	}
+	return yaml.NewYAMLOrJSONDecoder(bytes.NewBuffer([]byte(js)), 0).Decode(n)
+}
+
 type JobServiceConfig struct {
 	MaxConcurrentJobs         int
 	FailedJobsRetentionTime   time.Duration
 	ImageRegistry             string
+	InputDataEnvPrefix        string
 	JobsResourceRequirements  JobsResourceRequirements `toml:"jobs_resource_requirements"`
 	PersistentVolumeClaimName string                   `toml:"persistent_volume_claim_name"`
 	NodeSysctls               string                   `toml:"node_sysctls"`
+	EnableImagePrePulling     bool                     `toml:"enable_image_pre_pulling"`
+	ImagePrePullerPauseImage  string                   `toml:"image_pre_puller_pause_image"`
+	VolumeStorageClassName    string                   `toml:"volume_storage_class_name"`
+	JobsVolumeSizes           JobsVolumeSizes          `toml:"jobs_volume_sizes"`
+	ClientNamespaces          ClientNamespaces         `toml:"client_namespaces"`
+	Namespaces                Namespaces               `toml:"namespaces"`
+	// How secret job input data is passed to jobs. Defaults to env when empty.
+	SecretsDelivery SecretsDelivery `toml:"secrets_delivery"`
 }
 
 func (c JobServiceConfig) IsValid() error {
@@ -68,15 +161,65 @@ func (c JobServiceConfig) IsValid() error {
 		return fmt.Errorf("invalid FailedJobsRetentionTime value: should be at least one minute")
 	}
 
+	if c.PersistentVolumeClaimName != "" && c.VolumeStorageClassName != "" {
+		return fmt.Errorf("invalid VolumeStorageClassName value: should not be set along with PersistentVolumeClaimName")
+	}
+
+	// A claim only exists in a single namespace so it can't be shared by
+	// jobs created in the namespaces of different clients.
+	if c.PersistentVolumeClaimName != "" && len(c.ClientNamespaces) > 0 {
+		return fmt.Errorf("invalid PersistentVolumeClaimName value: should not be set along with ClientNamespaces")
+	}
+
+	for jobType, size := range c.JobsVolumeSizes {
+		if size.Sign() <= 0 {
+			return fmt.Errorf("invalid JobsVolumeSizes value for %q: should be positive", jobType)
+		}
+	}
+
+	for clientID, namespace := range c.ClientNamespaces {
+		if clientID == "" {
+			return fmt.Errorf("invalid ClientNamespaces value: client ID should not be empty")
+		}
+		if namespace == "" {
+			return fmt.Errorf("invalid ClientNamespaces value for %q: namespace should not be empty", clientID)
+		}
+	}
+
+	for namespace, nsCfg := range c.Namespaces {
+		if nsCfg.MaxConcurrentJobs < 0 {
+			return fmt.Errorf("invalid Namespaces value for %q: MaxConcurrentJobs should be positive", namespace)
+		}
+	}
+
+	if c.SecretsDelivery != "" {
+		if err := c.SecretsDelivery.IsValid(); err != nil {
+			return fmt.Errorf("invalid SecretsDelivery value: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// GetSecretsDelivery returns the configured secrets delivery, defaulting to
+// env.
+func (c JobServiceConfig) GetSecretsDelivery() SecretsDelivery {
+	if c.SecretsDelivery == "" {
+		return SecretsDeliveryEnv
+	}
+	return c.SecretsDelivery
+}
+
 type JobService struct {
 	cfg JobServiceConfig
 	log mlog.LoggerIFace
 
 	namespace string
-	cs        *k8s.Clientset
+	cs        k8s.Interface
+
+	// jobNamespaces caches the namespace of the jobs created by this
+	// instance to avoid looking them up.
+	jobNamespaces sync.Map
 }
 
 func NewJobService(log mlog.LoggerIFace, cfg JobServiceConfig) (*JobService, error) {
@@ -115,15 +258,154 @@ func NewJobService(log mlog.LoggerIFace, cfg JobServiceConfig) (*JobService, err
 	}, nil
 }
 
-func (s *JobService) Init(_ job.ServiceConfig) error {
-	// May be best not to mess with k8s image pulling policy for now.
-	// It's probably okay for images to be pulled upon first pod execution.
-	// In the future we may consider executing a dry-run job on start for the purpose of
-	// preloading the image.
+func (s *JobService) Init(cfg job.ServiceConfig) error {
+	if !s.cfg.EnableImagePrePulling || len(cfg.Runners) == 0 {
+		// Without pre-pulling, images are pulled upon first pod execution on
+		// any given node. A pre-puller left over from when it was enabled is
+		// removed so that it doesn't keep running on every node.
+		// Failing to do so shouldn't prevent the service from working, e.g.
+		// if the service account isn't allowed to manage daemonsets anymore.
+		if err := s.deleteImagePrePuller(); err != nil {
+			s.log.Warn("failed to delete image pre-puller", mlog.Err(err))
+		}
+		return nil
+	}
+
+	if os.Getenv("DEV_MODE") == "true" {
+		s.log.Info("DEV_MODE enabled, skipping image pre-pulling")
+		return nil
+	}
+
+	tolerations, err := getJobPodTolerations()
+	if err != nil {
+		return fmt.Errorf("failed to get job pod tolerations: %w", err)
+	}
+
+	pauseImage := s.cfg.ImagePrePullerPauseImage
+	if pauseImage == "" {
+		pauseImage = k8sPauseImage
+	}
+
+	spec, err := genImagePrePullerDaemonSet(s.namespace, k8sInitContainerImage, pauseImage, cfg.Runners, tolerations)
+	if err != nil {
+		return fmt.Errorf("failed to generate image pre-puller: %w", err)
+	}
+
+	client := s.cs.AppsV1().DaemonSets(s.namespace)
+	ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
+	defer cancel()
+
+	ds, err := client.Get(ctx, k8sImagePrePullerName, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		s.log.Info("creating image pre-puller", mlog.Any("runners", cfg.Runners))
+		if _, err := client.Create(ctx, spec, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create image pre-puller: %w", err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get image pre-puller: %w", err)
+	}
+
+	if ds.Annotations[k8sImagePrePullerRunnersKey] == spec.Annotations[k8sImagePrePullerRunnersKey] &&
+		getImagePrePullerPauseImage(ds) == pauseImage {
+		s.log.Debug("image pre-puller is up to date", mlog.Any("runners", cfg.Runners))
+		return nil
+	}
+
+	// Updating the pod template causes the pre-puller pods for the previous
+	// runners to be replaced on every node.
+	s.log.Info("updating image pre-puller", mlog.Any("runners", cfg.Runners),
+		mlog.String("previous_runners", ds.Annotations[k8sImagePrePullerRunnersKey]))
+	ds.Annotations = spec.Annotations
+	ds.Spec.Template = spec.Spec.Template
+	if _, err := client.Update(ctx, ds, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update image pre-puller: %w", err)
+	}
+
 	return nil
 }
 
-func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, error) {
+func (s *JobService) deleteImagePrePuller() error {
+	ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
+	defer cancel()
+
+	err := s.cs.AppsV1().DaemonSets(s.namespace).Delete(ctx, k8sImagePrePullerName, metav1.DeleteOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	s.log.Info("deleted image pre-puller")
+
+	return nil
+}
+
+func (s *JobService) GetInitStatus() (job.ServiceStatus, error) {
+	if !s.cfg.EnableImagePrePulling || os.Getenv("DEV_MODE") == "true" {
+		return job.ServiceStatus{Ready: true}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
+	defer cancel()
+
+	ds, err := s.cs.AppsV1().DaemonSets(s.namespace).Get(ctx, k8sImagePrePullerName, metav1.GetOptions{})
+	if err != nil {
+		return job.ServiceStatus{}, fmt.Errorf("failed to get image pre-puller: %w", err)
+	}
+
+	return getImagePrePullerStatus(ds), nil
+}
+
+// getClientNamespace returns the namespace jobs created by the given
+// client should go to.
+func (s *JobService) getClientNamespace(clientID string) string {
+	if namespace := s.cfg.ClientNamespaces[clientID]; namespace != "" {
+		return namespace
+	}
+	return s.namespace
+}
+
+// getJobNamespace returns the namespace the given job was created in. Unless
+// the job was created by this instance, the namespace of the client that
+// created it is tried first. The other candidate namespaces are then searched,
+// which covers jobs created before the client was recorded or before it got
+// mapped to a different namespace. Callers are expected to have verified that
+// the client is allowed to access the job.
+func (s *JobService) getJobNamespace(clientID, jobID string) (string, error) {
+	if len(s.cfg.ClientNamespaces) == 0 {
+		return s.namespace, nil
+	}
+
+	if namespace, ok := s.jobNamespaces.Load(jobID); ok {
+		return namespace.(string), nil
+	}
+
+	namespaces := getCandidateNamespaces(s.namespace, s.cfg.ClientNamespaces)
+	if clientID != "" {
+		namespace := s.getClientNamespace(clientID)
+		namespaces = append([]string{namespace}, slices.DeleteFunc(namespaces, func(ns string) bool {
+			return ns == namespace
+		})...)
+	}
+
+	for _, namespace := range namespaces {
+		ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
+		_, err := s.cs.BatchV1().Jobs(namespace).Get(ctx, jobID, metav1.GetOptions{})
+		cancel()
+		if k8sErrors.IsNotFound(err) || k8sErrors.IsForbidden(err) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("failed to get job: %w", err)
+		}
+		s.jobNamespaces.Store(jobID, namespace)
+		return namespace, nil
+	}
+
+	return "", job.ErrNotFound
+}
+
+func (s *JobService) CreateJob(clientID string, cfg job.Config, onStopCb job.StopCb) (job.Job, error) {
 	if err := cfg.IsValid(s.cfg.ImageRegistry); err != nil {
 		return job.Job{}, fmt.Errorf("invalid job config: %w", err)
 	}
@@ -134,37 +416,65 @@ func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, er
 
 	devMode := os.Getenv("DEV_MODE") == "true"
 
+	namespace := s.getClientNamespace(clientID)
+	nsCfg := s.cfg.Namespaces[namespace]
+
+	maxConcurrentJobs := s.cfg.MaxConcurrentJobs
+	if nsCfg.MaxConcurrentJobs > 0 {
+		maxConcurrentJobs = nsCfg.MaxConcurrentJobs
+	}
+
+	resources := s.cfg.JobsResourceRequirements[cfg.Type]
+	if nsResources, ok := nsCfg.JobsResourceRequirements[cfg.Type]; ok {
+		resources = nsResources
+	}
+
 	// We fetch the list of jobs to check against it in order to
 	// ensure we don't exceed the configured MaxConcurrentJobs limit.
-	client := s.cs.BatchV1().Jobs(s.namespace)
+	// The limit applies to each namespace independently.
+	client := s.cs.BatchV1().Jobs(namespace)
 	ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
 	defer cancel()
 	jobList, err := client.List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return job.Job{}, fmt.Errorf("failed to list jobs: %w", err)
 	}
-	if activeJobs := getActiveJobs(jobList.Items); s.cfg.MaxConcurrentJobs > 0 && activeJobs >= s.cfg.MaxConcurrentJobs {
+	if activeJobs := getActiveJobs(jobList.Items); maxConcurrentJobs > 0 && activeJobs >= maxConcurrentJobs {
 		if !devMode {
 			return job.Job{}, fmt.Errorf("max concurrent jobs reached")
 		}
 		s.log.Warn("max concurrent jobs reached", mlog.Int("number of active jobs", activeJobs),
-			mlog.Int("cfg.MaxConcurrentJobs", s.cfg.MaxConcurrentJobs))
+			mlog.Int("cfg.MaxConcurrentJobs", maxConcurrentJobs), mlog.String("namespace", namespace))
 	}
 
 	var jobID string
 	var jobPrefix string
-	var env []corev1.EnvVar
 	switch cfg.Type {
 	case job.TypeRecording:
 		cfg.InputData.SetSiteURL(getSiteURLForJob(cfg.InputData.GetSiteURL()))
 		jobPrefix = job.RecordingJobPrefix
 		jobID = jobPrefix + "-job-" + random.NewID()
-		env = append(env, getEnvFromJobInputData(cfg.InputData)...)
 	case job.TypeTranscribing:
 		cfg.InputData.SetSiteURL(getSiteURLForJob(cfg.InputData.GetSiteURL()))
 		jobPrefix = job.TranscribingJobPrefix
 		jobID = jobPrefix + "-job-" + random.NewID()
-		env = append(env, getEnvFromJobInputData(cfg.InputData)...)
+	}
+
+	inputEnv, secretsEnv, err := cfg.InputData.SplitEnvMap(cfg.Type, s.cfg.InputDataEnvPrefix)
+	if err != nil {
+		return job.Job{}, fmt.Errorf("invalid job config: %w", err)
+	}
+	// Unless delivered as plain environment variables, secrets are kept out
+	// of the job spec and stored in a Secret created along with the job.
+	secretsDelivery := s.cfg.GetSecretsDelivery()
+	if len(secretsEnv) == 0 {
+		secretsDelivery = SecretsDeliveryEnv
+	}
+	env := getEnvVars(inputEnv)
+	if secretsDelivery == SecretsDeliveryEnv {
+		env = append(env, getEnvVars(secretsEnv)...)
+	} else {
+		env = append(env, getSecretEnvVars(jobID, secretsEnv, secretsDelivery)...)
 	}
 
 	var initContainers []corev1.Container
@@ -209,19 +519,64 @@ func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, er
 		},
 	}
 
-	if s.cfg.PersistentVolumeClaimName != "" {
+	volumeMounts := []corev1.VolumeMount{
+		{
+			Name:      jobID,
+			MountPath: k8sVolumePath,
+		},
+	}
+
+	if secretsDelivery == SecretsDeliverySecretFile {
+		volumes = append(volumes, corev1.Volume{
+			Name: jobID + "-secrets",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: jobID,
+					// Jobs may not run as root.
+					DefaultMode: newInt32(0444),
+				},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      jobID + "-secrets",
+			MountPath: k8sSecretsPath,
+			ReadOnly:  true,
+		})
+	}
+
+	volumeSize, hasVolumeSize := s.cfg.JobsVolumeSizes[cfg.Type]
+
+	switch {
+	case s.cfg.PersistentVolumeClaimName != "":
 		s.log.Debug("using persistent volume claim", mlog.String("name", s.cfg.PersistentVolumeClaimName))
 		volumes[0].VolumeSource = corev1.VolumeSource{
 			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
 				ClaimName: s.cfg.PersistentVolumeClaimName,
 			},
 		}
+	case s.cfg.VolumeStorageClassName != "":
+		// The claim itself is created right after the job since it needs to
+		// reference it as its owner. In the meantime the pod stays pending.
+		volumes[0].VolumeSource = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: jobID,
+			},
+		}
+		if !hasVolumeSize {
+			volumeSize = resource.MustParse(k8sDefaultVolumeSize)
+		}
+	case hasVolumeSize:
+		volumes[0].VolumeSource = corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				SizeLimit: &volumeSize,
+			},
+		}
 	}
 
 	spec := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      jobID,
-			Namespace: s.namespace,
+			Namespace: namespace,
 			Labels: map[string]string{
 				// Using a custom label to easily watch the job.
 				"job_name": jobID,
@@ -252,14 +607,9 @@ func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, er
 							Name:            jobID,
 							Image:           cfg.Runner,
 							ImagePullPolicy: corev1.PullIfNotPresent,
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      jobID,
-									MountPath: k8sVolumePath,
-								},
-							},
+							VolumeMounts:    volumeMounts,
 							Env:             env,
-							Resources:       s.cfg.JobsResourceRequirements[cfg.Type],
+							Resources:       resources,
 							SecurityContext: getJobPodSecurityContext(),
 						},
 					},
@@ -283,10 +633,40 @@ func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, er
 	ctx, cancel = context.WithTimeout(context.Background(), k8sRequestTimeout)
 	defer cancel()
 
-	if _, err := client.Create(ctx, spec, metav1.CreateOptions{}); err != nil {
+	k8sJob, err := client.Create(ctx, spec, metav1.CreateOptions{})
+	if err != nil {
 		return job.Job{}, fmt.Errorf("failed to create job: %w", err)
 	}
 
+	if secretsDelivery != SecretsDeliveryEnv {
+		// Like the volume claim, the secret is owned by the job so that it
+		// gets deleted along with it. In the meantime the pod stays pending.
+		secret := genJobSecret(k8sJob, secretsEnv)
+		s.log.Debug("creating job secret", mlog.String("jobID", jobID), mlog.String("delivery", string(secretsDelivery)))
+		if _, err := s.cs.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			if err := s.deleteJob(namespace, jobID); err != nil {
+				s.log.Error("failed to delete job", mlog.Err(err), mlog.String("jobID", jobID))
+			}
+			return job.Job{}, fmt.Errorf("failed to create job secret: %w", err)
+		}
+	}
+
+	if s.cfg.VolumeStorageClassName != "" {
+		claim := genJobVolumeClaim(k8sJob, s.cfg.VolumeStorageClassName, volumeSize)
+		s.log.Debug("creating persistent volume claim", mlog.String("jobID", jobID),
+			mlog.String("storageClass", s.cfg.VolumeStorageClassName), mlog.String("size", volumeSize.String()))
+		if _, err := s.cs.CoreV1().PersistentVolumeClaims(namespace).Create(ctx, claim, metav1.CreateOptions{}); err != nil {
+			if err := s.deleteJob(namespace, jobID); err != nil {
+				s.log.Error("failed to delete job", mlog.Err(err), mlog.String("jobID", jobID))
+			}
+			return job.Job{}, fmt.Errorf("failed to create persistent volume claim: %w", err)
+		}
+	}
+
+	if len(s.cfg.ClientNamespaces) > 0 {
+		s.jobNamespaces.Store(jobID, namespace)
+	}
+
 	jb := job.Job{
 		ID:      jobID,
 		StartAt: time.Now().UnixMilli(),
@@ -334,6 +714,7 @@ func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, er
 
 			if ev.Type == watch.Deleted {
 				s.log.Info("job was deleted", mlog.String("jobID", jobID))
+				s.jobNamespaces.Delete(jobID)
 				return
 			}
 		}
@@ -342,14 +723,33 @@ func (s *JobService) CreateJob(cfg job.Config, onStopCb job.StopCb) (job.Job, er
 			s.log.Error("failed to run onStopCb", mlog.Err(err), mlog.String("jobID", jb.ID))
 		}
 
+		// Failed jobs may be garbage collected by Kubernetes at any point so
+		// we don't keep them cached past this point.
+		s.jobNamespaces.Delete(jobID)
+
 		s.log.Info("watcher done", mlog.String("jobID", jobID))
 	}()
 
 	return jb, nil
 }
 
-func (s *JobService) DeleteJob(jobID string) error {
-	client := s.cs.BatchV1().Jobs(s.namespace)
+func (s *JobService) DeleteJob(clientID, jobID string) error {
+	namespace, err := s.getJobNamespace(clientID, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to delete job: %w", err)
+	}
+
+	if err := s.deleteJob(namespace, jobID); err != nil {
+		return err
+	}
+
+	s.jobNamespaces.Delete(jobID)
+
+	return nil
+}
+
+func (s *JobService) deleteJob(namespace, jobID string) error {
+	client := s.cs.BatchV1().Jobs(namespace)
 	ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
 	defer cancel()
 
@@ -359,17 +759,24 @@ func (s *JobService) DeleteJob(jobID string) error {
 	err := client.Delete(ctx, jobID, metav1.DeleteOptions{
 		PropagationPolicy: &propagationPolicy,
 	})
-	if err != nil {
+	if k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete job: %w", job.ErrNotFound)
+	} else if err != nil {
 		return fmt.Errorf("failed to delete job: %w", err)
 	}
 	return nil
 }
 
-func (s *JobService) GetJobLogs(jobID string, _, stderr io.Writer) error {
+func (s *JobService) GetJobLogs(clientID, jobID string, _, stderr io.Writer, opts job.LogsOptions) error {
+	namespace, err := s.getJobNamespace(clientID, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to get job namespace: %w", err)
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
 	defer cancel()
 
-	list, err := s.cs.CoreV1().Pods(s.namespace).List(ctx, metav1.ListOptions{
+	list, err := s.cs.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
 		LabelSelector: "job_name==" + jobID,
 	})
 	if err != nil {
@@ -380,11 +787,45 @@ func (s *JobService) GetJobLogs(jobID string, _, stderr io.Writer) error {
 		return fmt.Errorf("no pods found")
 	}
 
-	// TODO: consider supporting multiple pods per job.
-	pod := list.Items[0]
+	targets := getPodLogTargets(list.Items, opts.Container)
+	if len(targets) == 0 {
+		return fmt.Errorf("no containers found: %w", job.ErrContainerNotFound)
+	}
+
+	for _, target := range targets {
+		if _, err := io.WriteString(stderr, target.header()); err != nil {
+			return fmt.Errorf("failed to write logs header: %w", err)
+		}
+
+		if target.waitingReason != "" {
+			if _, err := fmt.Fprintf(stderr, "container is waiting: %s\n", target.waitingReason); err != nil {
+				return fmt.Errorf("failed to write logs: %w", err)
+			}
+			continue
+		}
 
-	var opts corev1.PodLogOptions
-	req := s.cs.CoreV1().Pods(s.namespace).GetLogs(pod.Name, &opts)
+		// A failure to fetch logs for a single container (e.g. logs already
+		// rotated on the node) shouldn't prevent returning the others.
+		if err := s.copyContainerLogs(namespace, target, stderr); err != nil {
+			s.log.Warn("failed to get container logs", mlog.String("jobID", jobID),
+				mlog.String("pod", target.pod), mlog.String("container", target.container), mlog.Err(err))
+			if _, err := fmt.Fprintf(stderr, "failed to get logs: %s\n", err.Error()); err != nil {
+				return fmt.Errorf("failed to write logs: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *JobService) copyContainerLogs(namespace string, target podLogTarget, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), k8sRequestTimeout)
+	defer cancel()
+
+	req := s.cs.CoreV1().Pods(namespace).GetLogs(target.pod, &corev1.PodLogOptions{
+		Container: target.container,
+		Previous:  target.previous,
+	})
 
 	podLogs, err := req.Stream(ctx)
 	if err != nil {
@@ -392,7 +833,7 @@ func (s *JobService) GetJobLogs(jobID string, _, stderr io.Writer) error {
 	}
 	defer podLogs.Close()
 
-	if _, err := io.Copy(stderr, podLogs); err != nil {
+	if _, err := io.Copy(w, podLogs); err != nil {
 		return fmt.Errorf("failed to copy data from stream: %w", err)
 	}
 
@@ -0,0 +1,123 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mattermost/calls-offloader/public/job"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestJobService(t *testing.T, cfg JobServiceConfig) *JobService {
+	t.Helper()
+
+	log, err := mlog.NewLogger()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, log.Shutdown())
+	})
+
+	return &JobService{
+		cfg:       cfg,
+		log:       log,
+		cs:        fake.NewSimpleClientset(),
+		namespace: "default",
+	}
+}
+
+func TestInitImagePrePuller(t *testing.T) {
+	s := newTestJobService(t, JobServiceConfig{EnableImagePrePulling: true})
+	runners := job.ServiceConfig{Runners: []string{"mattermost/calls-recorder:v0.6.0"}}
+
+	getPrePuller := func() error {
+		_, err := s.cs.AppsV1().DaemonSets("default").Get(context.Background(), k8sImagePrePullerName, metav1.GetOptions{})
+		return err
+	}
+
+	require.NoError(t, s.Init(runners))
+	require.NoError(t, getPrePuller())
+
+	t.Run("pause image", func(t *testing.T) {
+		ds, err := s.cs.AppsV1().DaemonSets("default").Get(context.Background(), k8sImagePrePullerName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, k8sPauseImage, getImagePrePullerPauseImage(ds))
+
+		s.cfg.ImagePrePullerPauseImage = "registry.example.com/pause:3.9"
+		defer func() { s.cfg.ImagePrePullerPauseImage = "" }()
+		require.NoError(t, s.Init(runners))
+
+		ds, err = s.cs.AppsV1().DaemonSets("default").Get(context.Background(), k8sImagePrePullerName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "registry.example.com/pause:3.9", getImagePrePullerPauseImage(ds))
+	})
+
+	t.Run("empty runners", func(t *testing.T) {
+		require.NoError(t, s.Init(job.ServiceConfig{}))
+		require.True(t, k8sErrors.IsNotFound(getPrePuller()))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		require.NoError(t, s.Init(runners))
+		require.NoError(t, getPrePuller())
+
+		s.cfg.EnableImagePrePulling = false
+		require.NoError(t, s.Init(runners))
+		require.True(t, k8sErrors.IsNotFound(getPrePuller()))
+
+		// Nothing to delete.
+		require.NoError(t, s.Init(runners))
+	})
+}
+
+func TestGetJobNamespace(t *testing.T) {
+	s := newTestJobService(t, JobServiceConfig{
+		ClientNamespaces: ClientNamespaces{
+			"clientA": "tenant-a",
+			"clientB": "tenant-b",
+		},
+	})
+
+	_, err := s.cs.BatchV1().Jobs("tenant-a").Create(context.Background(), &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "jobA"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	t.Run("owner", func(t *testing.T) {
+		namespace, err := s.getJobNamespace("clientA", "jobA")
+		require.NoError(t, err)
+		require.Equal(t, "tenant-a", namespace)
+
+	})
+
+	t.Run("owner mapped to another namespace", func(t *testing.T) {
+		s.jobNamespaces.Delete("jobA")
+
+		// The job was created before clientB got mapped to tenant-b.
+		namespace, err := s.getJobNamespace("clientB", "jobA")
+		require.NoError(t, err)
+		require.Equal(t, "tenant-a", namespace)
+
+		_, err = s.getJobNamespace("clientB", "jobB")
+		require.ErrorIs(t, err, job.ErrNotFound)
+	})
+
+	t.Run("unknown owner", func(t *testing.T) {
+		s.jobNamespaces.Delete("jobA")
+
+		namespace, err := s.getJobNamespace("", "jobA")
+		require.NoError(t, err)
+		require.Equal(t, "tenant-a", namespace)
+
+		_, err = s.getJobNamespace("", "jobB")
+		require.ErrorIs(t, err, job.ErrNotFound)
+	})
+}
@@ -8,16 +8,27 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/mattermost/calls-offloader/public/job"
 
+	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
+const (
+	k8sImagePrePullerRunnersKey = "calls-offloader/runners"
+	k8sImagePrePullerBinPath    = "/calls-offloader-prepuller"
+)
+
 var defaultTolerations = []corev1.Toleration{
 	{
 		Key:      "utilities",
@@ -45,15 +56,50 @@ func newBool(val bool) *bool {
 	return p
 }
 
-func getEnvFromJobInputData(data job.InputData) []corev1.EnvVar {
-	var env []corev1.EnvVar
-	for k, v := range data {
-		env = append(env, corev1.EnvVar{
-			Name:  strings.ToUpper(k),
-			Value: fmt.Sprintf("%v", v),
+// getEnvVars returns the given environment variables, sorted by name.
+func getEnvVars(env map[string]string) []corev1.EnvVar {
+	vars := make([]corev1.EnvVar, 0, len(env))
+	for name, val := range env {
+		vars = append(vars, corev1.EnvVar{
+			Name:  name,
+			Value: val,
 		})
 	}
-	return env
+	sort.Slice(vars, func(i, j int) bool {
+		return vars[i].Name < vars[j].Name
+	})
+	return vars
+}
+
+// getSecretEnvVars returns the environment variables referencing the secrets
+// stored in the job's Secret, either directly or, when delivered as files,
+// through their path.
+func getSecretEnvVars(jobID string, secrets map[string]string, delivery SecretsDelivery) []corev1.EnvVar {
+	vars := make([]corev1.EnvVar, 0, len(secrets))
+	for name := range secrets {
+		if delivery == SecretsDeliverySecretFile {
+			vars = append(vars, corev1.EnvVar{
+				Name:  name + job.InputDataFileEnvSuffix,
+				Value: path.Join(k8sSecretsPath, name),
+			})
+			continue
+		}
+		vars = append(vars, corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: jobID,
+					},
+					Key: name,
+				},
+			},
+		})
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		return vars[i].Name < vars[j].Name
+	})
+	return vars
 }
 
 func getJobPodTolerations() ([]corev1.Toleration, error) {
@@ -156,3 +202,324 @@ func getJobPodSecurityContext() *corev1.SecurityContext {
 		Privileged: newBool(privileged),
 	}
 }
+
+// podLogTarget identifies a single stream of logs to fetch for a job.
+type podLogTarget struct {
+	pod       string
+	container string
+	init      bool
+	// previous is set when targeting the logs of a terminated
+	// instance of a container that has since been restarted.
+	previous bool
+	// waitingReason is set when the container has not started yet
+	// and as such has no logs to fetch.
+	waitingReason string
+}
+
+func (t podLogTarget) header() string {
+	var attrs []string
+	if t.init {
+		attrs = append(attrs, "init")
+	}
+	if t.previous {
+		attrs = append(attrs, "previous")
+	}
+
+	var suffix string
+	if len(attrs) > 0 {
+		suffix = " (" + strings.Join(attrs, ", ") + ")"
+	}
+
+	return fmt.Sprintf("==> pod/%s container/%s%s <==\n", t.pod, t.container, suffix)
+}
+
+// getPodLogTargets returns the list of log streams to fetch for the given
+// pods, sorted by creation time. Init containers come first in the order in
+// which they are executed. If container is not empty, only the containers
+// matching the given name are returned.
+func getPodLogTargets(pods []corev1.Pod, container string) []podLogTarget {
+	sorted := make([]corev1.Pod, len(pods))
+	copy(sorted, pods)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CreationTimestamp.Before(&sorted[j].CreationTimestamp)
+	})
+
+	var targets []podLogTarget
+	for _, pod := range sorted {
+		for _, cnt := range pod.Spec.InitContainers {
+			if container != "" && cnt.Name != container {
+				continue
+			}
+			targets = append(targets, getContainerLogTargets(pod.Name, cnt.Name, true, pod.Status.InitContainerStatuses)...)
+		}
+		for _, cnt := range pod.Spec.Containers {
+			if container != "" && cnt.Name != container {
+				continue
+			}
+			targets = append(targets, getContainerLogTargets(pod.Name, cnt.Name, false, pod.Status.ContainerStatuses)...)
+		}
+	}
+
+	return targets
+}
+
+func getContainerLogTargets(pod, container string, init bool, statuses []corev1.ContainerStatus) []podLogTarget {
+	target := podLogTarget{
+		pod:       pod,
+		container: container,
+		init:      init,
+	}
+
+	var status *corev1.ContainerStatus
+	for i := range statuses {
+		if statuses[i].Name == container {
+			status = &statuses[i]
+			break
+		}
+	}
+
+	if status == nil {
+		target.waitingReason = "PodInitializing"
+		return []podLogTarget{target}
+	}
+
+	var targets []podLogTarget
+	if status.RestartCount > 0 || status.LastTerminationState.Terminated != nil {
+		previous := target
+		previous.previous = true
+		targets = append(targets, previous)
+	}
+
+	if status.State.Waiting != nil {
+		// No need to report a waiting container if we already have logs
+		// from a previous attempt.
+		if len(targets) > 0 {
+			return targets
+		}
+		target.waitingReason = status.State.Waiting.Reason
+		if target.waitingReason == "" {
+			target.waitingReason = "Unknown"
+		}
+	}
+
+	return append(targets, target)
+}
+
+// genImagePrePullerDaemonSet generates a DaemonSet which pulls the given
+// runners on every eligible node. Each runner is executed as a no-op init
+// container after which the pod sits idle so that the kubelet doesn't garbage
+// collect the images.
+// Since runners can't be expected to ship any particular binary, the no-op
+// is the statically linked busybox binary found in the given image, which is
+// copied to a shared volume first and then run as "true".
+func genImagePrePullerDaemonSet(namespace, image, pauseImage string, runners []string, tolerations []corev1.Toleration) (*appsv1.DaemonSet, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("invalid empty namespace")
+	}
+
+	if image == "" {
+		return nil, fmt.Errorf("invalid empty image")
+	}
+
+	if pauseImage == "" {
+		return nil, fmt.Errorf("invalid empty pause image")
+	}
+
+	if len(runners) == 0 {
+		return nil, fmt.Errorf("invalid empty runners")
+	}
+
+	var sorted []string
+	for _, runner := range runners {
+		if !slices.Contains(sorted, runner) {
+			sorted = append(sorted, runner)
+		}
+	}
+	sort.Strings(sorted)
+
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("10m"),
+			corev1.ResourceMemory: resource.MustParse("16Mi"),
+		},
+	}
+
+	binMount := corev1.VolumeMount{
+		Name:      "bin",
+		MountPath: k8sImagePrePullerBinPath,
+	}
+
+	initContainers := []corev1.Container{
+		{
+			Name:            k8sImagePrePullerName + "-bin",
+			Image:           image,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{"cp", "/bin/busybox", path.Join(k8sImagePrePullerBinPath, "true")},
+			Resources:       resources,
+			VolumeMounts:    []corev1.VolumeMount{binMount},
+		},
+	}
+	for i, runner := range sorted {
+		initContainers = append(initContainers, corev1.Container{
+			Name:            fmt.Sprintf("%s-%d", k8sImagePrePullerName, i),
+			Image:           runner,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			Command:         []string{path.Join(k8sImagePrePullerBinPath, "true")},
+			Resources:       resources,
+			VolumeMounts:    []corev1.VolumeMount{binMount},
+		})
+	}
+
+	labels := map[string]string{
+		"app":       "mattermost-calls-offloader",
+		"component": k8sImagePrePullerName,
+	}
+
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      k8sImagePrePullerName,
+			Namespace: namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				k8sImagePrePullerRunnersKey: strings.Join(sorted, ","),
+			},
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: initContainers,
+					Containers: []corev1.Container{
+						{
+							Name:            "pause",
+							Image:           pauseImage,
+							ImagePullPolicy: corev1.PullIfNotPresent,
+							Resources:       resources,
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: binMount.Name,
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+					Tolerations: tolerations,
+				},
+			},
+		},
+	}, nil
+}
+
+func getImagePrePullerPauseImage(ds *appsv1.DaemonSet) string {
+	for _, container := range ds.Spec.Template.Spec.Containers {
+		if container.Name == "pause" {
+			return container.Image
+		}
+	}
+	return ""
+}
+
+func getImagePrePullerStatus(ds *appsv1.DaemonSet) job.ServiceStatus {
+	status := job.ServiceStatus{
+		NodesDesired: int(ds.Status.DesiredNumberScheduled),
+		NodesReady:   int(ds.Status.NumberReady),
+	}
+
+	if runners := ds.Annotations[k8sImagePrePullerRunnersKey]; runners != "" {
+		status.Runners = strings.Split(runners, ",")
+	}
+
+	// Pods still running the previous template don't count as ready
+	// since they have been pulling stale runners.
+	if updated := int(ds.Status.UpdatedNumberScheduled); updated < status.NodesReady {
+		status.NodesReady = updated
+	}
+
+	status.Ready = ds.Status.ObservedGeneration >= ds.Generation &&
+		status.NodesReady >= status.NodesDesired
+
+	return status
+}
+
+// genJobVolumeClaim generates a claim to dynamically provision the volume used
+// by the given job. The claim is owned by the job so that it gets garbage
+// collected along with it.
+func genJobVolumeClaim(jb *batchv1.Job, storageClassName string, size resource.Quantity) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jb.Name,
+			Namespace: jb.Namespace,
+			Labels: map[string]string{
+				"job_name": jb.Name,
+				"app":      "mattermost-calls-offloader",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: batchv1.SchemeGroupVersion.String(),
+					Kind:       "Job",
+					Name:       jb.Name,
+					UID:        jb.UID,
+				},
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteOnce,
+			},
+			StorageClassName: &storageClassName,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+}
+
+// genJobSecret returns the Secret holding the secret environment variables of
+// the given job. Keys match the names of the variables they are delivered
+// through.
+func genJobSecret(jb *batchv1.Job, secrets map[string]string) *corev1.Secret {
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jb.Name,
+			Namespace: jb.Namespace,
+			Labels: map[string]string{
+				"job_name": jb.Name,
+				"app":      "mattermost-calls-offloader",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: batchv1.SchemeGroupVersion.String(),
+					Kind:       "Job",
+					Name:       jb.Name,
+					UID:        jb.UID,
+				},
+			},
+		},
+		Immutable:  newBool(true),
+		Type:       corev1.SecretTypeOpaque,
+		StringData: secrets,
+	}
+}
+
+// getCandidateNamespaces returns the sorted list of unique namespaces jobs
+// can be created in.
+func getCandidateNamespaces(defaultNamespace string, clientNamespaces map[string]string) []string {
+	namespaces := []string{defaultNamespace}
+	for _, namespace := range clientNamespaces {
+		if !slices.Contains(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
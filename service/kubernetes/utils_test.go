@@ -4,15 +4,20 @@ import (
 	"encoding/json"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/mattermost/calls-offloader/public/job"
 
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/stretchr/testify/require"
 )
 
-func TestGetEnvFromJobInputData(t *testing.T) {
+func TestGetEnvVars(t *testing.T) {
 	tcs := []struct {
 		name string
 		data job.InputData
@@ -94,7 +99,9 @@ func TestGetEnvFromJobInputData(t *testing.T) {
 
 	for _, tc := range tcs {
 		t.Run(tc.name, func(t *testing.T) {
-			env := getEnvFromJobInputData(tc.data)
+			inputEnv, err := tc.data.ToEnvMap("")
+			require.NoError(t, err)
+			env := getEnvVars(inputEnv)
 			require.ElementsMatch(t, tc.env, env)
 		})
 	}
@@ -328,3 +335,354 @@ func TestGenInitContainersWithSecurityContext(t *testing.T) {
 		require.True(t, *cnts[0].SecurityContext.Privileged)
 	})
 }
+
+func TestGetPodLogTargets(t *testing.T) {
+	now := time.Now()
+
+	newPod := func(name string, createdAt time.Time) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(createdAt),
+			},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{
+					{Name: "jobID-init-0"},
+				},
+				Containers: []corev1.Container{
+					{Name: "jobID"},
+				},
+			},
+		}
+	}
+
+	t.Run("no pods", func(t *testing.T) {
+		require.Empty(t, getPodLogTargets(nil, ""))
+	})
+
+	t.Run("pod initializing", func(t *testing.T) {
+		pod := newPod("podA", now)
+		pod.Status.InitContainerStatuses = []corev1.ContainerStatus{
+			{
+				Name: "jobID-init-0",
+				State: corev1.ContainerState{
+					Running: &corev1.ContainerStateRunning{},
+				},
+			},
+		}
+
+		require.Equal(t, []podLogTarget{
+			{pod: "podA", container: "jobID-init-0", init: true},
+			{pod: "podA", container: "jobID", waitingReason: "PodInitializing"},
+		}, getPodLogTargets([]corev1.Pod{pod}, ""))
+	})
+
+	t.Run("multiple pods with restarts", func(t *testing.T) {
+		podA := newPod("podA", now)
+		podA.Status.InitContainerStatuses = []corev1.ContainerStatus{
+			{
+				Name: "jobID-init-0",
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{},
+				},
+			},
+		}
+		podA.Status.ContainerStatuses = []corev1.ContainerStatus{
+			{
+				Name:         "jobID",
+				RestartCount: 1,
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+				},
+				LastTerminationState: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{},
+				},
+			},
+		}
+
+		podB := newPod("podB", now.Add(-time.Minute))
+		podB.Status.InitContainerStatuses = []corev1.ContainerStatus{
+			{
+				Name: "jobID-init-0",
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{},
+				},
+			},
+		}
+		podB.Status.ContainerStatuses = []corev1.ContainerStatus{
+			{
+				Name: "jobID",
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{},
+				},
+			},
+		}
+
+		require.Equal(t, []podLogTarget{
+			{pod: "podB", container: "jobID-init-0", init: true},
+			{pod: "podB", container: "jobID", waitingReason: "Unknown"},
+			{pod: "podA", container: "jobID-init-0", init: true},
+			{pod: "podA", container: "jobID", previous: true},
+		}, getPodLogTargets([]corev1.Pod{podA, podB}, ""))
+
+		t.Run("single container", func(t *testing.T) {
+			require.Equal(t, []podLogTarget{
+				{pod: "podB", container: "jobID-init-0", init: true},
+				{pod: "podA", container: "jobID-init-0", init: true},
+			}, getPodLogTargets([]corev1.Pod{podA, podB}, "jobID-init-0"))
+		})
+
+		t.Run("missing container", func(t *testing.T) {
+			require.Empty(t, getPodLogTargets([]corev1.Pod{podA, podB}, "missing"))
+		})
+	})
+}
+
+func TestPodLogTargetHeader(t *testing.T) {
+	require.Equal(t, "==> pod/podA container/jobID <==\n",
+		podLogTarget{pod: "podA", container: "jobID"}.header())
+	require.Equal(t, "==> pod/podA container/jobID-init-0 (init) <==\n",
+		podLogTarget{pod: "podA", container: "jobID-init-0", init: true}.header())
+	require.Equal(t, "==> pod/podA container/jobID-init-0 (init, previous) <==\n",
+		podLogTarget{pod: "podA", container: "jobID-init-0", init: true, previous: true}.header())
+}
+
+func TestGenImagePrePullerDaemonSet(t *testing.T) {
+	t.Run("empty namespace", func(t *testing.T) {
+		ds, err := genImagePrePullerDaemonSet("", k8sInitContainerImage, k8sPauseImage, []string{"runnerA"}, nil)
+		require.EqualError(t, err, "invalid empty namespace")
+		require.Nil(t, ds)
+	})
+
+	t.Run("empty image", func(t *testing.T) {
+		ds, err := genImagePrePullerDaemonSet("default", "", k8sPauseImage, []string{"runnerA"}, nil)
+		require.EqualError(t, err, "invalid empty image")
+		require.Nil(t, ds)
+	})
+
+	t.Run("empty pause image", func(t *testing.T) {
+		ds, err := genImagePrePullerDaemonSet("default", k8sInitContainerImage, "", []string{"runnerA"}, nil)
+		require.EqualError(t, err, "invalid empty pause image")
+		require.Nil(t, ds)
+	})
+
+	t.Run("empty runners", func(t *testing.T) {
+		ds, err := genImagePrePullerDaemonSet("default", k8sInitContainerImage, k8sPauseImage, nil, nil)
+		require.EqualError(t, err, "invalid empty runners")
+		require.Nil(t, ds)
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		runners := []string{
+			"mattermost/calls-transcriber:v0.1.0",
+			"mattermost/calls-recorder:v0.6.0",
+			"mattermost/calls-recorder:v0.6.0",
+		}
+
+		ds, err := genImagePrePullerDaemonSet("default", k8sInitContainerImage, "registry.example.com/pause:3.9", runners, defaultTolerations)
+		require.NoError(t, err)
+		require.NotNil(t, ds)
+
+		require.Equal(t, k8sImagePrePullerName, ds.Name)
+		require.Equal(t, "default", ds.Namespace)
+		require.Equal(t, "mattermost/calls-recorder:v0.6.0,mattermost/calls-transcriber:v0.1.0",
+			ds.Annotations[k8sImagePrePullerRunnersKey])
+		require.Equal(t, ds.Spec.Selector.MatchLabels, ds.Spec.Template.Labels)
+		require.Equal(t, defaultTolerations, ds.Spec.Template.Spec.Tolerations)
+
+		initContainers := ds.Spec.Template.Spec.InitContainers
+		require.Len(t, initContainers, 3)
+		require.Equal(t, k8sInitContainerImage, initContainers[0].Image)
+		require.Equal(t, []string{"cp", "/bin/busybox", "/calls-offloader-prepuller/true"}, initContainers[0].Command)
+		require.Equal(t, "mattermost/calls-recorder:v0.6.0", initContainers[1].Image)
+		require.Equal(t, k8sImagePrePullerName+"-0", initContainers[1].Name)
+		require.Equal(t, "mattermost/calls-transcriber:v0.1.0", initContainers[2].Image)
+		require.Equal(t, k8sImagePrePullerName+"-1", initContainers[2].Name)
+		for _, cnt := range initContainers[1:] {
+			require.Equal(t, []string{"/calls-offloader-prepuller/true"}, cnt.Command)
+			require.Equal(t, initContainers[0].VolumeMounts, cnt.VolumeMounts)
+		}
+		require.Len(t, ds.Spec.Template.Spec.Volumes, 1)
+		require.NotNil(t, ds.Spec.Template.Spec.Volumes[0].EmptyDir)
+
+		require.Len(t, ds.Spec.Template.Spec.Containers, 1)
+		require.Equal(t, "registry.example.com/pause:3.9", ds.Spec.Template.Spec.Containers[0].Image)
+		require.Equal(t, "registry.example.com/pause:3.9", getImagePrePullerPauseImage(ds))
+	})
+}
+
+func TestGetImagePrePullerStatus(t *testing.T) {
+	ds, err := genImagePrePullerDaemonSet("default", k8sInitContainerImage, k8sPauseImage, []string{"runnerA", "runnerB"}, nil)
+	require.NoError(t, err)
+
+	t.Run("rolling out", func(t *testing.T) {
+		ds.Generation = 2
+		ds.Status = appsv1.DaemonSetStatus{
+			ObservedGeneration:     2,
+			DesiredNumberScheduled: 3,
+			NumberReady:            3,
+			UpdatedNumberScheduled: 1,
+		}
+		require.Equal(t, job.ServiceStatus{
+			Runners:      []string{"runnerA", "runnerB"},
+			NodesDesired: 3,
+			NodesReady:   1,
+		}, getImagePrePullerStatus(ds))
+	})
+
+	t.Run("generation not observed", func(t *testing.T) {
+		ds.Generation = 3
+		ds.Status = appsv1.DaemonSetStatus{
+			ObservedGeneration:     2,
+			DesiredNumberScheduled: 3,
+			NumberReady:            3,
+			UpdatedNumberScheduled: 3,
+		}
+		require.False(t, getImagePrePullerStatus(ds).Ready)
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		ds.Generation = 3
+		ds.Status = appsv1.DaemonSetStatus{
+			ObservedGeneration:     3,
+			DesiredNumberScheduled: 3,
+			NumberReady:            3,
+			UpdatedNumberScheduled: 3,
+		}
+		require.Equal(t, job.ServiceStatus{
+			Runners:      []string{"runnerA", "runnerB"},
+			Ready:        true,
+			NodesDesired: 3,
+			NodesReady:   3,
+		}, getImagePrePullerStatus(ds))
+	})
+}
+
+func TestGenJobVolumeClaim(t *testing.T) {
+	jb := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "calls-recorder-job-id",
+			Namespace: "default",
+			UID:       "uid",
+		},
+	}
+
+	claim := genJobVolumeClaim(jb, "fast", resource.MustParse("5Gi"))
+	require.Equal(t, "calls-recorder-job-id", claim.Name)
+	require.Equal(t, "default", claim.Namespace)
+	require.Equal(t, []metav1.OwnerReference{
+		{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+			Name:       "calls-recorder-job-id",
+			UID:        "uid",
+		},
+	}, claim.OwnerReferences)
+	require.NotNil(t, claim.Spec.StorageClassName)
+	require.Equal(t, "fast", *claim.Spec.StorageClassName)
+	require.Equal(t, resource.MustParse("5Gi"), claim.Spec.Resources.Requests[corev1.ResourceStorage])
+}
+
+func TestGetCandidateNamespaces(t *testing.T) {
+	require.Equal(t, []string{"default"}, getCandidateNamespaces("default", nil))
+	require.Equal(t, []string{"default", "tenant-a", "tenant-b"}, getCandidateNamespaces("default", map[string]string{
+		"clientB": "tenant-b",
+		"clientA": "tenant-a",
+		"clientC": "tenant-a",
+		"clientD": "default",
+	}))
+}
+
+func TestGetSecretEnvVars(t *testing.T) {
+	secrets := map[string]string{
+		"AUTH_TOKEN": "authToken",
+		"API_KEY":    "apiKey",
+	}
+
+	t.Run("secret env", func(t *testing.T) {
+		env := getSecretEnvVars("calls-recorder-job-id", secrets, SecretsDeliverySecretEnv)
+		require.Equal(t, []corev1.EnvVar{
+			{
+				Name: "API_KEY",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "calls-recorder-job-id"},
+						Key:                  "API_KEY",
+					},
+				},
+			},
+			{
+				Name: "AUTH_TOKEN",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "calls-recorder-job-id"},
+						Key:                  "AUTH_TOKEN",
+					},
+				},
+			},
+		}, env)
+	})
+
+	t.Run("secret file", func(t *testing.T) {
+		env := getSecretEnvVars("calls-recorder-job-id", secrets, SecretsDeliverySecretFile)
+		require.Equal(t, []corev1.EnvVar{
+			{
+				Name:  "API_KEY_FILE",
+				Value: "/run/secrets/calls-offloader/API_KEY",
+			},
+			{
+				Name:  "AUTH_TOKEN_FILE",
+				Value: "/run/secrets/calls-offloader/AUTH_TOKEN",
+			},
+		}, env)
+	})
+}
+
+func TestGenJobSecret(t *testing.T) {
+	jb := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "calls-recorder-job-id",
+			Namespace: "default",
+			UID:       "uid",
+		},
+	}
+
+	secret := genJobSecret(jb, map[string]string{"AUTH_TOKEN": "authToken", "PORT": "8065"})
+	require.Equal(t, "calls-recorder-job-id", secret.Name)
+	require.Equal(t, "default", secret.Namespace)
+	require.Equal(t, []metav1.OwnerReference{
+		{
+			APIVersion: "batch/v1",
+			Kind:       "Job",
+			Name:       "calls-recorder-job-id",
+			UID:        "uid",
+		},
+	}, secret.OwnerReferences)
+	require.Equal(t, corev1.SecretTypeOpaque, secret.Type)
+	require.Equal(t, map[string]string{"AUTH_TOKEN": "authToken", "PORT": "8065"}, secret.StringData)
+}
+
+func TestSecretsDeliveryIsValid(t *testing.T) {
+	cfg := JobServiceConfig{}
+	require.NoError(t, cfg.IsValid())
+	require.Equal(t, SecretsDeliveryEnv, cfg.GetSecretsDelivery())
+
+	cfg.SecretsDelivery = SecretsDeliverySecretFile
+	require.NoError(t, cfg.IsValid())
+	require.Equal(t, SecretsDeliverySecretFile, cfg.GetSecretsDelivery())
+
+	cfg.SecretsDelivery = "volume"
+	require.EqualError(t, cfg.IsValid(), `invalid SecretsDelivery value: invalid secrets delivery "volume"`)
+}
+
+func TestPersistentVolumeClaimNameIsValid(t *testing.T) {
+	cfg := JobServiceConfig{PersistentVolumeClaimName: "my-pvc"}
+	require.NoError(t, cfg.IsValid())
+
+	cfg.ClientNamespaces = ClientNamespaces{"clientA": "tenant-a"}
+	require.EqualError(t, cfg.IsValid(), "invalid PersistentVolumeClaimName value: should not be set along with ClientNamespaces")
+
+	cfg.PersistentVolumeClaimName = ""
+	cfg.VolumeStorageClassName = "standard"
+	require.NoError(t, cfg.IsValid())
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package service
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+const (
+	lockoutTypeClient  = "client"
+	lockoutTypeAddress = "address"
+)
+
+func clientLockoutKey(clientID string) string {
+	return lockoutTypeClient + ":" + clientID
+}
+
+func addrLockoutKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return lockoutTypeAddress + ":" + host
+}
+
+// lockoutKeys returns the keys tracking the failed attempts to authenticate
+// as the given client. Attempts without a client ID, which can only succeed
+// through the admin key, are only tracked by remote address so that they
+// can't be used to lock the admin out from everywhere.
+func lockoutKeys(r *http.Request, clientID string) []string {
+	if clientID == "" {
+		return []string{addrLockoutKey(r)}
+	}
+	return []string{clientLockoutKey(clientID), addrLockoutKey(r)}
+}
+
+// checkLockout returns an error if any of the given keys is locked out,
+// in which case the Retry-After header is set on the response.
+func (s *Service) checkLockout(w http.ResponseWriter, keys ...string) (int, error) {
+	retryAfter := s.lockouts.Check(keys...)
+	if retryAfter <= 0 {
+		return http.StatusOK, nil
+	}
+
+	// Rounding up so that clients don't retry before the lockout has expired.
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	return http.StatusTooManyRequests, errors.New("authentication failed: too many failed attempts")
+}
+
+// authFailed records a failed authentication attempt for both the client ID
+// and the remote address of the request.
+func (s *Service) authFailed(r *http.Request, clientID string) {
+	for _, key := range lockoutKeys(r, clientID) {
+		s.lockoutFail(r, key, clientID)
+	}
+}
+
+// authSucceeded forgets the failed attempts for both the client ID and the
+// remote address of the request, as many clients can share the same address
+// (e.g. behind a proxy).
+func (s *Service) authSucceeded(r *http.Request, clientID string) {
+	s.lockouts.Reset(lockoutKeys(r, clientID)...)
+}
+
+func (s *Service) lockoutFail(r *http.Request, key, clientID string) {
+	duration := s.lockouts.Fail(key)
+	if duration == 0 {
+		return
+	}
+
+	lockoutType, _, _ := strings.Cut(key, ":")
+	s.log.Warn("authentication lockout", append(reqAuditFields(r),
+		mlog.String("clientID", clientID),
+		mlog.String("type", lockoutType),
+		mlog.Any("duration", duration),
+	)...)
+	s.metrics.IncAuthLockouts(lockoutType)
+}
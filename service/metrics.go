@@ -0,0 +1,52 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package service
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "calls_offloader"
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	authLockouts *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+	}
+
+	m.registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{
+		Namespace: metricsNamespace,
+	}))
+	m.registry.MustRegister(collectors.NewGoCollector())
+
+	m.authLockouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "auth",
+			Name:      "lockouts_total",
+			Help:      "Total number of lockouts caused by repeated authentication failures",
+		},
+		[]string{"type"},
+	)
+	m.registry.MustRegister(m.authLockouts)
+
+	return m
+}
+
+func (m *metrics) IncAuthLockouts(lockoutType string) {
+	m.authLockouts.WithLabelValues(lockoutType).Inc()
+}
+
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/calls-offloader/public/job"
+
+	"github.com/Masterminds/semver"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// versionedSchema is the input data schema applying to the runners of a job
+// type starting from the given version.
+type versionedSchema struct {
+	version *semver.Version
+	raw     json.RawMessage
+	schema  *jsonschema.Schema
+}
+
+// Registry holds the input data schemas of each job type, by runner version.
+type Registry struct {
+	// schemas are sorted by ascending version.
+	schemas map[job.Type][]versionedSchema
+}
+
+// ValidationError is returned when input data doesn't validate against its
+// schema.
+type ValidationError struct {
+	Type    job.Type
+	Version string
+	Errors  []job.InputDataFieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fieldErr := range e.Errors {
+		if fieldErr.Field == "" {
+			msgs = append(msgs, fieldErr.Message)
+		} else {
+			msgs = append(msgs, fieldErr.Field+": "+fieldErr.Message)
+		}
+	}
+	return fmt.Sprintf("invalid input data for %s %s: %s", e.Type, e.Version, strings.Join(msgs, "; "))
+}
+
+// Load compiles the schemas found in dir, which is expected to hold one
+// directory per job type with one file per runner version, e.g.
+//
+//	recording/v0.6.0.json
+//	recording/v0.7.0.json
+//	transcribing/v0.1.0.json
+//
+// A schema applies to the runners of its job type from its version up to the
+// next schema's.
+func Load(dir string) (*Registry, error) {
+	typeDirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schemas directory: %w", err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+
+	r := &Registry{
+		schemas: make(map[job.Type][]versionedSchema),
+	}
+
+	for _, typeDir := range typeDirs {
+		if !typeDir.IsDir() {
+			continue
+		}
+
+		jobType := job.Type(typeDir.Name())
+		switch jobType {
+		case job.TypeRecording, job.TypeTranscribing:
+		default:
+			return nil, fmt.Errorf("invalid job type %q", jobType)
+		}
+
+		files, err := filepath.Glob(filepath.Join(dir, typeDir.Name(), "*.json"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list schemas: %w", err)
+		}
+
+		for _, file := range files {
+			vs, err := loadSchema(compiler, file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load schema %q: %w", file, err)
+			}
+			r.schemas[jobType] = append(r.schemas[jobType], vs)
+		}
+
+		sort.Slice(r.schemas[jobType], func(i, j int) bool {
+			return r.schemas[jobType][i].version.LessThan(r.schemas[jobType][j].version)
+		})
+	}
+
+	return r, nil
+}
+
+func loadSchema(compiler *jsonschema.Compiler, file string) (versionedSchema, error) {
+	version, err := semver.NewVersion(strings.TrimSuffix(filepath.Base(file), ".json"))
+	if err != nil {
+		return versionedSchema{}, fmt.Errorf("invalid version: %w", err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return versionedSchema{}, err
+	}
+
+	if err := compiler.AddResource(file, bytes.NewReader(data)); err != nil {
+		return versionedSchema{}, err
+	}
+
+	schema, err := compiler.Compile(file)
+	if err != nil {
+		return versionedSchema{}, err
+	}
+
+	return versionedSchema{
+		version: version,
+		raw:     data,
+		schema:  schema,
+	}, nil
+}
+
+// getSchema returns the schema applying to the given job type and runner, if
+// any. Runners without a valid version (e.g. development images) get the
+// latest schema.
+func (r *Registry) getSchema(jobType job.Type, runner string) *versionedSchema {
+	schemas := r.schemas[jobType]
+	if len(schemas) == 0 {
+		return nil
+	}
+
+	var version *semver.Version
+	if idx := strings.LastIndex(runner, ":"); idx >= 0 {
+		version, _ = semver.NewVersion(runner[idx+1:])
+	}
+	if version == nil {
+		return &schemas[len(schemas)-1]
+	}
+
+	for i := len(schemas) - 1; i >= 0; i-- {
+		if !version.LessThan(schemas[i].version) {
+			return &schemas[i]
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the input data of the given job config against the schema
+// applying to its type and runner. A *ValidationError is returned if it
+// doesn't validate. Configs without a matching schema are considered valid.
+func (r *Registry) Validate(cfg job.Config) error {
+	vs := r.getSchema(cfg.Type, cfg.Runner)
+	if vs == nil {
+		return nil
+	}
+
+	// Going through JSON so that values have the types expected by the
+	// validator, whatever the way the input data was built.
+	// Missing input data is validated as an empty object so that required
+	// properties are still enforced.
+	inputData := cfg.InputData
+	if inputData == nil {
+		inputData = job.InputData{}
+	}
+	js, err := json.Marshal(inputData)
+	if err != nil {
+		return fmt.Errorf("failed to marshal input data: %w", err)
+	}
+	var data any
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return fmt.Errorf("failed to unmarshal input data: %w", err)
+	}
+
+	err = vs.schema.Validate(data)
+	if err == nil {
+		return nil
+	}
+
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return fmt.Errorf("failed to validate input data: %w", err)
+	}
+
+	return &ValidationError{
+		Type:    cfg.Type,
+		Version: vs.version.Original(),
+		Errors:  getFieldErrors(ve, nil),
+	}
+}
+
+// getFieldErrors flattens the leaf errors of ve, which are the most specific
+// ones.
+func getFieldErrors(ve *jsonschema.ValidationError, fieldErrs []job.InputDataFieldError) []job.InputDataFieldError {
+	if len(ve.Causes) == 0 {
+		return append(fieldErrs, job.InputDataFieldError{
+			Field:   ve.InstanceLocation,
+			Message: ve.Message,
+		})
+	}
+	for _, cause := range ve.Causes {
+		fieldErrs = getFieldErrors(cause, fieldErrs)
+	}
+	return fieldErrs
+}
+
+// Schemas returns all the loaded schemas.
+func (r *Registry) Schemas() job.InputDataSchemas {
+	schemas := make(job.InputDataSchemas, len(r.schemas))
+	for jobType, versions := range r.schemas {
+		schemas[jobType] = make(map[string]json.RawMessage, len(versions))
+		for _, vs := range versions {
+			schemas[jobType][vs.version.Original()] = vs.raw
+		}
+	}
+	return schemas
+}
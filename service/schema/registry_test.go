@@ -0,0 +1,148 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package schema
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/calls-offloader/public/job"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	recordingSchemaV060 = `{
+  "type": "object",
+  "properties": {
+    "call_id": {"type": "string", "minLength": 1},
+    "width": {"type": "integer", "minimum": 1}
+  },
+  "required": ["call_id"]
+}`
+	recordingSchemaV070 = `{
+  "type": "object",
+  "properties": {
+    "call_id": {"type": "string", "minLength": 1},
+    "thread_id": {"type": "string"}
+  },
+  "required": ["call_id", "thread_id"]
+}`
+)
+
+func writeTestSchemas(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("missing directory", func(t *testing.T) {
+		_, err := Load(filepath.Join(t.TempDir(), "schemas"))
+		require.ErrorContains(t, err, "failed to read schemas directory")
+	})
+
+	t.Run("invalid job type", func(t *testing.T) {
+		dir := writeTestSchemas(t, map[string]string{"streaming/v0.1.0.json": `{}`})
+		_, err := Load(dir)
+		require.EqualError(t, err, `invalid job type "streaming"`)
+	})
+
+	t.Run("invalid version", func(t *testing.T) {
+		dir := writeTestSchemas(t, map[string]string{"recording/latest.json": `{}`})
+		_, err := Load(dir)
+		require.ErrorContains(t, err, "invalid version")
+	})
+
+	t.Run("invalid schema", func(t *testing.T) {
+		dir := writeTestSchemas(t, map[string]string{"recording/v0.6.0.json": `{"type": 42}`})
+		_, err := Load(dir)
+		require.ErrorContains(t, err, "failed to load schema")
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		dir := writeTestSchemas(t, map[string]string{
+			"recording/v0.7.0.json":    recordingSchemaV070,
+			"recording/v0.6.0.json":    recordingSchemaV060,
+			"transcribing/v0.1.0.json": `{"type": "object"}`,
+			"README.md":                "ignored",
+		})
+		r, err := Load(dir)
+		require.NoError(t, err)
+
+		schemas := r.Schemas()
+		require.Len(t, schemas, 2)
+		require.Len(t, schemas[job.TypeRecording], 2)
+		require.JSONEq(t, recordingSchemaV060, string(schemas[job.TypeRecording]["v0.6.0"]))
+		require.JSONEq(t, `{"type": "object"}`, string(schemas[job.TypeTranscribing]["v0.1.0"]))
+
+		_, err = json.Marshal(schemas)
+		require.NoError(t, err)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	dir := writeTestSchemas(t, map[string]string{
+		"recording/v0.6.0.json": recordingSchemaV060,
+		"recording/v0.7.0.json": recordingSchemaV070,
+	})
+	r, err := Load(dir)
+	require.NoError(t, err)
+
+	recordingCfg := func(runner string, inputData job.InputData) job.Config {
+		return job.Config{
+			Type:      job.TypeRecording,
+			Runner:    runner,
+			InputData: inputData,
+		}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		err := r.Validate(recordingCfg("mattermost/calls-recorder:v0.6.3", job.InputData{"call_id": "callID", "width": 1920}))
+		require.NoError(t, err)
+	})
+
+	t.Run("field errors", func(t *testing.T) {
+		err := r.Validate(recordingCfg("mattermost/calls-recorder:v0.6.3", job.InputData{"call_id": 45, "width": 0}))
+		var ve *ValidationError
+		require.ErrorAs(t, err, &ve)
+		require.Equal(t, job.TypeRecording, ve.Type)
+		require.Equal(t, "v0.6.0", ve.Version)
+		require.ElementsMatch(t, []job.InputDataFieldError{
+			{Field: "/call_id", Message: "expected string, but got number"},
+			{Field: "/width", Message: "must be >= 1 but found 0"},
+		}, ve.Errors)
+	})
+
+	t.Run("missing input data", func(t *testing.T) {
+		err := r.Validate(recordingCfg("mattermost/calls-recorder:v0.6.3", nil))
+		require.EqualError(t, err, "invalid input data for recording v0.6.0: missing properties: 'call_id'")
+	})
+
+	t.Run("versioned", func(t *testing.T) {
+		cfg := recordingCfg("mattermost/calls-recorder:v0.7.1", job.InputData{"call_id": "callID"})
+		require.EqualError(t, r.Validate(cfg), "invalid input data for recording v0.7.0: missing properties: 'thread_id'")
+	})
+
+	t.Run("older runner", func(t *testing.T) {
+		require.NoError(t, r.Validate(recordingCfg("mattermost/calls-recorder:v0.5.0", nil)))
+	})
+
+	t.Run("development runner", func(t *testing.T) {
+		cfg := recordingCfg("calls-recorder:master", job.InputData{"call_id": "callID"})
+		require.EqualError(t, r.Validate(cfg), "invalid input data for recording v0.7.0: missing properties: 'thread_id'")
+	})
+
+	t.Run("no schema", func(t *testing.T) {
+		cfg := job.Config{Type: job.TypeTranscribing, Runner: "mattermost/calls-transcriber:v0.1.0"}
+		require.NoError(t, r.Validate(cfg))
+	})
+}
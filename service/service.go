@@ -5,11 +5,15 @@ package service
 
 import (
 	"fmt"
+	"net/http"
 	"net/http/pprof"
+	"sync"
 
 	"github.com/mattermost/calls-offloader/logger"
 	"github.com/mattermost/calls-offloader/service/api"
 	"github.com/mattermost/calls-offloader/service/auth"
+	"github.com/mattermost/calls-offloader/service/encryption"
+	"github.com/mattermost/calls-offloader/service/schema"
 	"github.com/mattermost/calls-offloader/service/store"
 
 	"github.com/mattermost/mattermost/server/public/shared/mlog"
@@ -20,13 +24,26 @@ import (
 const apiRequestBodyMaxSizeBytes = 1024 * 1024 // 1MB
 
 type Service struct {
-	cfg          Config
-	apiServer    *api.Server
-	store        store.Store
-	auth         *auth.Service
-	log          *mlog.Logger
-	jobService   JobService
-	sessionCache *auth.SessionCache
+	cfg       Config
+	apiServer *api.Server
+	// adminServer is only set if the admin API listener is enabled.
+	adminServer *api.Server
+	store       store.Store
+	auth        *auth.Service
+	log         *mlog.Logger
+	jobService  JobService
+	sessions    auth.SessionManager
+	lockouts    *auth.LockoutTracker
+	metrics     *metrics
+	// keyring is only set if encryption keys are configured.
+	keyring *encryption.Keyring
+	// schemas is only set if an input data schemas directory is configured.
+	schemas *schema.Registry
+	// jobsMut serializes updates of job records.
+	jobsMut sync.Mutex
+
+	maintenanceStopCh chan struct{}
+	maintenanceDoneCh chan struct{}
 }
 
 func New(cfg Config) (*Service, error) {
@@ -35,7 +52,8 @@ func New(cfg Config) (*Service, error) {
 	}
 
 	s := &Service{
-		cfg: cfg,
+		cfg:     cfg,
+		metrics: newMetrics(),
 	}
 
 	var err error
@@ -46,28 +64,56 @@ func New(cfg Config) (*Service, error) {
 
 	s.log.Info("starting up", getVersionInfo().LogFields()...)
 
-	s.store, err = store.New(cfg.Store.DataSource)
+	s.store, err = store.NewWithDriver(cfg.Store.GetDriver(), cfg.Store.DataSource)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create store: %w", err)
 	}
-	s.log.Info("initiated data store", mlog.String("DataSource", cfg.Store.DataSource))
+	s.log.Info("initiated data store", mlog.String("Driver", string(cfg.Store.GetDriver())), mlog.String("DataSource", cfg.Store.DataSource))
 
-	s.sessionCache, err = auth.NewSessionCache(cfg.API.Security.SessionCache)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create session cache: %w", err)
+	if cfg.Store.Encryption.HasKeys() {
+		s.keyring, err = encryption.NewKeyring(cfg.Store.Encryption)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create keyring: %w", err)
+		}
+		s.log.Info("initiated encryption keyring", mlog.Bool("Enabled", s.keyring.Enabled()), mlog.String("ActiveKeyID", s.keyring.ActiveKeyID()))
 	}
 
-	s.auth, err = auth.NewService(s.store, s.sessionCache)
+	if cfg.API.Security.TokenMode == auth.TokenModeSigned {
+		s.sessions, err = auth.NewTokenSigner(cfg.API.Security.SignedTokens, s.store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create token signer: %w", err)
+		}
+	} else {
+		s.sessions, err = auth.NewSessionCache(cfg.API.Security.SessionCache, s.store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session cache: %w", err)
+		}
+	}
+
+	s.auth, err = auth.NewService(s.store, s.sessions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create auth service: %w", err)
 	}
 	s.log.Info("initiated auth service")
 
+	s.lockouts, err = auth.NewLockoutTracker(cfg.API.Security.Lockout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lockout tracker: %w", err)
+	}
+
 	s.apiServer, err = api.NewServer(cfg.API.HTTP, s.log)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create api server: %w", err)
 	}
 
+	if cfg.Jobs.InputDataSchemasDir != "" {
+		s.schemas, err = schema.Load(cfg.Jobs.InputDataSchemasDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load input data schemas: %w", err)
+		}
+		s.log.Info("loaded input data schemas", mlog.String("dir", cfg.Jobs.InputDataSchemasDir))
+	}
+
 	s.jobService, err = NewJobService(cfg.Jobs, s.log)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create job service: %w", err)
@@ -77,29 +123,104 @@ func New(cfg Config) (*Service, error) {
 	router := mux.NewRouter()
 	router.HandleFunc("/version", s.getVersion)
 	router.HandleFunc("/login", s.loginClient)
-	router.HandleFunc("/register", s.registerClient)
-	router.HandleFunc("/unregister", s.unregisterClient)
+	router.HandleFunc("/logout", s.logoutClient)
 	router.HandleFunc("/jobs", s.handleCreateJob).Methods("POST")
 	router.HandleFunc("/jobs/{id:[a-z0-9]{12,26}}/logs", s.handleJobGetLogs).Methods("GET")
 	router.HandleFunc("/jobs/{id:[a-z0-9]{12,26}}", s.handleGetJob).Methods("GET")
 	router.HandleFunc("/jobs/{id:[a-z0-9]{12,26}}", s.handleDeleteJob).Methods("DELETE")
 	router.HandleFunc("/jobs/init", s.handleInit).Methods("POST")
+	router.HandleFunc("/jobs/init", s.handleGetInitStatus).Methods("GET")
+	router.HandleFunc("/jobs/schemas", s.handleGetJobSchemas).Methods("GET")
+
+	// Clients need to be able to (un)register themselves so these are
+	// always served by the main API.
+	s.registerClientRoutes(router)
 
-	router.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-	router.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	router.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
-	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if cfg.API.Admin.Enable {
+		s.adminServer, err = api.NewServer(cfg.API.Admin.HTTP, s.log)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create admin api server: %w", err)
+		}
+
+		adminRouter := mux.NewRouter()
+		s.registerClientRoutes(adminRouter)
+		s.registerAdminRoutes(adminRouter)
+		// The admin listener is expected to only be reachable from a private
+		// network so metrics can be scraped without credentials.
+		adminRouter.Handle("/metrics", s.metrics.Handler())
+		s.registerDebugRoutes(adminRouter)
+		s.adminServer.RegisterHandler("/", adminRouter)
+	} else {
+		s.registerAdminRoutes(router)
+		router.Handle("/metrics", s.adminOnly(s.metrics.Handler()))
+		s.registerDebugRoutes(router)
+	}
 
 	s.apiServer.RegisterHandler("/", router)
 
+	s.maintenanceStopCh = make(chan struct{})
+	s.maintenanceDoneCh = make(chan struct{})
+	go func() {
+		defer close(s.maintenanceDoneCh)
+		s.maintainStore(s.maintenanceStopCh)
+	}()
+
 	return s, nil
 }
 
+func (s *Service) registerClientRoutes(router *mux.Router) {
+	router.HandleFunc("/register", s.registerClient)
+	router.HandleFunc("/unregister", s.unregisterClient)
+}
+
+// registerAdminRoutes registers the client and store management endpoints,
+// which are only served by the admin listener when it's enabled.
+func (s *Service) registerAdminRoutes(router *mux.Router) {
+	router.HandleFunc("/clients", s.handleListClients).Methods("GET")
+	router.HandleFunc("/clients/{id}/rotate", s.handleRotateClientKey).Methods("POST")
+	router.HandleFunc("/clients/{id}/sessions", s.handleDeleteClientSessions).Methods("DELETE")
+	router.Handle("/store/stats", s.adminOnly(http.HandlerFunc(s.handleGetStoreStats))).Methods("GET")
+	router.Handle("/store/compact", s.adminOnly(http.HandlerFunc(s.handleCompactStore))).Methods("POST")
+	router.Handle("/store/snapshot", s.adminOnly(http.HandlerFunc(s.handleGetStoreSnapshot))).Methods("GET")
+	router.Handle("/store/reencrypt", s.adminOnly(http.HandlerFunc(s.handleReencryptStore))).Methods("POST")
+}
+
+// registerDebugRoutes registers the pprof endpoints, if enabled. Profiles may
+// contain sensitive data (e.g. client keys) so they are restricted to the admin.
+func (s *Service) registerDebugRoutes(router *mux.Router) {
+	if !s.cfg.API.EnableDebug {
+		return
+	}
+
+	router.Handle("/debug/pprof/heap", s.adminOnly(pprof.Handler("heap")))
+	router.Handle("/debug/pprof/goroutine", s.adminOnly(pprof.Handler("goroutine")))
+	router.Handle("/debug/pprof/mutex", s.adminOnly(pprof.Handler("mutex")))
+	router.Handle("/debug/pprof/profile", s.adminOnly(http.HandlerFunc(pprof.Profile)))
+	router.Handle("/debug/pprof/trace", s.adminOnly(http.HandlerFunc(pprof.Trace)))
+}
+
 func (s *Service) Start() error {
 	if err := s.apiServer.Start(); err != nil {
 		return fmt.Errorf("failed to start api server: %w", err)
 	}
+	if s.adminServer != nil {
+		if err := s.adminServer.Start(); err != nil {
+			return fmt.Errorf("failed to start admin api server: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReloadCertificates reloads the TLS certificates served by the API.
+func (s *Service) ReloadCertificates() error {
+	if err := s.apiServer.ReloadCertificate(); err != nil {
+		return fmt.Errorf("failed to reload api server certificate: %w", err)
+	}
+	if s.adminServer != nil {
+		if err := s.adminServer.ReloadCertificate(); err != nil {
+			return fmt.Errorf("failed to reload admin api server certificate: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -114,6 +235,17 @@ func (s *Service) Stop() error {
 		return fmt.Errorf("failed to stop api server: %w", err)
 	}
 
+	if s.adminServer != nil {
+		if err := s.adminServer.Stop(); err != nil {
+			return fmt.Errorf("failed to stop admin api server: %w", err)
+		}
+	}
+
+	s.sessions.Close()
+
+	close(s.maintenanceStopCh)
+	<-s.maintenanceDoneCh
+
 	if err := s.store.Close(); err != nil {
 		return fmt.Errorf("failed to close store: %w", err)
 	}
@@ -4,16 +4,35 @@
 package store
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"git.mills.io/prologic/bitcask"
 )
 
+// noExpiry is the TTL of entries that should never expire. Bitcask doesn't
+// clear the expiration of a key when it's overwritten through a plain Put, so
+// all writes carry one.
+const noExpiry = 100 * 365 * 24 * time.Hour
+
+// journalChunkMaxSize is the size, in bytes, above which journaled operations
+// are split into another chunk. It leaves room for encoding within bitcask's
+// default maximum value size.
+const journalChunkMaxSize = 32 << 10
+
 type bitcaskStore struct {
 	db  *bitcask.Bitcask
 	mut sync.RWMutex
+	// pendingJournal is set when a committed batch couldn't be cleared from
+	// the journal. It then gets replayed before any other write, rather than
+	// on the next open where it would overwrite them.
+	pendingJournal bool
 }
 
 func newBitcaskStore(path string) (*bitcaskStore, error) {
@@ -25,19 +44,41 @@ func newBitcaskStore(path string) (*bitcaskStore, error) {
 		return nil, err
 	}
 
-	return &bitcaskStore{
+	s := &bitcaskStore{
 		db: db,
-	}, nil
+	}
+
+	if err := s.replayJournal(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *bitcaskStore) put(key, value string, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = noExpiry
+	}
+	return s.db.PutWithTTL([]byte(key), []byte(value), ttl)
 }
 
 func (s *bitcaskStore) Set(key, value string) error {
+	return s.SetWithTTL(key, value, 0)
+}
+
+func (s *bitcaskStore) SetWithTTL(key, value string, ttl time.Duration) error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 	if key == "" {
 		return ErrEmptyKey
 	}
 
-	err := s.db.Put([]byte(key), []byte(value))
+	if err := s.replayPendingJournal(); err != nil {
+		return err
+	}
+
+	err := s.put(key, value, ttl)
 	if err != nil {
 		return fmt.Errorf("failed to set key: %w", err)
 	}
@@ -56,11 +97,15 @@ func (s *bitcaskStore) Put(key, value string) error {
 		return ErrEmptyKey
 	}
 
+	if err := s.replayPendingJournal(); err != nil {
+		return err
+	}
+
 	if s.db.Has([]byte(key)) {
 		return ErrConflict
 	}
 
-	err := s.db.Put([]byte(key), []byte(value))
+	err := s.put(key, value, 0)
 	if err != nil {
 		return fmt.Errorf("failed to set key: %w", err)
 	}
@@ -79,7 +124,7 @@ func (s *bitcaskStore) Get(key string) (string, error) {
 		return "", ErrEmptyKey
 	}
 	val, err := s.db.Get([]byte(key))
-	if errors.Is(err, bitcask.ErrKeyNotFound) {
+	if errors.Is(err, bitcask.ErrKeyNotFound) || errors.Is(err, bitcask.ErrKeyExpired) {
 		return "", ErrNotFound
 	} else if err != nil {
 		return "", fmt.Errorf("failed to get key: %w", err)
@@ -94,6 +139,10 @@ func (s *bitcaskStore) Delete(key string) error {
 		return ErrEmptyKey
 	}
 
+	if err := s.replayPendingJournal(); err != nil {
+		return err
+	}
+
 	err := s.db.Delete([]byte(key))
 	if err != nil {
 		return fmt.Errorf("failed to delete key: %w", err)
@@ -106,6 +155,417 @@ func (s *bitcaskStore) Delete(key string) error {
 	return nil
 }
 
+func (s *bitcaskStore) scanKeys(prefix string) ([]string, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	var keys []string
+	if err := s.db.Scan([]byte(prefix), func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to scan keys: %w", err)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (s *bitcaskStore) Scan(prefix string, fn func(key, value string) error) error {
+	// Values are fetched one at a time, without holding the lock while
+	// calling fn, so that it can safely write to the store.
+	keys, err := s.scanKeys(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		val, err := s.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(key, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *bitcaskStore) Dump(fn func(key, value string, expiresAt time.Time) error) error {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	var keys []string
+	if err := s.db.Fold(func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to list keys: %w", err)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// A journaled batch is only meaningful to this store.
+		if strings.HasPrefix(key, JournalKeyPrefix) {
+			continue
+		}
+		val, err := s.db.Get([]byte(key))
+		if errors.Is(err, bitcask.ErrKeyExpired) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to get key: %w", err)
+		}
+		if err := fn(key, string(val), time.Time{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *bitcaskStore) Count(prefix string) (int, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	var keys [][]byte
+	if err := s.db.Scan([]byte(prefix), func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to scan keys: %w", err)
+	}
+
+	// Scanning includes expired keys which haven't been removed yet.
+	var n int
+	for _, key := range keys {
+		if s.db.Has(key) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Write applies the batch while holding the write lock. Bitcask has no
+// transactions so the batch is first journaled, and only considered committed
+// once fully persisted (see journal). Should any operation then fail, the
+// previous values of the keys already written are restored. A committed batch
+// which couldn't be either fully applied or rolled back, e.g. because the
+// process crashed, is replayed when the store is opened again.
+func (s *bitcaskStore) Write(b *Batch) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if err := b.isValid(); err != nil {
+		return err
+	}
+
+	if b.Len() == 0 {
+		return nil
+	}
+
+	if err := s.replayPendingJournal(); err != nil {
+		return err
+	}
+
+	if err := s.journal(b.ops); err != nil {
+		return fmt.Errorf("failed to journal batch: %w", err)
+	}
+
+	type prevValue struct {
+		key   string
+		value []byte
+		found bool
+	}
+	var prev []prevValue
+	seen := make(map[string]bool, len(b.ops))
+
+	// The journal is only cleared once the batch is rolled back, so that it
+	// gets replayed otherwise.
+	rollback := func() error {
+		s.pendingJournal = true
+		for i := len(prev) - 1; i >= 0; i-- {
+			var err error
+			if prev[i].found {
+				// Any expiration of the previous value is lost.
+				err = s.put(prev[i].key, string(prev[i].value), 0)
+			} else {
+				err = s.db.Delete([]byte(prev[i].key))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := s.db.Sync(); err != nil {
+			return err
+		}
+		if err := s.clearJournal(); err != nil {
+			return err
+		}
+		s.pendingJournal = false
+		return nil
+	}
+
+	for _, op := range b.ops {
+		if !seen[op.key] {
+			seen[op.key] = true
+			val, err := s.db.Get([]byte(op.key))
+			if err != nil && !errors.Is(err, bitcask.ErrKeyNotFound) && !errors.Is(err, bitcask.ErrKeyExpired) {
+				if rbErr := rollback(); rbErr != nil {
+					return fmt.Errorf("failed to roll back batch: %w", rbErr)
+				}
+				return fmt.Errorf("failed to get key: %w", err)
+			}
+			prev = append(prev, prevValue{key: op.key, value: val, found: err == nil})
+		}
+
+		if err := s.apply(op); err != nil {
+			if rbErr := rollback(); rbErr != nil {
+				return fmt.Errorf("failed to roll back batch: %w", rbErr)
+			}
+			return fmt.Errorf("failed to write batch: %w", err)
+		}
+	}
+
+	if err := s.db.Sync(); err != nil {
+		s.pendingJournal = true
+		return fmt.Errorf("failed to sync db: %w", err)
+	}
+
+	if err := s.clearJournal(); err != nil {
+		s.pendingJournal = true
+		return fmt.Errorf("failed to clear journal: %w", err)
+	}
+
+	return nil
+}
+
+// replayPendingJournal replays the batch left in the journal by a previous
+// Write, if any.
+func (s *bitcaskStore) replayPendingJournal() error {
+	if !s.pendingJournal {
+		return nil
+	}
+	if err := s.replayJournal(); err != nil {
+		return err
+	}
+	s.pendingJournal = false
+	return nil
+}
+
+func (s *bitcaskStore) apply(op batchOp) error {
+	if op.delete {
+		return s.db.Delete([]byte(op.key))
+	}
+
+	var ttl time.Duration
+	if !op.expiresAt.IsZero() {
+		ttl = time.Until(op.expiresAt)
+		if ttl <= 0 {
+			return s.db.Delete([]byte(op.key))
+		}
+	}
+
+	return s.put(op.key, op.value, ttl)
+}
+
+// journalOp is the representation of a batch operation in the journal.
+type journalOp struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	// The expiration, in Unix milliseconds, if any.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	Delete    bool  `json:"delete,omitempty"`
+}
+
+func newJournalOp(op batchOp) journalOp {
+	jop := journalOp{Key: op.key, Value: op.value, Delete: op.delete}
+	if !op.expiresAt.IsZero() {
+		jop.ExpiresAt = op.expiresAt.UnixMilli()
+	}
+	return jop
+}
+
+func (op journalOp) batchOp() batchOp {
+	bop := batchOp{key: op.Key, value: op.Value, delete: op.Delete}
+	if op.ExpiresAt != 0 {
+		bop.expiresAt = time.UnixMilli(op.ExpiresAt)
+	}
+	return bop
+}
+
+func journalChunkKey(i int) string {
+	return JournalKeyPrefix + "_" + strconv.Itoa(i)
+}
+
+// journal saves the given operations in chunks fitting within the maximum
+// value size, followed by the number of chunks under JournalKeyPrefix. Writing
+// that last entry is atomic and commits the batch: chunks without it are
+// discarded.
+func (s *bitcaskStore) journal(ops []batchOp) error {
+	var chunks [][]journalOp
+	var chunk []journalOp
+	var size int
+	for _, op := range ops {
+		opSize := len(op.key) + len(op.value)
+		if len(chunk) > 0 && size+opSize > journalChunkMaxSize {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, newJournalOp(op))
+		size += opSize
+	}
+	chunks = append(chunks, chunk)
+
+	for i, chunk := range chunks {
+		data, err := json.Marshal(chunk)
+		if err == nil {
+			err = s.put(journalChunkKey(i), string(data), 0)
+		}
+		if err != nil {
+			// Chunks left behind are discarded on the next journal clear.
+			_ = s.clearJournal()
+			return err
+		}
+	}
+
+	if err := s.db.Sync(); err != nil {
+		return err
+	}
+
+	if err := s.put(JournalKeyPrefix, strconv.Itoa(len(chunks)), 0); err != nil {
+		_ = s.clearJournal()
+		return err
+	}
+
+	return s.db.Sync()
+}
+
+// clearJournal removes the journaled batch, if any, starting with its commit
+// entry.
+func (s *bitcaskStore) clearJournal() error {
+	var keys [][]byte
+	if err := s.db.Scan([]byte(JournalKeyPrefix), func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if s.db.Has([]byte(JournalKeyPrefix)) {
+		if err := s.db.Delete([]byte(JournalKeyPrefix)); err != nil {
+			return err
+		}
+		if err := s.db.Sync(); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range keys {
+		if string(key) == JournalKeyPrefix {
+			continue
+		}
+		if err := s.db.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Sync()
+}
+
+// replayJournal applies the batch journaled by Write if it was committed but
+// not cleared, e.g. because the process stopped in the meantime.
+func (s *bitcaskStore) replayJournal() error {
+	data, err := s.db.Get([]byte(JournalKeyPrefix))
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
+		return s.clearJournal()
+	} else if err != nil {
+		return fmt.Errorf("failed to get journal: %w", err)
+	}
+
+	n, err := strconv.Atoi(string(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse journal: %w", err)
+	}
+
+	for i := 0; i < n; i++ {
+		data, err := s.db.Get([]byte(journalChunkKey(i)))
+		if err != nil {
+			return fmt.Errorf("failed to get journal chunk: %w", err)
+		}
+		var ops []journalOp
+		if err := json.Unmarshal(data, &ops); err != nil {
+			return fmt.Errorf("failed to parse journal chunk: %w", err)
+		}
+		for _, op := range ops {
+			if err := s.apply(op.batchOp()); err != nil {
+				return fmt.Errorf("failed to replay journal: %w", err)
+			}
+		}
+	}
+
+	if err := s.db.Sync(); err != nil {
+		return fmt.Errorf("failed to sync db: %w", err)
+	}
+
+	if err := s.clearJournal(); err != nil {
+		return fmt.Errorf("failed to clear journal: %w", err)
+	}
+
+	return nil
+}
+
+func (s *bitcaskStore) DeleteExpired() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if err := s.db.RunGC(); err != nil {
+		return fmt.Errorf("failed to delete expired keys: %w", err)
+	}
+
+	if err := s.db.Sync(); err != nil {
+		return fmt.Errorf("failed to sync db: %w", err)
+	}
+
+	return nil
+}
+
+func (s *bitcaskStore) Stats() (Stats, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	stats, err := s.db.Stats()
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to get stats: %w", err)
+	}
+
+	return Stats{
+		Keys:             stats.Keys,
+		SizeBytes:        stats.Size,
+		ReclaimableBytes: s.db.Reclaimable(),
+	}, nil
+}
+
+// Compact merges the data files, holding the write lock so that no entry is
+// written while merging.
+func (s *bitcaskStore) Compact() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if err := s.db.Merge(); err != nil {
+		return fmt.Errorf("failed to merge db: %w", err)
+	}
+
+	return nil
+}
+
 func (s *bitcaskStore) Close() error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
@@ -0,0 +1,87 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"git.mills.io/prologic/bitcask"
+)
+
+// MigrateBitcaskToSQLite copies all the entries of the bitcask store found in
+// bitcaskDir into the SQLite database at sqlitePath, which is created if
+// needed. The copy happens in a single transaction and is refused if the
+// SQLite store already holds any entry, so that it can only be applied once.
+// Expired entries are skipped. Bitcask doesn't expose the expiration of the
+// others so these are copied without one: sessions, token revocations and job
+// records that have since expired are deleted on start instead.
+// It returns the number of copied entries.
+func MigrateBitcaskToSQLite(bitcaskDir, sqlitePath string) (int, error) {
+	// Opening a bitcask store creates the directory if missing, which would
+	// silently migrate nothing out of a mistyped path.
+	if _, err := os.Stat(bitcaskDir); err != nil {
+		return 0, fmt.Errorf("failed to find bitcask store: %w", err)
+	}
+
+	src, err := newBitcaskStore(bitcaskDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open bitcask store: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := newSQLiteStore(sqlitePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open sqlite store: %w", err)
+	}
+	defer dst.Close()
+
+	src.mut.RLock()
+	defer src.mut.RUnlock()
+
+	var keys [][]byte
+	if err := src.db.Fold(func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to list keys: %w", err)
+	}
+
+	tx, err := dst.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		// A no-op once the transaction is committed.
+		_ = tx.Rollback()
+	}()
+
+	var count, copied int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM kv`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count entries: %w", err)
+	}
+	if count > 0 {
+		return 0, errors.New("sqlite store is not empty")
+	}
+
+	for _, key := range keys {
+		value, err := src.db.Get(key)
+		if errors.Is(err, bitcask.ErrKeyExpired) {
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to get key %q: %w", key, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO kv (key, value) VALUES (?, ?)`, string(key), string(value)); err != nil {
+			return 0, fmt.Errorf("failed to insert key %q: %w", key, err)
+		}
+		copied++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return copied, nil
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package store
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by
+// WriteSnapshot. It should be increased on any incompatible change.
+//
+// A snapshot is a gzip compressed tar archive holding, in order:
+//   - manifest.json: a SnapshotManifest.
+//   - entries.jsonl: one {"key": ..., "value": ..., "expires_at": ...} object
+//     per line, expires_at being in Unix milliseconds and omitted for entries
+//     that never expire.
+//
+// Entries are stored independently of the backend so that a snapshot can be
+// restored into a store using a different driver.
+//
+// Version 2 added expires_at.
+const SnapshotVersion = 2
+
+const (
+	snapshotManifestName = "manifest.json"
+	snapshotEntriesName  = "entries.jsonl"
+	// snapshotMaxManifestSize limits the memory used when reading an archive.
+	snapshotMaxManifestSize = 64 * 1024
+)
+
+// SnapshotManifest describes the content of a snapshot.
+type SnapshotManifest struct {
+	Version int `json:"version"`
+	// The time the snapshot was taken, in Unix milliseconds.
+	CreatedAt int64 `json:"created_at"`
+	// The driver of the store the snapshot was taken from.
+	Driver Driver `json:"driver"`
+	// The number of entries in the snapshot.
+	Entries int `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+// WriteSnapshot writes a point-in-time snapshot of all the entries in st to
+// w. Entries are first written to a temporary file so that writes to the
+// store are only blocked while reading them, not while writing to w, without
+// holding the whole store in memory. Expirations are preserved, except for
+// bitcask stores which can't expose them.
+func WriteSnapshot(st Store, driver Driver, w io.Writer) (SnapshotManifest, error) {
+	manifest := SnapshotManifest{
+		Version: SnapshotVersion,
+		Driver:  driver,
+	}
+
+	// The file holds credentials, CreateTemp makes it only readable by us.
+	entries, err := os.CreateTemp("", "calls-offloader-snapshot-*")
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = entries.Close()
+		_ = os.Remove(entries.Name())
+	}()
+
+	bw := bufio.NewWriter(entries)
+	enc := json.NewEncoder(bw)
+	err = st.Dump(func(key, value string, expiresAt time.Time) error {
+		manifest.Entries++
+		entry := snapshotEntry{Key: key, Value: value}
+		if !expiresAt.IsZero() {
+			entry.ExpiresAt = expiresAt.UnixMilli()
+		}
+		return enc.Encode(entry)
+	})
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to dump store: %w", err)
+	}
+	manifest.CreatedAt = time.Now().UnixMilli()
+	if err := bw.Flush(); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to write entries: %w", err)
+	}
+
+	entriesSize, err := entries.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to get entries size: %w", err)
+	}
+	if _, err := entries.Seek(0, io.SeekStart); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to rewind entries: %w", err)
+	}
+
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	for _, file := range []struct {
+		name string
+		size int64
+		r    io.Reader
+	}{
+		{snapshotManifestName, int64(len(manifestData)), bytes.NewReader(manifestData)},
+		{snapshotEntriesName, entriesSize, entries},
+	} {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    file.name,
+			Mode:    0600,
+			Size:    file.size,
+			ModTime: time.UnixMilli(manifest.CreatedAt),
+		}); err != nil {
+			return SnapshotManifest{}, fmt.Errorf("failed to write header: %w", err)
+		}
+		if _, err := io.Copy(tw, file.r); err != nil {
+			return SnapshotManifest{}, fmt.Errorf("failed to write %s: %w", file.name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to close archive: %w", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to close archive: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// isEmptyDataSource returns whether the given path is missing, an empty
+// directory or an empty file.
+func isEmptyDataSource(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if !info.IsDir() {
+		return info.Size() == 0, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return false, err
+	}
+
+	return len(entries) == 0, nil
+}
+
+// RestoreSnapshot loads the snapshot read from r into a new store created
+// with the given driver at dataSource, which should be empty. The snapshot is
+// fully read and validated before creating the store, and all the entries are
+// then written in a single batch so that a failed restore leaves the store
+// empty. Entries that expired since the snapshot was taken are skipped.
+func RestoreSnapshot(r io.Reader, driver Driver, dataSource string) (SnapshotManifest, error) {
+	if empty, err := isEmptyDataSource(dataSource); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to check data source: %w", err)
+	} else if !empty {
+		return SnapshotManifest{}, fmt.Errorf("data source %q is not empty", dataSource)
+	}
+
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if hdr.Name != snapshotManifestName {
+		return SnapshotManifest{}, fmt.Errorf("unexpected file %q: %s should come first", hdr.Name, snapshotManifestName)
+	}
+
+	var manifest SnapshotManifest
+	if err := json.NewDecoder(io.LimitReader(tr, snapshotMaxManifestSize)).Decode(&manifest); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if manifest.Version < 1 || manifest.Version > SnapshotVersion {
+		return SnapshotManifest{}, fmt.Errorf("unsupported snapshot version %d", manifest.Version)
+	}
+
+	hdr, err = tr.Next()
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if hdr.Name != snapshotEntriesName {
+		return SnapshotManifest{}, fmt.Errorf("unexpected file %q", hdr.Name)
+	}
+
+	var b Batch
+	var n int
+	now := time.Now()
+	scanner := bufio.NewScanner(tr)
+	// Lines hold whole entries so these can be larger than the default limit.
+	scanner.Buffer(nil, int(hdr.Size)+1)
+	for scanner.Scan() {
+		n++
+		var entry snapshotEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return SnapshotManifest{}, fmt.Errorf("failed to decode entry %d: %w", n, err)
+		}
+
+		if entry.ExpiresAt == 0 {
+			b.Set(entry.Key, entry.Value)
+			continue
+		}
+
+		expiresAt := time.UnixMilli(entry.ExpiresAt)
+		if !expiresAt.After(now) {
+			continue
+		}
+		b.SetWithExpiration(entry.Key, entry.Value, expiresAt)
+	}
+	if err := scanner.Err(); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to read entries: %w", err)
+	}
+	if n != manifest.Entries {
+		return SnapshotManifest{}, fmt.Errorf("snapshot is incomplete: expected %d entries, got %d", manifest.Entries, n)
+	}
+
+	if err := b.isValid(); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("invalid entry: %w", err)
+	}
+
+	st, err := NewWithDriver(driver, dataSource)
+	if err != nil {
+		return SnapshotManifest{}, fmt.Errorf("failed to open store: %w", err)
+	}
+
+	if err := st.Write(&b); err != nil {
+		_ = st.Close()
+		return SnapshotManifest{}, fmt.Errorf("failed to write entries: %w", err)
+	}
+
+	if err := st.Close(); err != nil {
+		return SnapshotManifest{}, err
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestSnapshot(t *testing.T, manifest SnapshotManifest, entries string) *bytes.Buffer {
+	t.Helper()
+
+	manifestData, err := json.Marshal(manifest)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for name, data := range map[string][]byte{
+		snapshotManifestName: manifestData,
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: snapshotEntriesName, Mode: 0600, Size: int64(len(entries))}))
+	_, err = tw.Write([]byte(entries))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+
+	return &buf
+}
+
+func TestSnapshot(t *testing.T) {
+	entries := map[string]string{
+		"clientA":       `{"key_hash":"hash"}`,
+		"clients_index": `["clientA"]`,
+		"job_abc":       `{"type":"recording","start_at":100}`,
+		"multiline":     "first\nsecond",
+	}
+
+	for _, tc := range []struct {
+		name string
+		from Driver
+		to   Driver
+	}{
+		{"bitcask to sqlite", DriverBitcask, DriverSQLite},
+		{"sqlite to bitcask", DriverSQLite, DriverBitcask},
+		{"bitcask to bitcask", DriverBitcask, DriverBitcask},
+		{"sqlite to sqlite", DriverSQLite, DriverSQLite},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srcPath := t.TempDir()
+			if tc.from == DriverSQLite {
+				srcPath = filepath.Join(srcPath, "offloader.db")
+			}
+			src, err := NewWithDriver(tc.from, srcPath)
+			require.NoError(t, err)
+			defer src.Close()
+
+			for key, value := range entries {
+				require.NoError(t, src.Set(key, value))
+			}
+			require.NoError(t, src.SetWithTTL("job_expired", "value", time.Millisecond))
+			require.NoError(t, src.SetWithTTL("session_abc", "value", time.Hour))
+			time.Sleep(5 * time.Millisecond)
+
+			var buf bytes.Buffer
+			manifest, err := WriteSnapshot(src, tc.from, &buf)
+			require.NoError(t, err)
+			require.Equal(t, SnapshotVersion, manifest.Version)
+			require.Equal(t, tc.from, manifest.Driver)
+			require.Equal(t, len(entries)+1, manifest.Entries)
+			require.NotZero(t, manifest.CreatedAt)
+
+			dstPath := filepath.Join(t.TempDir(), "restored")
+			restored, err := RestoreSnapshot(&buf, tc.to, dstPath)
+			require.NoError(t, err)
+			require.Equal(t, manifest, restored)
+
+			dst, err := NewWithDriver(tc.to, dstPath)
+			require.NoError(t, err)
+			defer dst.Close()
+
+			n, err := dst.Count("")
+			require.NoError(t, err)
+			require.Equal(t, len(entries)+1, n)
+			for key, value := range entries {
+				val, err := dst.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, value, val)
+			}
+
+			// Bitcask doesn't expose expirations so these can only be
+			// preserved, and checked, with sqlite.
+			if tc.to != DriverSQLite {
+				return
+			}
+			var expiresAt time.Time
+			require.NoError(t, dst.Dump(func(key, _ string, exp time.Time) error {
+				if key == "session_abc" {
+					expiresAt = exp
+				} else {
+					require.Zero(t, exp)
+				}
+				return nil
+			}))
+			if tc.from == DriverSQLite {
+				require.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+			} else {
+				require.Zero(t, expiresAt)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	src, err := New(t.TempDir())
+	require.NoError(t, err)
+	defer src.Close()
+	require.NoError(t, src.Set("key", "value"))
+
+	var snapshot bytes.Buffer
+	_, err = WriteSnapshot(src, DriverBitcask, &snapshot)
+	require.NoError(t, err)
+
+	t.Run("not empty", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0600))
+
+		_, err := RestoreSnapshot(bytes.NewReader(snapshot.Bytes()), DriverBitcask, dir)
+		require.EqualError(t, err, `data source "`+dir+`" is not empty`)
+
+		_, err = RestoreSnapshot(bytes.NewReader(snapshot.Bytes()), DriverSQLite, filepath.Join(dir, "file"))
+		require.Error(t, err)
+	})
+
+	t.Run("empty directory", func(t *testing.T) {
+		dir := t.TempDir()
+		manifest, err := RestoreSnapshot(bytes.NewReader(snapshot.Bytes()), DriverBitcask, dir)
+		require.NoError(t, err)
+		require.Equal(t, 1, manifest.Entries)
+	})
+
+	t.Run("invalid archive", func(t *testing.T) {
+		_, err := RestoreSnapshot(bytes.NewReader([]byte("invalid")), DriverBitcask, filepath.Join(t.TempDir(), "db"))
+		require.Error(t, err)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		buf := writeTestSnapshot(t, SnapshotManifest{Version: SnapshotVersion + 1}, "")
+		_, err := RestoreSnapshot(buf, DriverBitcask, filepath.Join(t.TempDir(), "db"))
+		require.EqualError(t, err, "unsupported snapshot version 3")
+	})
+
+	t.Run("version 1", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "db")
+		buf := writeTestSnapshot(t, SnapshotManifest{Version: 1, Entries: 1}, `{"key":"key","value":"value"}`+"\n")
+		_, err := RestoreSnapshot(buf, DriverSQLite, dir)
+		require.NoError(t, err)
+
+		st, err := NewWithDriver(DriverSQLite, dir)
+		require.NoError(t, err)
+		defer st.Close()
+		val, err := st.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, "value", val)
+	})
+
+	t.Run("expired entries", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "db")
+		entries := fmt.Sprintf(`{"key":"expired","value":"value","expires_at":%d}`+"\n"+`{"key":"valid","value":"value","expires_at":%d}`+"\n",
+			time.Now().Add(-time.Minute).UnixMilli(), time.Now().Add(time.Minute).UnixMilli())
+		buf := writeTestSnapshot(t, SnapshotManifest{Version: SnapshotVersion, Entries: 2}, entries)
+		_, err := RestoreSnapshot(buf, DriverSQLite, dir)
+		require.NoError(t, err)
+
+		st, err := NewWithDriver(DriverSQLite, dir)
+		require.NoError(t, err)
+		defer st.Close()
+		n, err := st.Count("")
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		_, err = st.Get("valid")
+		require.NoError(t, err)
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "db")
+		buf := writeTestSnapshot(t, SnapshotManifest{Version: SnapshotVersion, Entries: 2}, `{"key":"key","value":"value"}`+"\n")
+		_, err := RestoreSnapshot(buf, DriverBitcask, dir)
+		require.EqualError(t, err, "snapshot is incomplete: expected 2 entries, got 1")
+
+		// Nothing should be written.
+		empty, err := isEmptyDataSource(dir)
+		require.NoError(t, err)
+		require.True(t, empty)
+	})
+
+	t.Run("invalid entry", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "db")
+		buf := writeTestSnapshot(t, SnapshotManifest{Version: SnapshotVersion, Entries: 1}, `{"key":""}`+"\n")
+		_, err := RestoreSnapshot(buf, DriverBitcask, dir)
+		require.ErrorIs(t, err, ErrEmptyKey)
+
+		empty, err := isEmptyDataSource(dir)
+		require.NoError(t, err)
+		require.True(t, empty)
+	})
+}
@@ -0,0 +1,410 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	// Registers the pure Go "sqlite" driver.
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations holds the schema changes, applied in order. The schema
+// version is the number of migrations applied so existing entries should
+// never be modified, only appended to.
+var sqliteMigrations = []string{
+	// 1: the key-value table backing the Store interface.
+	`CREATE TABLE kv (
+		key TEXT NOT NULL PRIMARY KEY,
+		value TEXT NOT NULL
+	) WITHOUT ROWID`,
+
+	// 2: job records are saved as JSON under the job_ prefix. Generated
+	// columns expose their fields so that jobs can be queried through indexes
+	// (e.g. by type or time range). Columns are NULL for any other key.
+	`ALTER TABLE kv ADD COLUMN job_type TEXT GENERATED ALWAYS AS (
+		CASE WHEN key GLOB 'job_*' AND json_valid(value) THEN json_extract(value, '$.type') END
+	) VIRTUAL;
+	ALTER TABLE kv ADD COLUMN job_start_at INTEGER GENERATED ALWAYS AS (
+		CASE WHEN key GLOB 'job_*' AND json_valid(value) THEN json_extract(value, '$.start_at') END
+	) VIRTUAL;
+	ALTER TABLE kv ADD COLUMN job_stop_at INTEGER GENERATED ALWAYS AS (
+		CASE WHEN key GLOB 'job_*' AND json_valid(value) THEN json_extract(value, '$.stop_at') END
+	) VIRTUAL;
+	CREATE INDEX idx_kv_job_type ON kv (job_type, job_start_at) WHERE job_type IS NOT NULL;
+	CREATE INDEX idx_kv_job_start_at ON kv (job_start_at) WHERE job_start_at IS NOT NULL;
+	CREATE INDEX idx_kv_job_stop_at ON kv (job_stop_at) WHERE job_stop_at IS NOT NULL`,
+
+	// 3: entries set with a TTL store their expiration time, in milliseconds
+	// since epoch. It's NULL for entries that never expire.
+	`ALTER TABLE kv ADD COLUMN expires_at INTEGER;
+	CREATE INDEX idx_kv_expires_at ON kv (expires_at) WHERE expires_at IS NOT NULL`,
+}
+
+// notExpired is the condition matching entries which haven't expired as of
+// the time passed as argument.
+const notExpired = `(expires_at IS NULL OR expires_at > ?)`
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// newSQLiteStore opens, or creates, the SQLite database file found at path
+// and migrates its schema to the latest version.
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		return nil, errors.New("invalid path: should not be empty")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Creating the file upfront so that it isn't readable by others.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close database file: %w", err)
+	}
+
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(FULL)")
+	params.Add("_txlock", "immediate")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// A single connection serializes writes, matching the bitcask store.
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{
+		db: db,
+	}
+
+	if err := s.migrate(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *sqliteStore) migrate() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// A no-op once the transaction is committed.
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("schema version %d is newer than the supported one (%d)", version, len(sqliteMigrations))
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+			i+1, time.Now().UnixMilli()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Set(key, value string) error {
+	return s.SetWithTTL(key, value, 0)
+}
+
+func (s *sqliteStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	var expiresAt *int64
+	if ttl != 0 {
+		ts := time.Now().Add(ttl).UnixMilli()
+		expiresAt = &ts
+	}
+
+	_, err := s.db.Exec(`INSERT INTO kv (key, value, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`, key, value, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to set key: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Put(key, value string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	// An expired entry, not yet removed, doesn't conflict.
+	res, err := s.db.Exec(`INSERT INTO kv (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = NULL
+		WHERE NOT `+notExpired, key, value, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to set key: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to set key: %w", err)
+	}
+	if n == 0 {
+		return ErrConflict
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Get(key string) (string, error) {
+	if key == "" {
+		return "", ErrEmptyKey
+	}
+
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM kv WHERE key = ? AND `+notExpired,
+		key, time.Now().UnixMilli()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get key: %w", err)
+	}
+
+	return value, nil
+}
+
+func (s *sqliteStore) Delete(key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	if _, err := s.db.Exec(`DELETE FROM kv WHERE key = ?`, key); err != nil {
+		return fmt.Errorf("failed to delete key: %w", err)
+	}
+
+	return nil
+}
+
+// prefixRange returns the condition, and its arguments, matching the keys
+// starting with prefix. A range is used, rather than LIKE or GLOB, so that
+// the primary key index applies and no character needs escaping.
+func prefixRange(prefix string) (string, []any) {
+	if prefix == "" {
+		return "1", nil
+	}
+
+	// The upper bound is the smallest string greater than all those starting
+	// with prefix, if any.
+	upper := []byte(prefix)
+	for len(upper) > 0 && upper[len(upper)-1] == 0xff {
+		upper = upper[:len(upper)-1]
+	}
+	if len(upper) == 0 {
+		return "key >= ?", []any{prefix}
+	}
+	upper[len(upper)-1]++
+
+	return "key >= ? AND key < ?", []any{prefix, string(upper)}
+}
+
+func (s *sqliteStore) scanKeys(prefix string) ([]string, error) {
+	cond, args := prefixRange(prefix)
+	rows, err := s.db.Query(`SELECT key FROM kv WHERE `+cond+` AND `+notExpired+` ORDER BY key`,
+		append(args, time.Now().UnixMilli())...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan keys: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (s *sqliteStore) Scan(prefix string, fn func(key, value string) error) error {
+	// Keys are collected upfront as the single connection would otherwise be
+	// held while calling fn, preventing it from writing to the store.
+	keys, err := s.scanKeys(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		val, err := s.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(key, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Dump reads all the entries through a single query. The only connection is
+// held until it returns, blocking writes.
+func (s *sqliteStore) Dump(fn func(key, value string, expiresAt time.Time) error) error {
+	rows, err := s.db.Query(`SELECT key, value, expires_at FROM kv WHERE `+notExpired+` ORDER BY key`, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to query entries: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		var expiresAt sql.NullInt64
+		if err := rows.Scan(&key, &value, &expiresAt); err != nil {
+			return fmt.Errorf("failed to scan entry: %w", err)
+		}
+		var expiration time.Time
+		if expiresAt.Valid {
+			expiration = time.UnixMilli(expiresAt.Int64)
+		}
+		if err := fn(key, value, expiration); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query entries: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Count(prefix string) (int, error) {
+	cond, args := prefixRange(prefix)
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM kv WHERE `+cond+` AND `+notExpired,
+		append(args, time.Now().UnixMilli())...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count keys: %w", err)
+	}
+	return n, nil
+}
+
+func (s *sqliteStore) Write(b *Batch) error {
+	if err := b.isValid(); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		// A no-op once the transaction is committed.
+		_ = tx.Rollback()
+	}()
+
+	for _, op := range b.ops {
+		if op.delete {
+			_, err = tx.Exec(`DELETE FROM kv WHERE key = ?`, op.key)
+		} else {
+			var expiresAt *int64
+			if !op.expiresAt.IsZero() {
+				ms := op.expiresAt.UnixMilli()
+				expiresAt = &ms
+			}
+			_, err = tx.Exec(`INSERT INTO kv (key, value, expires_at) VALUES (?, ?, ?)
+				ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`, op.key, op.value, expiresAt)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write batch: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) DeleteExpired() error {
+	if _, err := s.db.Exec(`DELETE FROM kv WHERE expires_at <= ?`, time.Now().UnixMilli()); err != nil {
+		return fmt.Errorf("failed to delete expired keys: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Stats() (Stats, error) {
+	var stats Stats
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM kv`).Scan(&stats.Keys); err != nil {
+		return Stats{}, fmt.Errorf("failed to count keys: %w", err)
+	}
+
+	var pageSize, pageCount, freePages int64
+	if err := s.db.QueryRow(`SELECT page_size, page_count, freelist_count
+		FROM pragma_page_size(), pragma_page_count(), pragma_freelist_count()`).Scan(&pageSize, &pageCount, &freePages); err != nil {
+		return Stats{}, fmt.Errorf("failed to get page stats: %w", err)
+	}
+	stats.SizeBytes = pageSize * pageCount
+	stats.ReclaimableBytes = pageSize * freePages
+
+	return stats, nil
+}
+
+// Compact rebuilds the database file, dropping free pages, and truncates the
+// write-ahead log.
+func (s *sqliteStore) Compact() error {
+	if _, err := s.db.Exec(`VACUUM`); err != nil {
+		return fmt.Errorf("failed to vacuum db: %w", err)
+	}
+
+	if _, err := s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return fmt.Errorf("failed to checkpoint db: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("failed to close store: %w", err)
+	}
+	return nil
+}
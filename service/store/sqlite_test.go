@@ -0,0 +1,202 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package store
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWithDriver(t *testing.T) {
+	t.Run("invalid driver", func(t *testing.T) {
+		store, err := NewWithDriver("leveldb", t.TempDir())
+		require.EqualError(t, err, `invalid driver "leveldb"`)
+		require.Nil(t, store)
+	})
+
+	t.Run("invalid sqlite path", func(t *testing.T) {
+		store, err := NewWithDriver(DriverSQLite, "")
+		require.Error(t, err)
+		require.Nil(t, store)
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		store, err := NewWithDriver(DriverSQLite, filepath.Join(t.TempDir(), "db", "offloader.db"))
+		require.NoError(t, err)
+		require.NotNil(t, store)
+		err = store.Close()
+		require.NoError(t, err)
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "offloader.db")
+
+	store, err := newSQLiteStore(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	t.Run("empty key", func(t *testing.T) {
+		require.ErrorIs(t, store.Put("", "value"), ErrEmptyKey)
+		require.ErrorIs(t, store.Set("", "value"), ErrEmptyKey)
+		require.ErrorIs(t, store.Delete(""), ErrEmptyKey)
+		_, err := store.Get("")
+		require.ErrorIs(t, err, ErrEmptyKey)
+	})
+
+	t.Run("put", func(t *testing.T) {
+		_, err := store.Get("key")
+		require.Equal(t, ErrNotFound, err)
+
+		err = store.Put("key", "value")
+		require.NoError(t, err)
+
+		err = store.Put("key", "value2")
+		require.ErrorIs(t, err, ErrConflict)
+
+		val, err := store.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, "value", val)
+	})
+
+	t.Run("concurrent put", func(t *testing.T) {
+		var wg sync.WaitGroup
+		var nErrors int32
+		n := 10
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func() {
+				defer wg.Done()
+				if err := store.Put("key2", "value2"); err != nil {
+					atomic.AddInt32(&nErrors, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int32(n-1), nErrors)
+	})
+
+	t.Run("set", func(t *testing.T) {
+		err := store.Set("key", "updated")
+		require.NoError(t, err)
+
+		val, err := store.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, "updated", val)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		err := store.Delete("missing")
+		require.NoError(t, err)
+
+		err = store.Delete("key2")
+		require.NoError(t, err)
+
+		_, err = store.Get("key2")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("job indexes", func(t *testing.T) {
+		err := store.Set("job_a", `{"type":"recording","start_at":100,"stop_at":200}`)
+		require.NoError(t, err)
+		err = store.Set("job_b", `{"type":"transcribing","start_at":300}`)
+		require.NoError(t, err)
+		// Values that aren't valid JSON are still accepted.
+		err = store.Set("job_c", `not json`)
+		require.NoError(t, err)
+
+		var keys []string
+		rows, err := store.db.Query(`SELECT key FROM kv WHERE job_type = ? AND job_start_at >= ?`, "recording", 50)
+		require.NoError(t, err)
+		defer rows.Close()
+		for rows.Next() {
+			var key string
+			require.NoError(t, rows.Scan(&key))
+			keys = append(keys, key)
+		}
+		require.NoError(t, rows.Err())
+		require.Equal(t, []string{"job_a"}, keys)
+
+		var plan string
+		err = store.db.QueryRow(`EXPLAIN QUERY PLAN SELECT key FROM kv WHERE job_start_at > ?`, 50).Scan(new(int), new(int), new(int), &plan)
+		require.NoError(t, err)
+		require.Contains(t, plan, "idx_kv_job_start_at")
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		err := store.Close()
+		require.NoError(t, err)
+
+		store, err = newSQLiteStore(dbPath)
+		require.NoError(t, err)
+
+		var version int
+		err = store.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+		require.NoError(t, err)
+		require.Equal(t, len(sqliteMigrations), version)
+
+		val, err := store.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, "updated", val)
+	})
+
+	t.Run("newer schema", func(t *testing.T) {
+		_, err := store.db.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, 0)`, len(sqliteMigrations)+1)
+		require.NoError(t, err)
+
+		s, err := newSQLiteStore(dbPath)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "is newer than the supported one")
+		require.Nil(t, s)
+	})
+}
+
+func TestMigrateBitcaskToSQLite(t *testing.T) {
+	bitcaskDir := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "offloader.db")
+
+	t.Run("missing bitcask store", func(t *testing.T) {
+		n, err := MigrateBitcaskToSQLite(filepath.Join(bitcaskDir, "missing"), dbPath)
+		require.Error(t, err)
+		require.Zero(t, n)
+	})
+
+	src, err := New(bitcaskDir)
+	require.NoError(t, err)
+	for key, value := range map[string]string{
+		"clientA":       "hash",
+		"job_abc":       `{"type":"recording","start_at":100}`,
+		"clients_index": `["clientA"]`,
+	} {
+		require.NoError(t, src.Set(key, value))
+	}
+	require.NoError(t, src.Close())
+
+	t.Run("success", func(t *testing.T) {
+		n, err := MigrateBitcaskToSQLite(bitcaskDir, dbPath)
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+
+		dst, err := NewWithDriver(DriverSQLite, dbPath)
+		require.NoError(t, err)
+		defer dst.Close()
+
+		val, err := dst.Get("clientA")
+		require.NoError(t, err)
+		require.Equal(t, "hash", val)
+		val, err = dst.Get("job_abc")
+		require.NoError(t, err)
+		require.Equal(t, `{"type":"recording","start_at":100}`, val)
+	})
+
+	t.Run("not empty", func(t *testing.T) {
+		n, err := MigrateBitcaskToSQLite(bitcaskDir, dbPath)
+		require.EqualError(t, err, "sqlite store is not empty")
+		require.Zero(t, n)
+	})
+}
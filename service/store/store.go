@@ -5,6 +5,8 @@ package store
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
@@ -13,14 +15,139 @@ var (
 	ErrConflict = errors.New("error: conflict")
 )
 
+// JournalKeyPrefix prefixes the keys used by stores lacking transactions to
+// journal batches. Callers must not write keys starting with it.
+const JournalKeyPrefix = "store_journal"
+
 type Store interface {
 	Put(key, value string) error
 	Set(key, value string) error
+	// SetWithTTL sets key to value, expiring the entry once ttl has elapsed.
+	// Expired entries are treated as missing and removed by DeleteExpired.
+	// Setting the key again, through any method, replaces the expiration.
+	SetWithTTL(key, value string, ttl time.Duration) error
 	Get(key string) (string, error)
 	Delete(key string) error
+	// Scan calls fn, in key order, for every entry whose key starts with
+	// prefix. An empty prefix matches all keys. Iteration stops at the first
+	// error returned by fn, which is then returned by Scan. The store can be
+	// modified from within fn: entries deleted before being reached are
+	// skipped.
+	Scan(prefix string, fn func(key, value string) error) error
+	// Dump calls fn, in key order, for every entry as of a single point in
+	// time, along with its expiration. The expiration is zero for entries
+	// that never expire, and for all entries of bitcask stores since these
+	// can't be read back. Writes are blocked until it returns so fn should
+	// not access the store.
+	Dump(fn func(key, value string, expiresAt time.Time) error) error
+	// Count returns the number of keys starting with prefix.
+	Count(prefix string) (int, error)
+	// Write applies all the operations in the batch atomically: either all of
+	// them are persisted or none is, even if the process stops half-way.
+	Write(b *Batch) error
+	// DeleteExpired removes all the expired entries.
+	DeleteExpired() error
+	// Stats returns statistics about the data held by the store.
+	Stats() (Stats, error)
+	// Compact rewrites the store's data on disk to reclaim the space used by
+	// deleted and overwritten entries.
+	Compact() error
 	Close() error
 }
 
+// Stats holds statistics about the data held by a store.
+type Stats struct {
+	// The number of keys, possibly including expired ones not removed yet.
+	Keys int `json:"keys"`
+	// The size on disk, in bytes.
+	SizeBytes int64 `json:"size_bytes"`
+	// The size, in bytes, that compacting the store would reclaim.
+	ReclaimableBytes int64 `json:"reclaimable_bytes"`
+}
+
+// GarbageRatio returns the fraction of the size on disk that compacting the
+// store would reclaim.
+func (s Stats) GarbageRatio() float64 {
+	if s.SizeBytes <= 0 {
+		return 0
+	}
+	return float64(s.ReclaimableBytes) / float64(s.SizeBytes)
+}
+
+type batchOp struct {
+	key       string
+	value     string
+	expiresAt time.Time
+	delete    bool
+}
+
+// Batch holds a list of write operations to be applied through Store.Write.
+// Operations are applied in the order they were added.
+type Batch struct {
+	ops []batchOp
+}
+
+// Set adds an operation setting key to value.
+func (b *Batch) Set(key, value string) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// SetWithExpiration adds an operation setting key to value, expiring the
+// entry at the given time. A zero time means the entry never expires.
+func (b *Batch) SetWithExpiration(key, value string, expiresAt time.Time) {
+	b.ops = append(b.ops, batchOp{key: key, value: value, expiresAt: expiresAt})
+}
+
+// Delete adds an operation deleting key. Deleting a missing key is not an
+// error.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) isValid() error {
+	for _, op := range b.ops {
+		if op.key == "" {
+			return ErrEmptyKey
+		}
+	}
+	return nil
+}
+
+type Driver string
+
+const (
+	DriverBitcask Driver = "bitcask"
+	DriverSQLite  Driver = "sqlite"
+)
+
+func (d Driver) IsValid() error {
+	switch d {
+	case DriverBitcask, DriverSQLite:
+		return nil
+	default:
+		return fmt.Errorf("invalid driver %q", d)
+	}
+}
+
+// New creates a bitcask store in the dataSource directory.
 func New(dataSource string) (Store, error) {
-	return newBitcaskStore(dataSource)
+	return NewWithDriver(DriverBitcask, dataSource)
+}
+
+// NewWithDriver creates a store using the given driver. The dataSource is a
+// directory for bitcask and a database file path for SQLite.
+func NewWithDriver(driver Driver, dataSource string) (Store, error) {
+	switch driver {
+	case DriverBitcask:
+		return newBitcaskStore(dataSource)
+	case DriverSQLite:
+		return newSQLiteStore(dataSource)
+	default:
+		return nil, fmt.Errorf("invalid driver %q", driver)
+	}
 }
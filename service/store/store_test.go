@@ -4,10 +4,16 @@
 package store
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -170,3 +176,479 @@ func TestDelete(t *testing.T) {
 		require.Empty(t, val)
 	})
 }
+
+func forEachDriver(t *testing.T, fn func(t *testing.T, store Store)) {
+	t.Helper()
+
+	for _, tc := range []struct {
+		driver     Driver
+		dataSource func(t *testing.T) string
+	}{
+		{
+			driver:     DriverBitcask,
+			dataSource: func(t *testing.T) string { return t.TempDir() },
+		},
+		{
+			driver:     DriverSQLite,
+			dataSource: func(t *testing.T) string { return filepath.Join(t.TempDir(), "offloader.db") },
+		},
+	} {
+		t.Run(string(tc.driver), func(t *testing.T) {
+			store, err := NewWithDriver(tc.driver, tc.dataSource(t))
+			require.NoError(t, err)
+			defer store.Close()
+			fn(t, store)
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, store Store) {
+		for _, key := range []string{"job_b", "job_a", "jobs", "client", "job_c"} {
+			require.NoError(t, store.Set(key, "val_"+key))
+		}
+
+		scan := func(prefix string) map[string]string {
+			t.Helper()
+			entries := map[string]string{}
+			var keys []string
+			err := store.Scan(prefix, func(key, value string) error {
+				entries[key] = value
+				keys = append(keys, key)
+				return nil
+			})
+			require.NoError(t, err)
+			require.IsNonDecreasing(t, keys)
+			return entries
+		}
+
+		t.Run("prefix", func(t *testing.T) {
+			require.Equal(t, map[string]string{
+				"job_a": "val_job_a",
+				"job_b": "val_job_b",
+				"job_c": "val_job_c",
+			}, scan("job_"))
+		})
+
+		t.Run("all", func(t *testing.T) {
+			require.Len(t, scan(""), 5)
+		})
+
+		t.Run("no match", func(t *testing.T) {
+			require.Empty(t, scan("missing"))
+		})
+
+		t.Run("stop", func(t *testing.T) {
+			errStop := errors.New("stop")
+			var n int
+			err := store.Scan("job_", func(_, _ string) error {
+				n++
+				return errStop
+			})
+			require.ErrorIs(t, err, errStop)
+			require.Equal(t, 1, n)
+		})
+
+		t.Run("delete while scanning", func(t *testing.T) {
+			var keys []string
+			err := store.Scan("job_", func(key, _ string) error {
+				keys = append(keys, key)
+				// Deleting the current and the next key.
+				if key == "job_a" {
+					require.NoError(t, store.Delete("job_a"))
+					require.NoError(t, store.Delete("job_b"))
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []string{"job_a", "job_c"}, keys)
+			require.Len(t, scan("job_"), 1)
+		})
+	})
+}
+
+func TestCount(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, store Store) {
+		n, err := store.Count("")
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		for i := 0; i < 10; i++ {
+			require.NoError(t, store.Set(fmt.Sprintf("job_%d", i), "value"))
+		}
+		require.NoError(t, store.Set("client", "value"))
+
+		n, err = store.Count("job_")
+		require.NoError(t, err)
+		require.Equal(t, 10, n)
+
+		n, err = store.Count("")
+		require.NoError(t, err)
+		require.Equal(t, 11, n)
+
+		n, err = store.Count("missing")
+		require.NoError(t, err)
+		require.Zero(t, n)
+	})
+}
+
+func TestWrite(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, store Store) {
+		t.Run("empty key", func(t *testing.T) {
+			var b Batch
+			b.Set("key", "value")
+			b.Set("", "value")
+			require.ErrorIs(t, store.Write(&b), ErrEmptyKey)
+
+			_, err := store.Get("key")
+			require.ErrorIs(t, err, ErrNotFound)
+		})
+
+		t.Run("empty batch", func(t *testing.T) {
+			require.NoError(t, store.Write(&Batch{}))
+		})
+
+		t.Run("valid", func(t *testing.T) {
+			require.NoError(t, store.Set("toDelete", "value"))
+
+			var b Batch
+			b.Set("keyA", "valueA")
+			b.Set("keyB", "valueB")
+			b.Set("keyA", "updated")
+			b.Delete("toDelete")
+			b.Delete("missing")
+			require.Equal(t, 5, b.Len())
+			require.NoError(t, store.Write(&b))
+
+			val, err := store.Get("keyA")
+			require.NoError(t, err)
+			require.Equal(t, "updated", val)
+			val, err = store.Get("keyB")
+			require.NoError(t, err)
+			require.Equal(t, "valueB", val)
+			_, err = store.Get("toDelete")
+			require.ErrorIs(t, err, ErrNotFound)
+		})
+
+		t.Run("expiration", func(t *testing.T) {
+			require.NoError(t, store.SetWithTTL("persisted", "value", time.Millisecond))
+
+			var b Batch
+			b.SetWithExpiration("expiring", "value", time.Now().Add(50*time.Millisecond))
+			b.SetWithExpiration("expired", "value", time.Now().Add(-time.Second))
+			b.SetWithExpiration("persisted", "value", time.Time{})
+			require.NoError(t, store.Write(&b))
+
+			val, err := store.Get("expiring")
+			require.NoError(t, err)
+			require.Equal(t, "value", val)
+			_, err = store.Get("expired")
+			require.ErrorIs(t, err, ErrNotFound)
+
+			time.Sleep(100 * time.Millisecond)
+			_, err = store.Get("expiring")
+			require.ErrorIs(t, err, ErrNotFound)
+			val, err = store.Get("persisted")
+			require.NoError(t, err)
+			require.Equal(t, "value", val)
+		})
+
+		t.Run("concurrent writers", func(t *testing.T) {
+			// Each writer moves a token between two keys. Readers should
+			// never observe a state in which both or none of the keys are set.
+			require.NoError(t, store.Set("token_a", "token"))
+
+			var wg sync.WaitGroup
+			stopCh := make(chan struct{})
+			var nInconsistent int32
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stopCh:
+						return
+					default:
+					}
+					n, err := store.Count("token_")
+					if err != nil || n != 1 {
+						atomic.AddInt32(&nInconsistent, 1)
+					}
+				}
+			}()
+
+			var writersWg sync.WaitGroup
+			var mut sync.Mutex
+			n := 10
+			writersWg.Add(n)
+			for i := 0; i < n; i++ {
+				go func() {
+					defer writersWg.Done()
+					for j := 0; j < 10; j++ {
+						// Serializing the read-modify-write cycle so that
+						// writers build batches from the latest state.
+						mut.Lock()
+						from, to := "token_a", "token_b"
+						if _, err := store.Get(from); errors.Is(err, ErrNotFound) {
+							from, to = to, from
+						}
+						var b Batch
+						b.Delete(from)
+						b.Set(to, "token")
+						err := store.Write(&b)
+						mut.Unlock()
+						if err != nil {
+							atomic.AddInt32(&nInconsistent, 1)
+						}
+					}
+				}()
+			}
+			writersWg.Wait()
+			close(stopCh)
+			wg.Wait()
+
+			require.Zero(t, atomic.LoadInt32(&nInconsistent))
+			count, err := store.Count("token_")
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
+		})
+
+		t.Run("concurrent disjoint writers", func(t *testing.T) {
+			var wg sync.WaitGroup
+			n := 10
+			wg.Add(n)
+			for i := 0; i < n; i++ {
+				go func(i int) {
+					defer wg.Done()
+					var b Batch
+					for j := 0; j < 10; j++ {
+						b.Set(fmt.Sprintf("batch_%d_%d", i, j), "value")
+					}
+					require.NoError(t, store.Write(&b))
+				}(i)
+			}
+			wg.Wait()
+
+			count, err := store.Count("batch_")
+			require.NoError(t, err)
+			require.Equal(t, n*10, count)
+		})
+	})
+}
+
+func TestTTL(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, store Store) {
+		ttl := 100 * time.Millisecond
+
+		require.ErrorIs(t, store.SetWithTTL("", "value", ttl), ErrEmptyKey)
+
+		require.NoError(t, store.SetWithTTL("job_expiring", "value", ttl))
+		require.NoError(t, store.SetWithTTL("job_updated", "value", ttl))
+		require.NoError(t, store.SetWithTTL("job_recreated", "value", ttl))
+		require.NoError(t, store.SetWithTTL("job_extended", "value", ttl))
+		require.NoError(t, store.Set("job_persistent", "value"))
+
+		val, err := store.Get("job_expiring")
+		require.NoError(t, err)
+		require.Equal(t, "value", val)
+		n, err := store.Count("job_")
+		require.NoError(t, err)
+		require.Equal(t, 5, n)
+
+		// Setting without a TTL clears the expiration.
+		require.NoError(t, store.Set("job_updated", "updated"))
+		require.NoError(t, store.SetWithTTL("job_extended", "extended", time.Hour))
+
+		time.Sleep(2 * ttl)
+
+		_, err = store.Get("job_expiring")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		n, err = store.Count("job_")
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+
+		var keys []string
+		err = store.Scan("job_", func(key, _ string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"job_extended", "job_persistent", "job_updated"}, keys)
+
+		// Expired entries don't conflict.
+		require.NoError(t, store.Put("job_recreated", "recreated"))
+
+		require.NoError(t, store.DeleteExpired())
+
+		for key, value := range map[string]string{
+			"job_updated":    "updated",
+			"job_extended":   "extended",
+			"job_recreated":  "recreated",
+			"job_persistent": "value",
+		} {
+			val, err := store.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, value, val)
+		}
+
+		n, err = store.Count("")
+		require.NoError(t, err)
+		require.Equal(t, 4, n)
+	})
+}
+
+func TestCompact(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, store Store) {
+		value := strings.Repeat("a", 1024)
+		for i := 0; i < 500; i++ {
+			require.NoError(t, store.Set(fmt.Sprintf("job_%d", i), value))
+		}
+		for i := 0; i < 500; i++ {
+			if i%10 == 0 {
+				require.NoError(t, store.Set(fmt.Sprintf("job_%d", i), "updated"))
+			} else {
+				require.NoError(t, store.Delete(fmt.Sprintf("job_%d", i)))
+			}
+		}
+
+		stats, err := store.Stats()
+		require.NoError(t, err)
+		require.Equal(t, 50, stats.Keys)
+		require.Positive(t, stats.ReclaimableBytes)
+		require.Greater(t, stats.GarbageRatio(), 0.5)
+
+		require.NoError(t, store.Compact())
+
+		compacted, err := store.Stats()
+		require.NoError(t, err)
+		require.Equal(t, 50, compacted.Keys)
+		require.Less(t, compacted.SizeBytes, stats.SizeBytes)
+		require.Less(t, compacted.GarbageRatio(), 0.5)
+
+		val, err := store.Get("job_10")
+		require.NoError(t, err)
+		require.Equal(t, "updated", val)
+		_, err = store.Get("job_11")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		// The store remains writable.
+		require.NoError(t, store.Set("job_11", "value"))
+		val, err = store.Get("job_11")
+		require.NoError(t, err)
+		require.Equal(t, "value", val)
+	})
+}
+
+func TestBitcaskWriteRollback(t *testing.T) {
+	store, err := New(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.Set("existing", "value"))
+
+	var b Batch
+	b.Set("existing", "updated")
+	b.Set("new", "value")
+	b.Delete("existing")
+	// Exceeding the maximum value size makes the batch fail half-way.
+	b.Set("tooLarge", strings.Repeat("a", 1<<17))
+	require.Error(t, store.Write(&b))
+
+	val, err := store.Get("existing")
+	require.NoError(t, err)
+	require.Equal(t, "value", val)
+	_, err = store.Get("new")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Get("tooLarge")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestBitcaskWriteJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	journal := func(committed bool) {
+		t.Helper()
+		st, err := newBitcaskStore(dir)
+		require.NoError(t, err)
+		require.NoError(t, st.Set("existing", "value"))
+		require.NoError(t, st.Set("toDelete", "value"))
+
+		// A batch journaled by a process which stopped before applying it.
+		ops := []journalOp{
+			{Key: "existing", Value: "updated"},
+			{Key: "new", Value: "value"},
+			{Key: "toDelete", Delete: true},
+		}
+		data, err := json.Marshal(ops)
+		require.NoError(t, err)
+		require.NoError(t, st.put(journalChunkKey(0), string(data), 0))
+		if committed {
+			require.NoError(t, st.put(JournalKeyPrefix, "1", 0))
+		}
+		require.NoError(t, st.db.Close())
+	}
+
+	t.Run("committed", func(t *testing.T) {
+		journal(true)
+
+		st, err := newBitcaskStore(dir)
+		require.NoError(t, err)
+		defer st.Close()
+
+		val, err := st.Get("existing")
+		require.NoError(t, err)
+		require.Equal(t, "updated", val)
+		val, err = st.Get("new")
+		require.NoError(t, err)
+		require.Equal(t, "value", val)
+		_, err = st.Get("toDelete")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		n, err := st.Count(JournalKeyPrefix)
+		require.NoError(t, err)
+		require.Zero(t, n)
+	})
+
+	t.Run("not committed", func(t *testing.T) {
+		require.NoError(t, os.RemoveAll(dir))
+		journal(false)
+
+		st, err := newBitcaskStore(dir)
+		require.NoError(t, err)
+		defer st.Close()
+
+		val, err := st.Get("existing")
+		require.NoError(t, err)
+		require.Equal(t, "value", val)
+		_, err = st.Get("new")
+		require.ErrorIs(t, err, ErrNotFound)
+		_, err = st.Get("toDelete")
+		require.NoError(t, err)
+
+		n, err := st.Count(JournalKeyPrefix)
+		require.NoError(t, err)
+		require.Zero(t, n)
+	})
+
+	t.Run("large batch", func(t *testing.T) {
+		st, err := newBitcaskStore(t.TempDir())
+		require.NoError(t, err)
+		defer st.Close()
+
+		// Spanning multiple journal chunks.
+		var b Batch
+		for i := range 100 {
+			b.Set(fmt.Sprintf("key%d", i), strings.Repeat("a", 1<<10))
+		}
+		require.NoError(t, st.Write(&b))
+
+		n, err := st.Count("key")
+		require.NoError(t, err)
+		require.Equal(t, 100, n)
+		n, err = st.Count(JournalKeyPrefix)
+		require.NoError(t, err)
+		require.Zero(t, n)
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/calls-offloader/service/store"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+// These handlers are restricted to the admin through adminOnly.
+
+func (s *Service) handleGetStoreStats(w http.ResponseWriter, r *http.Request) {
+	data := newHTTPData()
+	defer s.httpAudit("handleGetStoreStats", data, w, r)
+
+	stats, err := s.store.Stats()
+	if err != nil {
+		data.err = "failed to get store stats: " + err.Error()
+		data.code = http.StatusInternalServerError
+		return
+	}
+
+	data.code = http.StatusOK
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		s.log.Error("failed to encode response", mlog.Err(err))
+	}
+}
+
+func (s *Service) handleCompactStore(w http.ResponseWriter, r *http.Request) {
+	data := newHTTPData()
+	defer s.httpAudit("handleCompactStore", data, w, r)
+
+	stats, _, err := s.compactStore(true)
+	if err != nil {
+		data.err = "failed to compact store: " + err.Error()
+		data.code = http.StatusInternalServerError
+		return
+	}
+
+	data.code = http.StatusOK
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		s.log.Error("failed to encode response", mlog.Err(err))
+	}
+}
+
+func (s *Service) handleReencryptStore(w http.ResponseWriter, r *http.Request) {
+	data := newHTTPData()
+	defer s.httpAudit("handleReencryptStore", data, w, r)
+
+	n, err := s.reencryptJobRecords()
+	if err != nil {
+		data.err = "failed to re-encrypt store: " + err.Error()
+		data.code = http.StatusInternalServerError
+		return
+	}
+
+	data.code = http.StatusOK
+
+	if err := json.NewEncoder(w).Encode(map[string]int{"reencrypted": n}); err != nil {
+		s.log.Error("failed to encode response", mlog.Err(err))
+	}
+}
+
+func (s *Service) handleGetStoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	data := newHTTPData()
+	// The response writer is dropped from the audit once the snapshot has
+	// started streaming, see below.
+	auditW := w
+	defer func() { s.httpAudit("handleGetStoreSnapshot", data, auditW, r) }()
+
+	filename := fmt.Sprintf("calls-offloader-snapshot-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	// The snapshot is streamed so that the store isn't held in memory.
+	cw := &countingWriter{w: w}
+	manifest, err := store.WriteSnapshot(s.store, s.cfg.Store.GetDriver(), cw)
+	if err != nil && cw.n > 0 {
+		// The status has already been sent along with part of the archive.
+		// Aborting the connection makes sure the client doesn't mistake it
+		// for a complete snapshot.
+		data.err = "failed to write snapshot: " + err.Error()
+		data.code = http.StatusOK
+		auditW = nil
+		panic(http.ErrAbortHandler)
+	} else if err != nil {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Disposition")
+		data.err = "failed to write snapshot: " + err.Error()
+		data.code = http.StatusInternalServerError
+		return
+	}
+
+	s.log.Info("store snapshot taken", mlog.Int("entries", manifest.Entries), mlog.Int("size_bytes", cw.n))
+
+	data.code = http.StatusOK
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package service
+
+import (
+	"time"
+
+	"github.com/mattermost/calls-offloader/service/store"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+// storeSweepInterval is how often expired entries are removed from the store.
+var storeSweepInterval = 10 * time.Minute
+
+func storeStatsLogFields(stats store.Stats) []mlog.Field {
+	return []mlog.Field{
+		mlog.Int("keys", stats.Keys),
+		mlog.Int("size_bytes", stats.SizeBytes),
+		mlog.Int("reclaimable_bytes", stats.ReclaimableBytes),
+		mlog.Float("garbage_ratio", stats.GarbageRatio()),
+	}
+}
+
+// compactStore compacts the store, unless force is false and the reclaimable
+// space is below the configured threshold. It returns the stats after
+// compaction and whether compaction ran.
+func (s *Service) compactStore(force bool) (store.Stats, bool, error) {
+	stats, err := s.store.Stats()
+	if err != nil {
+		return store.Stats{}, false, err
+	}
+	s.log.Info("store stats", storeStatsLogFields(stats)...)
+
+	if !force && (stats.ReclaimableBytes == 0 || stats.GarbageRatio() < s.cfg.Store.CompactionGarbageThreshold) {
+		return stats, false, nil
+	}
+
+	start := time.Now()
+	if err := s.store.Compact(); err != nil {
+		return stats, false, err
+	}
+
+	stats, err = s.store.Stats()
+	if err != nil {
+		return store.Stats{}, true, err
+	}
+	s.log.Info("store compacted", append(storeStatsLogFields(stats), mlog.Any("duration", time.Since(start)))...)
+
+	return stats, true, nil
+}
+
+// maintainStore periodically removes expired entries from the store and, if
+// enabled, compacts it until stopCh is closed.
+func (s *Service) maintainStore(stopCh <-chan struct{}) {
+	if _, err := s.reencryptJobRecords(); err != nil {
+		s.log.Error("failed to re-encrypt job records", mlog.Err(err))
+	}
+
+	if _, err := s.expireJobRecords(); err != nil {
+		s.log.Error("failed to expire job records", mlog.Err(err))
+	}
+
+	sweepTicker := time.NewTicker(storeSweepInterval)
+	defer sweepTicker.Stop()
+
+	// A nil channel disables scheduled compaction.
+	var compactCh <-chan time.Time
+	if s.cfg.Store.CompactionIntervalMinutes > 0 {
+		compactTicker := time.NewTicker(time.Duration(s.cfg.Store.CompactionIntervalMinutes) * time.Minute)
+		defer compactTicker.Stop()
+		compactCh = compactTicker.C
+	}
+
+	for {
+		select {
+		case <-sweepTicker.C:
+			if err := s.store.DeleteExpired(); err != nil {
+				s.log.Error("failed to delete expired store entries", mlog.Err(err))
+			}
+		case <-compactCh:
+			if _, _, err := s.compactStore(false); err != nil {
+				s.log.Error("failed to compact store", mlog.Err(err))
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2022-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/calls-offloader/service/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactStore(t *testing.T) {
+	s := newJobStoreTestService(t)
+	s.cfg.Store.CompactionGarbageThreshold = 0.5
+
+	value := strings.Repeat("a", 1024)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.store.Set(fmt.Sprintf("key_%d", i), value))
+	}
+
+	t.Run("below threshold", func(t *testing.T) {
+		stats, compacted, err := s.compactStore(false)
+		require.NoError(t, err)
+		require.False(t, compacted)
+		require.Equal(t, 100, stats.Keys)
+	})
+
+	for i := 0; i < 90; i++ {
+		require.NoError(t, s.store.Delete(fmt.Sprintf("key_%d", i)))
+	}
+
+	t.Run("above threshold", func(t *testing.T) {
+		stats, compacted, err := s.compactStore(false)
+		require.NoError(t, err)
+		require.True(t, compacted)
+		require.Equal(t, 10, stats.Keys)
+		require.Zero(t, stats.ReclaimableBytes)
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		_, compacted, err := s.compactStore(true)
+		require.NoError(t, err)
+		require.True(t, compacted)
+	})
+}
+
+func TestStoreAPI(t *testing.T) {
+	s := newJobStoreTestService(t)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.store.Set(fmt.Sprintf("key_%d", i), "value"))
+	}
+	require.NoError(t, s.store.Delete("key_0"))
+
+	t.Run("stats", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.handleGetStoreStats(w, httptest.NewRequest("GET", "/store/stats", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var stats store.Stats
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&stats))
+		require.Equal(t, 9, stats.Keys)
+		require.Positive(t, stats.SizeBytes)
+		require.Positive(t, stats.ReclaimableBytes)
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.handleCompactStore(w, httptest.NewRequest("POST", "/store/compact", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var stats store.Stats
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&stats))
+		require.Equal(t, 9, stats.Keys)
+		require.Zero(t, stats.ReclaimableBytes)
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.handleGetStoreSnapshot(w, httptest.NewRequest("GET", "/store/snapshot", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+		require.Contains(t, w.Header().Get("Content-Disposition"), "calls-offloader-snapshot-")
+
+		dbPath := filepath.Join(t.TempDir(), "offloader.db")
+		manifest, err := store.RestoreSnapshot(w.Body, store.DriverSQLite, dbPath)
+		require.NoError(t, err)
+		require.Equal(t, store.DriverBitcask, manifest.Driver)
+		require.Equal(t, 9, manifest.Entries)
+	})
+
+	t.Run("snapshot failing mid-stream", func(t *testing.T) {
+		w := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+		require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			s.handleGetStoreSnapshot(w, httptest.NewRequest("GET", "/store/snapshot", nil))
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("reencrypt", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.handleReencryptStore(w, httptest.NewRequest("POST", "/store/reencrypt", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{"reencrypted":0}`, w.Body.String())
+	})
+}
+
+// failingResponseWriter fails all writes but the first one.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	written bool
+}
+
+func (w *failingResponseWriter) Write(p []byte) (int, error) {
+	if w.written {
+		return 0, errors.New("connection reset")
+	}
+	w.written = true
+	return w.ResponseRecorder.Write(p)
+}